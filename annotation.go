@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// annotation severities in ascending order
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+var severityRank = map[string]int{
+	SeverityInfo:     1,
+	SeverityWarning:  2,
+	SeverityCritical: 3,
+}
+
+// maxSeverity returns the more severe one, unknown severities rank lowest
+func maxSeverity(a, b string) string {
+	if severityRank[b] > severityRank[a] {
+		return b
+	}
+	if len(a) == 0 {
+		return b
+	}
+	return a
+}
+
+// annotationRegion is a merged annotation with the number of source annotations
+type annotationRegion struct {
+	item  QueryAnnotationItem
+	end   int64
+	times map[int64]struct{}
+}
+
+func (r *annotationRegion) key() string {
+	return fmt.Sprintf("%d\x00%s\x00%s\x00%s", r.item.PanelID, r.item.Title, r.item.Tags, r.item.Category)
+}
+
+func annotationEnd(item *QueryAnnotationItem) int64 {
+	if item.TimeEnd > item.Time {
+		return item.TimeEnd
+	}
+	return item.Time
+}
+
+// MergeAnnotations merges the overlapping or adjacent annotations sharing the same
+// panel, title, tags and category. Annotations are adjacent when the gap between them is no
+// more than gap. Annotations with the same start time are counted once, so the rows
+// of different fields from one influxdb point collapse into one region.
+func MergeAnnotations(items QueryAnnotationsData, gap time.Duration) QueryAnnotationsData {
+	if len(items) == 0 {
+		return items
+	}
+	sorted := make(QueryAnnotationsData, len(items))
+	copy(sorted, items)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time < sorted[j].Time
+	})
+
+	gapMillis := int64(gap / time.Millisecond)
+	regions := make([]*annotationRegion, 0)
+	opened := make(map[string]*annotationRegion)
+	for i := range sorted {
+		item := sorted[i]
+		r := &annotationRegion{item: item, end: annotationEnd(&item), times: map[int64]struct{}{item.Time: {}}}
+		cur, ok := opened[r.key()]
+		if ok && item.Time <= cur.end+gapMillis {
+			cur.times[item.Time] = struct{}{}
+			cur.item.Severity = maxSeverity(cur.item.Severity, item.Severity)
+			if r.end > cur.end {
+				cur.end = r.end
+				cur.item.TimeEnd = r.end
+				cur.item.TimeEndText = item.TimeEndText
+				if item.TimeEnd <= item.Time {
+					cur.item.TimeEndText = item.TimeText
+				}
+			}
+			continue
+		}
+		opened[r.key()] = r
+		regions = append(regions, r)
+	}
+
+	merged := make(QueryAnnotationsData, 0, len(regions))
+	for _, r := range regions {
+		if cnt := len(r.times); cnt > 1 {
+			r.item.Text = fmt.Sprintf("%s (merged %d regions", r.item.Text, cnt)
+			if len(r.item.Severity) > 0 {
+				r.item.Text = fmt.Sprintf("%s, max severity %s", r.item.Text, r.item.Severity)
+			}
+			r.item.Text += ")"
+		}
+		merged = append(merged, r.item)
+	}
+	return merged
+}
+
+// AnnotationFilter selects annotations by severity or category, e.g. severity>=warning
+type AnnotationFilter struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// filter fields and operators, the ordering operators only apply to severity
+const (
+	AnnotationFilterSeverity = "severity"
+	AnnotationFilterCategory = "category"
+)
+
+var annotationFilterOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+// ParseAnnotationFilter parses the expression `<field><op><value>`
+func ParseAnnotationFilter(expr string) (*AnnotationFilter, error) {
+	for _, op := range annotationFilterOps {
+		idx := strings.Index(expr, op)
+		if idx <= 0 {
+			continue
+		}
+		f := &AnnotationFilter{
+			Field: strings.TrimSpace(expr[:idx]),
+			Op:    op,
+			Value: strings.TrimSpace(expr[idx+len(op):]),
+		}
+		switch f.Field {
+		case AnnotationFilterSeverity:
+			if _, ok := severityRank[f.Value]; !ok {
+				return nil, fmt.Errorf("filter %q: unknown severity %q", expr, f.Value)
+			}
+		case AnnotationFilterCategory:
+			if op != "=" && op != "!=" {
+				return nil, fmt.Errorf("filter %q: category only supports = and !=", expr)
+			}
+		default:
+			return nil, fmt.Errorf("filter %q: unknown field %q", expr, f.Field)
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("filter %q: missing operator", expr)
+}
+
+// Match reports whether the annotation satisfies the filter
+func (f *AnnotationFilter) Match(item *QueryAnnotationItem) bool {
+	if f.Field == AnnotationFilterCategory {
+		return (item.Category == f.Value) == (f.Op == "=")
+	}
+	if f.Op == "=" || f.Op == "!=" {
+		return (item.Severity == f.Value) == (f.Op == "=")
+	}
+	got, want := severityRank[item.Severity], severityRank[f.Value]
+	switch f.Op {
+	case ">=":
+		return got >= want
+	case "<=":
+		return got <= want
+	case ">":
+		return got > want
+	default:
+		return got < want
+	}
+}
+
+// FilterAnnotations keeps the annotations matching all filters
+func FilterAnnotations(items QueryAnnotationsData, filters []*AnnotationFilter) QueryAnnotationsData {
+	if len(filters) == 0 {
+		return items
+	}
+	filtered := make(QueryAnnotationsData, 0, len(items))
+	for i := range items {
+		matched := true
+		for _, f := range filters {
+			if !f.Match(&items[i]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			filtered = append(filtered, items[i])
+		}
+	}
+	return filtered
+}
+
+// defaultAnnotationStyles colors the annotations by severity when no configured style matches
+var defaultAnnotationStyles = []*AnnotationStyleConfig{
+	{Severity: SeverityInfo, IconColor: "rgba(50, 116, 217, 1)"},
+	{Severity: SeverityWarning, IconColor: "rgba(255, 152, 48, 1)"},
+	{Severity: SeverityCritical, IconColor: "rgba(255, 96, 96, 1)"},
+}
+
+// matchAnnotationStyle returns the most specific style of the category and severity,
+// a style with both matched wins over the one with only the category or the severity.
+func matchAnnotationStyle(styles []*AnnotationStyleConfig, category string, severity string) *AnnotationStyleConfig {
+	var best *AnnotationStyleConfig
+	bestScore := -1
+	for _, style := range styles {
+		score := 0
+		if len(style.Category) > 0 {
+			if style.Category != category {
+				continue
+			}
+			score += 2
+		}
+		if len(style.Severity) > 0 {
+			if style.Severity != severity {
+				continue
+			}
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = style, score
+		}
+	}
+	return best
+}
+
+// NewStyledAnnotation returns the annotation styled by the category and severity
+func NewStyledAnnotation(styles []*AnnotationStyleConfig, category string, severity string) *Annotation {
+	annotation := DefaultAnomalyAnnotation()
+	style := matchAnnotationStyle(styles, category, severity)
+	if style == nil {
+		return annotation
+	}
+	if len(style.Name) > 0 {
+		annotation.Name = style.Name
+	}
+	if len(style.IconColor) > 0 {
+		annotation.IconColor = style.IconColor
+	}
+	if style.ShowLine != nil {
+		annotation.ShowLine = *style.ShowLine
+	}
+	return annotation
+}
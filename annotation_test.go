@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeAnnotations(t *testing.T) {
+	assert := require.New(t)
+	items := QueryAnnotationsData{
+		{Time: 1000, TimeEnd: 5000, Title: "stall", Tags: "tikv", Text: "write stall", PanelID: 1, Severity: SeverityWarning},
+		// overlaps with the first one
+		{Time: 3000, TimeEnd: 8000, Title: "stall", Tags: "tikv", Text: "write stall", PanelID: 1, Severity: SeverityCritical},
+		// adjacent within the gap
+		{Time: 9000, Title: "stall", Tags: "tikv", Text: "write stall", PanelID: 1, Severity: SeverityInfo},
+		// another field row of the same point
+		{Time: 9000, Title: "stall", Tags: "tikv", Text: "write stall", PanelID: 1},
+		// out of the gap
+		{Time: 20000, TimeEnd: 21000, Title: "stall", Tags: "tikv", Text: "write stall", PanelID: 1},
+		// same time range but different panel
+		{Time: 2000, TimeEnd: 4000, Title: "stall", Tags: "tikv", Text: "write stall", PanelID: 2},
+		// overlaps with the first one but has another category
+		{Time: 4000, TimeEnd: 6000, Title: "stall", Tags: "tikv", Text: "write stall", PanelID: 1, Category: "config"},
+	}
+	merged := MergeAnnotations(items, 2*time.Second)
+	assert.Len(merged, 4)
+
+	assert.Equal(int64(1000), merged[0].Time)
+	assert.Equal(int64(9000), merged[0].TimeEnd)
+	assert.Equal(int64(1), merged[0].PanelID)
+	assert.Equal(SeverityCritical, merged[0].Severity)
+	assert.Equal("write stall (merged 3 regions, max severity critical)", merged[0].Text)
+
+	assert.Equal(int64(2), merged[1].PanelID)
+	assert.Equal("write stall", merged[1].Text)
+
+	assert.Equal(int64(4000), merged[2].Time)
+	assert.Equal("config", merged[2].Category)
+	assert.Equal("write stall", merged[2].Text)
+
+	assert.Equal(int64(20000), merged[3].Time)
+	assert.Equal(int64(21000), merged[3].TimeEnd)
+	assert.Equal("write stall", merged[3].Text)
+
+	// the input is left untouched
+	assert.Equal("write stall", items[0].Text)
+	assert.Equal(int64(5000), items[0].TimeEnd)
+}
+
+func TestFilterAnnotations(t *testing.T) {
+	assert := require.New(t)
+	items := QueryAnnotationsData{
+		{Title: "a", Severity: SeverityInfo, Category: "disk"},
+		{Title: "b", Severity: SeverityWarning, Category: "disk"},
+		{Title: "c", Severity: SeverityCritical, Category: "cpu"},
+		{Title: "d"},
+	}
+	parse := func(exprs ...string) []*AnnotationFilter {
+		filters := make([]*AnnotationFilter, 0, len(exprs))
+		for _, expr := range exprs {
+			f, err := ParseAnnotationFilter(expr)
+			assert.Nil(err, expr)
+			filters = append(filters, f)
+		}
+		return filters
+	}
+	titles := func(items QueryAnnotationsData) []string {
+		res := make([]string, 0, len(items))
+		for _, item := range items {
+			res = append(res, item.Title)
+		}
+		return res
+	}
+	assert.Equal([]string{"b", "c"}, titles(FilterAnnotations(items, parse("severity>=warning"))))
+	assert.Equal([]string{"b"}, titles(FilterAnnotations(items, parse("severity>=warning", "category=disk"))))
+	assert.Equal([]string{"c", "d"}, titles(FilterAnnotations(items, parse("category!=disk"))))
+	assert.Equal([]string{"a", "d"}, titles(FilterAnnotations(items, parse("severity<warning"))))
+
+	for _, expr := range []string{"severity>=fatal", "category>=disk", "panel=1", "severity"} {
+		_, err := ParseAnnotationFilter(expr)
+		assert.NotNil(err, expr)
+	}
+}
+
+func TestNewStyledAnnotation(t *testing.T) {
+	assert := require.New(t)
+	hide := false
+	styles := append([]*AnnotationStyleConfig{
+		{Category: "disk", Name: "Disk Anomaly", IconColor: "blue"},
+		{Category: "disk", Severity: SeverityCritical, Name: "Disk Critical", ShowLine: &hide},
+	}, defaultAnnotationStyles...)
+
+	a := NewStyledAnnotation(styles, "disk", SeverityCritical)
+	assert.Equal("Disk Critical", a.Name)
+	assert.Equal(DefaultAnomalyAnnotation().IconColor, a.IconColor)
+	assert.False(a.ShowLine)
+
+	a = NewStyledAnnotation(styles, "disk", SeverityWarning)
+	assert.Equal("Disk Anomaly", a.Name)
+	assert.Equal("blue", a.IconColor)
+	assert.True(a.ShowLine)
+
+	a = NewStyledAnnotation(styles, "cpu", SeverityWarning)
+	assert.Equal(DefaultAnomalyAnnotation().Name, a.Name)
+	assert.Equal("rgba(255, 152, 48, 1)", a.IconColor)
+
+	assert.Equal(DefaultAnomalyAnnotation(), NewStyledAnnotation(styles, "", ""))
+}
+
+func TestAnnotationParam(t *testing.T) {
+	assert := require.New(t)
+	param := &AnnotationParam{
+		ID:            "abc",
+		TiDBClusterID: "clinic",
+		Time:          1640995200000,
+		TimeEnd:       1640995260500,
+		PanelID:       12,
+		Title:         "write stall",
+		Severity:      SeverityWarning,
+	}
+	assert.Nil(param.Validate())
+	assert.Equal("fast_tune_anomaly", param.Measurement)
+	assert.Equal(map[string]string{
+		"tidb_cluster_id": "clinic",
+		"annotation_id":   "abc",
+		"panel_id":        "12",
+		"title":           "write stall",
+		"severity":        SeverityWarning,
+	}, param.GetTags())
+	assert.Equal(map[string]interface{}{"end_time": 1640995260.5}, param.GetFields())
+	assert.Equal(int64(1640995200000), toMillis(param.GetTime()))
+
+	invalid := []*AnnotationParam{
+		{Time: 1, Title: "t"},
+		{TiDBClusterID: "clinic", Title: "t"},
+		{TiDBClusterID: "clinic", Time: 10, TimeEnd: 5, Title: "t"},
+		{TiDBClusterID: "clinic", Time: 10, PanelID: -1, Title: "t"},
+		{TiDBClusterID: "clinic", Time: 10},
+		{TiDBClusterID: "clinic", Time: 10, Title: "t", Severity: "fatal"},
+	}
+	for _, p := range invalid {
+		assert.NotNil(p.Validate(), "%+v", p)
+	}
+}
+
+func TestValidateAnnotationKey(t *testing.T) {
+	assert := require.New(t)
+	id, err := NewAnnotationID()
+	assert.Nil(err)
+	assert.Nil(ValidateAnnotationKey("clinic-1.a:b", "fast_tune_anomaly", id))
+	assert.Nil(ValidateAnnotationKey("clinic", "", ""))
+
+	err = ValidateAnnotationKey(`c",tidb_cluster_id=~".*`, "fast.*", `x",annotation_id=~".*`)
+	assert.Equal([]string{"tidb_cluster_id", "measurement", "id"}, fieldsOf(err))
+	for _, id := range []string{"abc", "0123456789ABCDEF", "0123456789abcdef0"} {
+		assert.NotNil(ValidateAnnotationKey("clinic", "", id), id)
+	}
+	assert.NotNil((&AnnotationParam{TiDBClusterID: `c" OR "1"="1`, Time: 10, Title: "t"}).Validate())
+}
+
+// fakeAnnotationVM stores the revisions of the annotation ids with a series in vm,
+// the revision of the series without the label is empty
+type fakeAnnotationVM struct {
+	mu         sync.Mutex
+	ids        map[string]map[string]bool
+	failWrites bool
+	requests   []string
+}
+
+func (f *fakeAnnotationVM) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	bs, _ := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewReader(bs))
+	_ = req.ParseForm()
+	match := req.Form.Get("match[]")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req.URL.Path+" "+match)
+	id := regexp.MustCompile(`annotation_id="([0-9a-f]+)"`).FindStringSubmatch(match)
+	switch req.URL.Path {
+	case "/api/v1/series":
+		data := make([]map[string]string, 0)
+		if len(id) == 2 {
+			for revision := range f.ids[id[1]] {
+				labels := map[string]string{"__name__": "fast_tune_anomaly_end_time", "annotation_id": id[1]}
+				if len(revision) > 0 {
+					labels["revision"] = revision
+				}
+				data = append(data, labels)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": data})
+	case "/api/v1/admin/tsdb/delete_series":
+		if revision := regexp.MustCompile(`revision="([0-9a-f]*)"`).FindStringSubmatch(match); len(revision) == 2 {
+			delete(f.ids[id[1]], revision[1])
+		} else {
+			delete(f.ids, id[1])
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "/influx/api/v2/write":
+		if f.failWrites {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		written := regexp.MustCompile(`annotation_id=([0-9a-f]+)`).FindStringSubmatch(string(bs))
+		revision := regexp.MustCompile(`revision=([0-9a-f]+)`).FindStringSubmatch(string(bs))
+		if f.ids[written[1]] == nil {
+			f.ids[written[1]] = make(map[string]bool)
+		}
+		f.ids[written[1]][revision[1]] = true
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestAnnotationEndpoints(t *testing.T) {
+	assert := require.New(t)
+	existing, err := NewAnnotationID()
+	assert.Nil(err)
+	fake := &fakeAnnotationVM{ids: map[string]map[string]bool{existing: {"": true}}}
+	vm := httptest.NewServer(fake)
+	defer vm.Close()
+	reportAPI, err := NewReportAPI("http://127.0.0.1:0", "org", "bucket", "token", WithVMOption(vm.URL),
+		WithSessionOption(&SessionConfig{Dir: filepath.Join(t.TempDir(), "sessions")}))
+	assert.Nil(err)
+	defer reportAPI.Close()
+	dataAPI, err := NewDataAPI(vm.URL)
+	assert.Nil(err)
+	router := NewRouter(&ReportEndpoint{}, reportAPI, dataAPI)
+	do := func(method, target string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	// the hostile values never reach vm
+	hostile := url.PathEscape(`x",annotation_id=~".*`)
+	assert.Equal(http.StatusBadRequest, do(http.MethodDelete, "/annotations/"+hostile+"?tidb_cluster_id=clinic", "").Code)
+	assert.Equal(http.StatusBadRequest, do(http.MethodDelete, "/annotations/"+existing+"?tidb_cluster_id="+
+		url.QueryEscape(`clinic",tidb_cluster_id=~".*`), "").Code)
+	assert.Equal(http.StatusBadRequest, do(http.MethodDelete, "/annotations/"+existing+"?tidb_cluster_id=clinic&measurement=.*", "").Code)
+	body := `{"tidb_cluster_id":"clinic","time":1000,"title":"t"}`
+	assert.Equal(http.StatusBadRequest, do(http.MethodPut, "/annotations/"+hostile, body).Code)
+	assert.Empty(fake.requests)
+
+	// the unknown id is not created by put
+	missing, err := NewAnnotationID()
+	assert.Nil(err)
+	assert.Equal(http.StatusNotFound, do(http.MethodPut, "/annotations/"+missing, body).Code)
+	assert.Equal(http.StatusNotFound, do(http.MethodDelete, "/annotations/"+missing+"?tidb_cluster_id=clinic", "").Code)
+	for _, r := range fake.requests {
+		assert.True(strings.HasPrefix(r, "/api/v1/series "), r)
+	}
+
+	// the failed write keeps the annotation
+	fake.failWrites = true
+	assert.Equal(http.StatusInternalServerError, do(http.MethodPut, "/annotations/"+existing, body).Code)
+	assert.Equal(map[string]bool{"": true}, fake.ids[existing])
+	fake.failWrites = false
+
+	// the new revision replaces the old ones
+	assert.Equal(http.StatusOK, do(http.MethodPut, "/annotations/"+existing, body).Code)
+	assert.Contains(fake.requests, "/api/v1/admin/tsdb/delete_series "+
+		`{__name__=~"fast_tune_anomaly.*",tidb_cluster_id="clinic",annotation_id="`+existing+`",revision=""}`)
+	assert.Len(fake.ids[existing], 1)
+	assert.False(fake.ids[existing][""])
+	assert.Equal(http.StatusOK, do(http.MethodPut, "/annotations/"+existing, body).Code)
+	assert.Len(fake.ids[existing], 1)
+	assert.Equal(http.StatusOK, do(http.MethodDelete, "/annotations/"+existing+"?tidb_cluster_id=clinic", "").Code)
+	assert.Contains(fake.requests, "/api/v1/admin/tsdb/delete_series "+
+		`{__name__=~"fast_tune_anomaly.*",tidb_cluster_id="clinic",annotation_id="`+existing+`"}`)
+	assert.Equal(http.StatusNotFound, do(http.MethodDelete, "/annotations/"+existing+"?tidb_cluster_id=clinic", "").Code)
+}
+
+func TestDeleteAnnotationInfluxDB(t *testing.T) {
+	assert := require.New(t)
+	id, err := NewAnnotationID()
+	assert.Nil(err)
+	var query, deleteBody string
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		bs, _ := io.ReadAll(req.Body)
+		switch req.URL.Path {
+		case "/api/v2/query":
+			body := struct {
+				Query string `json:"query"`
+			}{}
+			_ = json.Unmarshal(bs, &body)
+			query = body.Query
+			w.Header().Set("Content-Type", "text/csv")
+			if strings.Contains(query, id) {
+				// the annotation is a year ahead, beyond any fixed window from now
+				fmt.Fprint(w, "#datatype,string,long,dateTime:RFC3339,double,string,string\n"+
+					"#group,false,false,false,false,true,true\n"+
+					"#default,_result,,,,,\n"+
+					",result,table,_time,_value,_field,_measurement\n"+
+					",,0,"+time.Now().AddDate(1, 0, 0).UTC().Format(time.RFC3339)+",1,end_time,fast_tune_anomaly\n\n")
+			}
+		case "/api/v2/delete":
+			deleteBody = string(bs)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer influx.Close()
+	reportAPI, err := NewReportAPI(influx.URL, "org", "bucket", "token",
+		WithSessionOption(&SessionConfig{Dir: filepath.Join(t.TempDir(), "sessions")}))
+	assert.Nil(err)
+	defer reportAPI.Close()
+
+	missing, err := NewAnnotationID()
+	assert.Nil(err)
+	assert.Equal(ErrAnnotationNotFound, reportAPI.DeleteAnnotation(context.Background(), "clinic", "", missing))
+	assert.Empty(deleteBody)
+
+	assert.Nil(reportAPI.DeleteAnnotation(context.Background(), "clinic", "", id))
+	assert.Contains(query, "range(start: 0, stop: 2262-04-11T23:47:16.854775806Z)")
+	assert.Contains(query, `group(columns: ["revision"])`)
+	assert.Contains(deleteBody, `"stop":"2262-04-11T23:47:16.854775806Z"`)
+	assert.Contains(deleteBody, `annotation_id=\"`+id+`\"`)
+}
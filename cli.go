@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultConfigPath = "./config.yaml"
+
+// command is a subcommand of reportd, args are the ones after the command name
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error
+}
+
+var commands = []*command{
+	{
+		name:    "serve",
+		usage:   "serve [-c config.yaml]",
+		summary: "run the http server, it is the default command",
+		run: func(ctx context.Context, args []string, _ io.Reader, _ io.Writer) error {
+			return runServe(ctx, args)
+		},
+	},
+	{
+		name:    "query",
+		usage:   "query <node-graph|annotations|text> [-c config.yaml] [-o json|table] [-api version] key=value...",
+		summary: "call the query api directly, key=value are the query params of the http api",
+		run: func(ctx context.Context, args []string, _ io.Reader, stdout io.Writer) error {
+			return runQuery(ctx, args, stdout)
+		},
+	},
+	{
+		name:    "ingest",
+		usage:   "ingest [-c config.yaml] [-v2] [-dry-run] < samples.ndjson",
+		summary: "insert the samples read from stdin, one json sample per line",
+		run:     runIngest,
+	},
+	{
+		name:    "migrate",
+		usage:   "migrate [-c config.yaml] -start time [flags]",
+		summary: "copy influxdb measurements to vm",
+		run: func(ctx context.Context, args []string, _ io.Reader, stdout io.Writer) error {
+			return runMigrate(ctx, args, stdout)
+		},
+	},
+	{
+		name:    "validate-config",
+		usage:   "validate-config [-c config.yaml]",
+		summary: "check config.yaml and the diagnosis trees without starting the server",
+		run: func(ctx context.Context, args []string, _ io.Reader, stdout io.Writer) error {
+			return runValidateConfig(ctx, args, stdout)
+		},
+	},
+}
+
+// runCLI dispatches args to the command and returns the exit code. serve is run when
+// args start with a flag, so `reportd -c config.yaml` keeps working.
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		printUsage(stdout)
+		return 0
+	}
+	var cmd *command
+	for _, c := range commands {
+		if c.name == name {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(stderr, "unknown command %q\n", name)
+		printUsage(stderr)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := cmd.run(ctx, args, stdin, stdout); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: reportd <command> [flags]")
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  reportd %s\n", c.usage)
+	}
+}
+
+// configFlag registers the -c flag shared by all commands
+func configFlag(fs *flag.FlagSet) *string {
+	return fs.String("c", defaultConfigPath, "path to config.yaml")
+}
+
+// drainTimeoutFromConfig returns the server.drain_timeout, defaultDrainTimeout when it is not set
+func drainTimeoutFromConfig(cfg *Config) (time.Duration, error) {
+	if cfg.Server == nil || len(cfg.Server.DrainTimeout) == 0 {
+		return defaultDrainTimeout, nil
+	}
+	d, err := time.ParseDuration(cfg.Server.DrainTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("server.drain_timeout: %w", err)
+	}
+	return d, nil
+}
+
+// maxRangeFromConfig returns the query.max_range, zero lets the decoder use its default
+func maxRangeFromConfig(cfg *Config) (time.Duration, error) {
+	if cfg.Query == nil || len(cfg.Query.MaxRange) == 0 {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(cfg.Query.MaxRange)
+	if err != nil {
+		return 0, fmt.Errorf("query.max_range: %w", err)
+	}
+	return d, nil
+}
+
+// loadReportAPI reads the config and builds the ReportAPI, the caller must close it
+func loadReportAPI(cfgPath string) (*Config, *ReportAPI, error) {
+	cfg, err := InitConfig(cfgPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := InitLogger(cfg.Log); err != nil {
+		return nil, nil, err
+	}
+	reportAPI, err := NewReportAPIFromConfig(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, reportAPI, nil
+}
+
+// query kinds of the query command
+const (
+	queryNodeGraph   = "node-graph"
+	queryAnnotations = "annotations"
+	queryText        = "text"
+)
+
+// output formats of the query command
+const (
+	outputJSON  = "json"
+	outputTable = "table"
+)
+
+func runQuery(ctx context.Context, args []string, w io.Writer) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf("query needs one of %s, %s, %s", queryNodeGraph, queryAnnotations, queryText)
+	}
+	kind := args[0]
+	fs := flag.NewFlagSet("query "+kind, flag.ContinueOnError)
+	var (
+		cfgPath = configFlag(fs)
+		output  = fs.String("o", outputJSON, "output format, json or table")
+		version = fs.String("api", "", "api version, default is the latest one")
+	)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *output != outputJSON && *output != outputTable {
+		return fmt.Errorf("output %q is not json or table", *output)
+	}
+	values, err := parseQueryValues(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	cfg, reportAPI, err := loadReportAPI(*cfgPath)
+	if err != nil {
+		return err
+	}
+	defer reportAPI.Close()
+	maxRange, err := maxRangeFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+	d := NewParamDecoder(values, maxRange)
+	var data interface{}
+	switch kind {
+	case queryNodeGraph:
+		data, err = cliQueryNodeGraph(ctx, reportAPI, d, *version)
+	case queryAnnotations:
+		data, err = cliQueryAnnotations(ctx, reportAPI, d, *version)
+	case queryText:
+		data, err = cliQueryText(ctx, reportAPI, d, *version)
+	default:
+		return fmt.Errorf("unknown query %q, use one of %s, %s, %s", kind, queryNodeGraph, queryAnnotations, queryText)
+	}
+	if err != nil {
+		return err
+	}
+	if *output == outputTable {
+		return writeTable(w, data)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(data)
+}
+
+// parseQueryValues converts the key=value args to the query params, a key can be repeated
+func parseQueryValues(args []string) (url.Values, error) {
+	values := make(url.Values)
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return nil, fmt.Errorf("param %q is not key=value", arg)
+		}
+		values.Add(kv[0], kv[1])
+	}
+	return values, nil
+}
+
+func cliQueryNodeGraph(ctx context.Context, api *ReportAPI, d *ParamDecoder, version string) (interface{}, error) {
+	param := &QueryNodeGraphParam{}
+	param.TiDBClusterID = d.Required("tidb_cluster_id")
+	param.Tree = d.String("tree")
+	param.Agg = d.String("agg")
+	param.TsRange = d.TsRange("")
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	if err := param.Validate(); err != nil {
+		return nil, err
+	}
+	switch version {
+	case "v1":
+		return api.QueryNodeGraph(ctx, param)
+	case "", "v2":
+		return api.QueryNodeGraphV2(ctx, param)
+	}
+	return nil, fmt.Errorf("%s has no api %q", queryNodeGraph, version)
+}
+
+func cliQueryAnnotations(ctx context.Context, api *ReportAPI, d *ParamDecoder, version string) (interface{}, error) {
+	param := &QueryAnnotationsParam{}
+	param.TiDBClusterID = d.Required("tidb_cluster_id")
+	param.TsRange = d.TsRange("")
+	param.Measurement = d.String("measurement")
+	param.TZ = d.String("tz")
+	param.TimeFormat = d.String("time_format")
+	parseAnnotationParam(d, param)
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	if err := param.Validate(); err != nil {
+		return nil, err
+	}
+	switch version {
+	case "v1":
+		return api.QueryAnnotations(ctx, param)
+	case "", "v2":
+		return api.QueryAnnotationsV2(ctx, param)
+	}
+	return nil, fmt.Errorf("%s has no api %q", queryAnnotations, version)
+}
+
+func cliQueryText(ctx context.Context, api *ReportAPI, d *ParamDecoder, version string) (interface{}, error) {
+	param := &QueryDynamicTextValueParam{}
+	param.TiDBClusterID = d.Required("tidb_cluster_id")
+	param.TsRange = d.TsRange("")
+	param.Measurement = d.String("measurement")
+	param.TZ = d.String("tz")
+	param.TimeFormat = d.String("time_format")
+	param.Default1 = d.String("default_1")
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	if err := param.Validate(); err != nil {
+		return nil, err
+	}
+	switch version {
+	case "v1":
+		return api.QueryDynamicTextValue(ctx, param)
+	case "v2":
+		return api.QueryDynamicTextValueV2(ctx, param)
+	case "", "v3":
+		return api.QueryDynamicTextValueV3(ctx, param)
+	}
+	return nil, fmt.Errorf("%s has no api %q", queryText, version)
+}
+
+// writeTable renders the query data as aligned columns
+func writeTable(w io.Writer, data interface{}) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	row := func(cells ...string) {
+		for i := range cells {
+			cells[i] = tableCell(cells[i])
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	switch data := data.(type) {
+	case *QueryNodeGraphData:
+		row("ID", "TITLE", "SUBTITLE", "MAIN_STAT", "SECONDARY_STAT")
+		for _, node := range data.Nodes {
+			row(node.ID, node.Title, node.SubTitle, node.MainStat, node.SecondaryStat)
+		}
+		row()
+		row("SOURCE", "TARGET")
+		for _, edge := range data.Edges {
+			row(edge.Source, edge.Target)
+		}
+	case QueryAnnotationsData:
+		row("TIME", "TIME_END", "SEVERITY", "CATEGORY", "TITLE", "TEXT")
+		for _, item := range data {
+			row(item.TimeText, item.TimeEndText, item.Severity, item.Category, item.Title, item.Text)
+		}
+	case QueryDynamicTextValueData:
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		row("KEY", "VALUE")
+		for _, k := range keys {
+			row(k, fmt.Sprint(data[k]))
+		}
+	case *QueryDynamicTextValueV3Data:
+		row("FIELD", "TYPE", "VALUE", "TEXT")
+		for _, name := range sortedFieldNames(data.Fields) {
+			f := data.Fields[name]
+			row(name, f.Type, strconv.FormatFloat(f.Value, 'f', -1, 64), f.Text)
+		}
+		if len(data.Occurrences) > 0 {
+			row()
+			row("INDEX", "TIMESTAMP", "FIELD", "TYPE", "VALUE", "TEXT")
+			for _, o := range data.Occurrences {
+				for _, name := range sortedFieldNames(o.Fields) {
+					f := o.Fields[name]
+					row(strconv.Itoa(o.Index), strconv.FormatInt(o.Timestamp, 10), name, f.Type,
+						strconv.FormatFloat(f.Value, 'f', -1, 64), f.Text)
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("can not render %T as table", data)
+	}
+	return tw.Flush()
+}
+
+// tableCell keeps a cell in one column, tabs and new lines would break the alignment
+func tableCell(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func sortedFieldNames(fields map[string]*TextValueField) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// maxIngestLine is the longest sample line the ingest command accepts
+const maxIngestLine = 1 << 20
+
+// IngestReport is printed by the ingest command
+type IngestReport struct {
+	Lines    int            `json:"lines"`
+	Accepted int            `json:"accepted"`
+	Rejected []*IngestError `json:"rejected,omitempty"`
+	// Unwritten are the accepted points lost by the async influxdb writes
+	Unwritten int64 `json:"unwritten,omitempty"`
+	DryRun    bool  `json:"dry_run,omitempty"`
+}
+
+// IngestError is a rejected line of the ingest command
+type IngestError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+func runIngest(ctx context.Context, args []string, stdin io.Reader, w io.Writer) error {
+	fs := flag.NewFlagSet("ingest", flag.ContinueOnError)
+	var (
+		cfgPath = configFlag(fs)
+		v2      = fs.Bool("v2", false, "write the samples to vm like /sample/v2")
+		dryRun  = fs.Bool("dry-run", false, "validate the samples without writing them")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	_, reportAPI, err := loadReportAPI(*cfgPath)
+	if err != nil {
+		return err
+	}
+	defer reportAPI.Close()
+
+	report := &IngestReport{DryRun: *dryRun}
+	scanner := bufio.NewScanner(stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxIngestLine)
+	for scanner.Scan() && ctx.Err() == nil {
+		report.Lines++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := ingestSample(ctx, reportAPI, line, *v2, *dryRun); err != nil {
+			report.Rejected = append(report.Rejected, &IngestError{Line: report.Lines, Error: err.Error()})
+			continue
+		}
+		report.Accepted++
+	}
+	err = scanner.Err()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil && !*v2 && !*dryRun {
+		// drain the async writes before counting the lost points
+		err = reportAPI.Shutdown(ctx)
+		report.Unwritten = reportAPI.WriteStats().Unwritten()
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if encErr := enc.Encode(report); encErr != nil && err == nil {
+		err = encErr
+	}
+	switch {
+	case err != nil:
+		return err
+	case len(report.Rejected) > 0:
+		return fmt.Errorf("%d of %d samples are rejected", len(report.Rejected), len(report.Rejected)+report.Accepted)
+	case report.Unwritten > 0:
+		return fmt.Errorf("%d points are not written", report.Unwritten)
+	}
+	return nil
+}
+
+// ingestSample checks one sample line like the /sample handlers and writes it
+func ingestSample(ctx context.Context, api *ReportAPI, line []byte, v2, dryRun bool) error {
+	param := &InsertSampleParam{
+		Fields: make(map[string]interface{}),
+		Tags:   make(map[string]string),
+	}
+	if err := json.Unmarshal(line, param); err != nil {
+		return err
+	}
+	if err := param.Validate(); err != nil {
+		return err
+	}
+	if err := api.ValidateSample(param); err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	var err error
+	if v2 {
+		_, err = api.InsertSampleV2(ctx, param)
+	} else {
+		_, err = api.InsertSample(ctx, param)
+	}
+	return err
+}
+
+func runValidateConfig(ctx context.Context, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	cfgPath := configFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := InitConfig(*cfgPath)
+	if err != nil {
+		return err
+	}
+
+	var reportAPI *ReportAPI
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"log", func() error { return InitLogger(cfg.Log) }},
+		{"server", func() error {
+			_, err := drainTimeoutFromConfig(cfg)
+			return err
+		}},
+		{"query", func() error {
+			_, err := maxRangeFromConfig(cfg)
+			return err
+		}},
+		{"rate_limit", func() error {
+			_, err := NewRateLimiter(cfg.RateLimit)
+			return err
+		}},
+		{"tracing", func() error {
+			if cfg.Tracing == nil || len(cfg.Tracing.Exporter) == 0 {
+				return nil
+			}
+			tp, err := newTracerProvider(ctx, cfg.Tracing, io.Discard)
+			if err != nil {
+				return err
+			}
+			return tp.Shutdown(ctx)
+		}},
+		{"data api", func() error {
+			if cfg.VM == nil {
+				return errors.New("vm must be configured")
+			}
+			_, err := NewDataAPI(cfg.VM.Endpoint)
+			return err
+		}},
+		// covers influxdb, vm, formatters, timezones, annotation, trees, grafana, report,
+		// session, upstream and schema
+		{"report api", func() error {
+			var err error
+			reportAPI, err = NewReportAPIFromConfig(cfg)
+			return err
+		}},
+	}
+	failed := 0
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			failed++
+			fmt.Fprintf(tw, "FAIL\t%s\t%v\n", c.name, err)
+			continue
+		}
+		fmt.Fprintf(tw, "ok\t%s\n", c.name)
+	}
+	if reportAPI != nil {
+		defer reportAPI.Close()
+		names := make([]string, 0, len(reportAPI.trees))
+		for name := range reportAPI.trees {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "TREE\tNODES\tEDGES\tAGG")
+		for _, name := range names {
+			tree := reportAPI.trees[name]
+			edges := 0
+			for _, children := range tree.Edges {
+				edges += len(children)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", name, len(tree.NodeIDs()), edges, tableCell(tree.Agg))
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestConfig(t *testing.T, influxURL, vmURL string, extra string) string {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.yaml")
+	cfg := fmt.Sprintf("influxdb:\n  endpoint: %q\n  org: org\n  bucket: clinic\n  token: token\nvm:\n  endpoint: %q\nsession:\n  dir: %q\n%s",
+		influxURL, vmURL, filepath.Join(dir, "sessions"), extra)
+	require.Nil(t, os.WriteFile(cfgPath, []byte(cfg), 0644))
+	return cfgPath
+}
+
+func TestRunCLI(t *testing.T) {
+	assert := require.New(t)
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	assert.Equal(0, runCLI([]string{"help"}, nil, stdout, stderr))
+	for _, c := range commands {
+		assert.Contains(stdout.String(), "reportd "+c.usage)
+	}
+
+	assert.Equal(2, runCLI([]string{"nodes"}, nil, stdout, stderr))
+	assert.Contains(stderr.String(), `unknown command "nodes"`)
+
+	stderr.Reset()
+	assert.Equal(1, runCLI([]string{"query"}, nil, stdout, stderr))
+	assert.Contains(stderr.String(), "query: query needs one of node-graph, annotations, text")
+
+	// the flags without a command go to serve
+	stderr.Reset()
+	assert.Equal(1, runCLI([]string{"-c", filepath.Join(t.TempDir(), "missing.yaml")}, nil, stdout, stderr))
+	assert.Contains(stderr.String(), "serve: ")
+
+	// -c used to default to "./", a directory InitConfig can not read
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	configFlag(fs)
+	assert.Equal("./config.yaml", fs.Lookup("c").DefValue)
+}
+
+func TestQueryCommand(t *testing.T) {
+	assert := require.New(t)
+	var query string
+	vm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+		query = req.Form.Get("query")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[`+
+			`{"metric":{"__name__":"overview_qps","aggr":"first"},"values":[[100,"12"]]}]}}`)
+	}))
+	defer vm.Close()
+	cfgPath := writeTestConfig(t, "http://127.0.0.1:0", vm.URL, "")
+	params := []string{"tidb_cluster_id=clinic", "measurement=overview", "start_ts=40", "end_ts=100"}
+
+	out := &bytes.Buffer{}
+	assert.Nil(runQuery(context.Background(), append([]string{"text", "-c", cfgPath, "-o", "table"}, params...), out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal([]string{"FIELD", "TYPE", "VALUE", "TEXT"}, strings.Fields(lines[0]))
+	assert.Equal([]string{"qps", "float", "12"}, strings.Fields(lines[1])[:3])
+	assert.Contains(query, "clinic")
+
+	out.Reset()
+	assert.Nil(runQuery(context.Background(), append([]string{"text", "-c", cfgPath, "-api", "v2"}, params...), out))
+	data := QueryDynamicTextValueData{}
+	assert.Nil(json.Unmarshal(out.Bytes(), &data))
+	assert.NotEmpty(data)
+
+	for _, args := range [][]string{
+		{"text", "-c", cfgPath, "measurement=overview"},
+		{"text", "-c", cfgPath, "-api", "v4", "tidb_cluster_id=clinic"},
+		{"text", "-c", cfgPath, "-o", "yaml", "tidb_cluster_id=clinic"},
+		{"text", "-c", cfgPath, "tidb_cluster_id"},
+		{"graph", "-c", cfgPath, "tidb_cluster_id=clinic"},
+	} {
+		assert.NotNil(runQuery(context.Background(), args, out), args)
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	assert := require.New(t)
+	out := &bytes.Buffer{}
+	assert.Nil(writeTable(out, &QueryNodeGraphData{
+		Nodes: []*Node{{ID: "1", Title: "latency", MainStat: "0.9"}},
+		Edges: []*Edge{{Source: "1", Target: "2"}},
+	}))
+	assert.Equal("ID  TITLE    SUBTITLE  MAIN_STAT  SECONDARY_STAT\n"+
+		"1   latency  -         0.9        -\n"+
+		"\n"+
+		"SOURCE  TARGET\n"+
+		"1       2\n", out.String())
+
+	out.Reset()
+	assert.Nil(writeTable(out, QueryAnnotationsData{{TimeText: "10:00", Title: "slow\tquery", Text: "a\nb"}}))
+	assert.Contains(out.String(), "10:00  -         -         -         slow query  a b")
+	assert.NotNil(writeTable(out, "text"))
+}
+
+func TestIngestCommand(t *testing.T) {
+	assert := require.New(t)
+	influx, lines := newFakeInfluxDB(t)
+	cfgPath := writeTestConfig(t, influx.URL, "http://127.0.0.1:0", "")
+	stdin := `{"timestamp":1,"measurement":"m","tidb_cluster_id":"clinic","fields":{"v":1}}
+{"timestamp":2,"measurement":"m","tidb_cluster_id":"clinic","fields":{"v":2}}
+{"timestamp":3,
+{"measurement":"m","tidb_cluster_id":"clinic","fields":{"v":3}}
+
+`
+
+	out := &bytes.Buffer{}
+	err := runIngest(context.Background(), []string{"-c", cfgPath, "-dry-run"}, strings.NewReader(stdin), out)
+	assert.EqualError(err, "2 of 4 samples are rejected")
+	report := &IngestReport{}
+	assert.Nil(json.Unmarshal(out.Bytes(), report))
+	assert.Equal(5, report.Lines)
+	assert.Equal(2, report.Accepted)
+	assert.Len(report.Rejected, 2)
+	assert.Equal(3, report.Rejected[0].Line)
+	assert.Equal(IngestError{Line: 4, Error: "timestamp is empty"}, *report.Rejected[1])
+	assert.Equal(int64(0), atomic.LoadInt64(lines))
+
+	out.Reset()
+	stdin = strings.Join(strings.Split(stdin, "\n")[:2], "\n")
+	assert.Nil(runIngest(context.Background(), []string{"-c", cfgPath}, strings.NewReader(stdin), out))
+	report = &IngestReport{}
+	assert.Nil(json.Unmarshal(out.Bytes(), report))
+	assert.Equal(&IngestReport{Lines: 2, Accepted: 2}, report)
+	assert.Equal(int64(2), atomic.LoadInt64(lines))
+}
+
+func TestValidateConfigCommand(t *testing.T) {
+	assert := require.New(t)
+	out := &bytes.Buffer{}
+	assert.Nil(runValidateConfig(context.Background(), []string{"-c", "config.yaml"}, out))
+	assert.Regexp(`(?m)^ok\s+report api$`, out.String())
+	assert.Contains(out.String(), "TREE")
+	assert.Contains(out.String(), DefaultTreeName)
+
+	out.Reset()
+	cfgPath := writeTestConfig(t, "http://127.0.0.1:0", "http://127.0.0.1:0", "query:\n  max_range: 1x\n")
+	err := runValidateConfig(context.Background(), []string{"-c", cfgPath}, out)
+	assert.EqualError(err, "1 of 7 checks failed")
+	assert.Regexp(`(?m)^FAIL\s+query\s+query.max_range: `, out.String())
+
+	out.Reset()
+	cfgPath = writeTestConfig(t, "http://127.0.0.1:0", "http://127.0.0.1:0", "trees:\n  - name: broken\n    edges:\n      1: [2]\n      2: [1]\n")
+	assert.NotNil(runValidateConfig(context.Background(), []string{"-c", cfgPath}, out))
+	assert.Regexp(`(?m)^FAIL\s+report api\s+tree broken: cycle found`, out.String())
+	assert.NotContains(out.String(), "TREE")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// inflightCall is a query which is running or waiting to be returned to its callers.
+type inflightCall struct {
+	done   chan struct{}
+	cancel context.CancelFunc
+	// waiters counts the callers waiting on this call, including the one starting it.
+	waiters int64
+	shared  bool
+
+	val interface{}
+	err error
+}
+
+// QueryGroup de-duplicates concurrent identical upstream queries, callers with
+// the same key share one upstream call and its decoded result.
+type QueryGroup struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+func NewQueryGroup() *QueryGroup {
+	return &QueryGroup{
+		calls: make(map[string]*inflightCall),
+	}
+}
+
+// Do executes fn once for all concurrent callers with the same key. The returned
+// value is shared and must be treated as read only by the caller. shared reports
+// whether the value was given to more than one caller.
+//
+// fn runs on a context with the values of the first caller, which is not canceled
+// with any caller but when all of them have returned. A caller whose ctx is done
+// returns its error without waiting for fn.
+func (g *QueryGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (v interface{}, shared bool, err error) {
+	g.mu.Lock()
+	c, ok := g.calls[key]
+	if ok {
+		c.waiters++
+		c.shared = true
+	} else {
+		callCtx, cancel := context.WithCancel(detachContext(ctx))
+		c = &inflightCall{done: make(chan struct{}), cancel: cancel, waiters: 1}
+		g.calls[key] = c
+		go g.doCall(callCtx, c, key, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		if e, ok := c.err.(*panicError); ok {
+			panic(e)
+		}
+		g.mu.Lock()
+		shared = c.shared
+		g.mu.Unlock()
+		return c.val, shared, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// nobody waits for the result, the next caller starts a new call
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		shared = c.shared
+		g.mu.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+// doCall runs fn for the call and releases its callers. The panic of fn is passed
+// on to every caller rather than crashing the process.
+func (g *QueryGroup) doCall(ctx context.Context, c *inflightCall, key string, fn func(ctx context.Context) (interface{}, error)) {
+	returned := false
+	defer func() {
+		if !returned {
+			if r := recover(); r != nil {
+				c.err = &panicError{value: r, stack: debug.Stack()}
+			} else {
+				// fn called runtime.Goexit, the waiters must not get a nil result
+				c.err = errCallExited
+			}
+		}
+		g.mu.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		c.cancel()
+		close(c.done)
+	}()
+	c.val, c.err = fn(ctx)
+	returned = true
+}
+
+var errCallExited = errors.New("shared query exited without a result")
+
+// panicError is the panic of a shared call with the stack of the goroutine running it
+type panicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (p *panicError) Error() string {
+	return fmt.Sprintf("%v\n\n%s", p.value, p.stack)
+}
+
+// detachedContext keeps the values of the parent, e.g. the span and the request id,
+// but is not canceled with it. A shared call runs on it, so the caller who started
+// the call does not cancel it for the others.
+type detachedContext struct {
+	parent context.Context
+}
+
+func detachContext(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+
+func (detachedContext) Done() <-chan struct{} { return nil }
+
+func (detachedContext) Err() error { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// InflightQuery describes a running upstream query for debugging.
+type InflightQuery struct {
+	Key     string `json:"key"`
+	Waiters int64  `json:"waiters"`
+}
+
+// Inflight returns the running queries and how many callers are waiting on each.
+func (g *QueryGroup) Inflight() []InflightQuery {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	queries := make([]InflightQuery, 0, len(g.calls))
+	for key, c := range g.calls {
+		queries = append(queries, InflightQuery{Key: key, Waiters: c.waiters})
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		return queries[i].Key < queries[j].Key
+	})
+	return queries
+}
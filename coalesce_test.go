@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryGroup_Do(t *testing.T) {
+	assert := require.New(t)
+	g := NewQueryGroup()
+	var calls int32
+	release := make(chan struct{})
+	fn := func(context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "result", nil
+	}
+
+	const callers = 8
+	var wg sync.WaitGroup
+	results := make([]interface{}, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, _, err := g.Do(context.Background(), "same-query", fn)
+			assert.Nil(err)
+			results[i] = v
+		}(i)
+	}
+	// wait until all callers are attached to the running query
+	assert.Eventually(func() bool {
+		inflight := g.Inflight()
+		return len(inflight) == 1 && inflight[0].Waiters == callers
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+	for _, v := range results {
+		assert.Equal("result", v)
+	}
+	assert.Len(g.Inflight(), 0)
+
+	// a finished query is not cached
+	_, shared, err := g.Do(context.Background(), "same-query", func(context.Context) (interface{}, error) { return nil, nil })
+	assert.Nil(err)
+	assert.False(shared)
+}
+
+func TestQueryGroup_DoPanic(t *testing.T) {
+	assert := require.New(t)
+	g := NewQueryGroup()
+	release := make(chan struct{})
+	recovered := make(chan interface{}, 2)
+	do := func(fn func(context.Context) (interface{}, error)) {
+		defer func() { recovered <- recover() }()
+		_, _, _ = g.Do(context.Background(), "same-query", fn)
+	}
+	go do(func(context.Context) (interface{}, error) {
+		<-release
+		panic("boom")
+	})
+	assert.Eventually(func() bool { return len(g.Inflight()) == 1 }, time.Second, time.Millisecond)
+	go do(nil)
+	assert.Eventually(func() bool {
+		inflight := g.Inflight()
+		return len(inflight) == 1 && inflight[0].Waiters == 2
+	}, time.Second, time.Millisecond)
+	close(release)
+
+	// both the caller running the query and the waiter see the panic
+	for i := 0; i < 2; i++ {
+		r := <-recovered
+		assert.IsType(&panicError{}, r)
+		assert.Contains(r.(*panicError).Error(), "boom")
+	}
+	// the key is released, the next call is not blocked
+	v, _, err := g.Do(context.Background(), "same-query", func(context.Context) (interface{}, error) { return "result", nil })
+	assert.Nil(err)
+	assert.Equal("result", v)
+}
+
+func TestQueryGroup_LeaderCanceled(t *testing.T) {
+	assert := require.New(t)
+	var requests int32
+	release := make(chan struct{})
+	vm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[`+
+			`{"metric":{"__name__":"overview_qps"},"value":[100,"12"]}]}}`)
+	}))
+	defer vm.Close()
+	reportAPI, err := NewReportAPI("http://127.0.0.1:0", "org", "bucket", "token", WithVMOption(vm.URL),
+		WithSessionOption(&SessionConfig{Dir: filepath.Join(t.TempDir(), "sessions")}))
+	assert.Nil(err)
+	defer reportAPI.Close()
+
+	type result struct {
+		v   model.Value
+		err error
+	}
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leader, waiter := make(chan result, 1), make(chan result, 1)
+	go func() {
+		v, err := reportAPI.queryMetrics(leaderCtx, "overview_qps", 100)
+		leader <- result{v, err}
+	}()
+	assert.Eventually(func() bool { return atomic.LoadInt32(&requests) == 1 }, time.Second, time.Millisecond)
+	go func() {
+		v, err := reportAPI.queryMetrics(context.Background(), "overview_qps", 100)
+		waiter <- result{v, err}
+	}()
+	assert.Eventually(func() bool {
+		inflight := reportAPI.queryGroup.Inflight()
+		return len(inflight) == 1 && inflight[0].Waiters == 2
+	}, time.Second, time.Millisecond)
+
+	// the client which started the query goes away without waiting, the shared call goes on
+	cancel()
+	r := <-leader
+	assert.Equal(context.Canceled, r.err)
+	assert.Equal(int64(1), reportAPI.queryGroup.Inflight()[0].Waiters)
+	close(release)
+	r = <-waiter
+	assert.Nil(r.err)
+	assert.Len(r.v.(model.Vector), 1)
+	assert.Equal(int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestQueryGroup_AllCanceled(t *testing.T) {
+	assert := require.New(t)
+	g := NewQueryGroup()
+	callCanceled := make(chan error, 1)
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		callCanceled <- ctx.Err()
+		return nil, ctx.Err()
+	}
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	for _, ctx := range []context.Context{ctx1, ctx2} {
+		go func(ctx context.Context) {
+			_, _, err := g.Do(ctx, "same-query", fn)
+			errs <- err
+		}(ctx)
+	}
+	assert.Eventually(func() bool {
+		inflight := g.Inflight()
+		return len(inflight) == 1 && inflight[0].Waiters == 2
+	}, time.Second, time.Millisecond)
+
+	// the call goes on while a caller is waiting
+	cancel1()
+	assert.Equal(context.Canceled, <-errs)
+	select {
+	case <-callCanceled:
+		assert.Fail("the call is canceled with a waiter left")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// the last caller leaving cancels the call and releases the key
+	cancel2()
+	assert.Equal(context.Canceled, <-errs)
+	assert.Equal(context.Canceled, <-callCanceled)
+	assert.Len(g.Inflight(), 0)
+	v, shared, err := g.Do(context.Background(), "same-query", func(context.Context) (interface{}, error) { return "result", nil })
+	assert.Nil(err)
+	assert.False(shared)
+	assert.Equal("result", v)
+}
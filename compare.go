@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// sides of a compared node or edge
+const (
+	CompareSideBoth    = "both"
+	CompareSideBase    = "base"
+	CompareSideCompare = "compare"
+)
+
+// CompareNodeGraphParam holds the two ranges to compare, the compare cluster is the
+// base one when not set so two windows of one cluster can be compared.
+type CompareNodeGraphParam struct {
+	Tree    string              `json:"tree,omitempty"`
+	Agg     string              `json:"agg,omitempty"`
+	Base    QueryNodeGraphParam `json:"base"`
+	Compare QueryNodeGraphParam `json:"compare"`
+}
+
+func (param *CompareNodeGraphParam) Validate() error {
+	if len(param.Compare.TiDBClusterID) == 0 {
+		param.Compare.TiDBClusterID = param.Base.TiDBClusterID
+	}
+	param.Base.Tree, param.Compare.Tree = param.Tree, param.Tree
+	param.Base.Agg, param.Compare.Agg = param.Agg, param.Agg
+	if err := param.Base.Validate(); err != nil {
+		return fmt.Errorf("base: %v", err)
+	}
+	if err := param.Compare.Validate(); err != nil {
+		return fmt.Errorf("compare: %v", err)
+	}
+	if param.Base.TiDBClusterID == param.Compare.TiDBClusterID && param.Base.TsRange == param.Compare.TsRange {
+		return errors.New("base and compare are the same")
+	}
+	return nil
+}
+
+// CompareNode is a node of the compared graph, the detail fields show in the
+// grafana node graph panel as the node details.
+type CompareNode struct {
+	*Node
+	Side              string   `json:"detail__side"`
+	BaseSimilarity    *float64 `json:"detail__base_similarity"`
+	CompareSimilarity *float64 `json:"detail__compare_similarity"`
+	Delta             float64  `json:"detail__delta"`
+}
+
+type CompareEdge struct {
+	*Edge
+	Side string `json:"detail__side"`
+}
+
+type CompareNodeGraphData struct {
+	Nodes []*CompareNode `json:"nodes"`
+	Edges []*CompareEdge `json:"edges"`
+}
+
+// CompareNodeGraphs merges the base and compare graph into one. MainStat holds both
+// similarities and SecondaryStat the delta, the arcs show the compare similarity or the
+// base one when the node is only in base. Nodes and edges are flagged with the side
+// they appear on.
+func CompareNodeGraphs(base, compare *QueryNodeGraphData) *CompareNodeGraphData {
+	data := &CompareNodeGraphData{
+		Nodes: make([]*CompareNode, 0),
+		Edges: make([]*CompareEdge, 0),
+	}
+	baseNodes := make(map[string]*Node)
+	for _, node := range base.Nodes {
+		baseNodes[node.ID] = node
+	}
+	compareNodes := make(map[string]*Node)
+	for _, node := range compare.Nodes {
+		compareNodes[node.ID] = node
+	}
+	ids := make([]string, 0, len(baseNodes)+len(compareNodes))
+	for id := range baseNodes {
+		ids = append(ids, id)
+	}
+	for id := range compareNodes {
+		if _, ok := baseNodes[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	formatSimilarity := func(v *float64) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprintf("%.3f", *v)
+	}
+	for _, id := range ids {
+		b, inBase := baseNodes[id]
+		c, inCompare := compareNodes[id]
+		node := DefaultNode()
+		cn := &CompareNode{Node: node}
+		src := c
+		switch {
+		case inBase && inCompare:
+			cn.Side = CompareSideBoth
+		case inBase:
+			cn.Side = CompareSideBase
+			src = b
+		default:
+			cn.Side = CompareSideCompare
+		}
+		node.ID = src.ID
+		node.Title = src.Title
+		node.SubTitle = src.SubTitle
+		if len(node.SubTitle) == 0 && inBase {
+			node.SubTitle = b.SubTitle
+		}
+		node.ArcPositive = src.ArcPositive
+		node.ArcNegative = 1 - src.ArcPositive
+		if inBase {
+			v := b.ArcPositive
+			cn.BaseSimilarity = &v
+		}
+		if inCompare {
+			v := c.ArcPositive
+			cn.CompareSimilarity = &v
+		}
+		node.MainStat = fmt.Sprintf("%s → %s", formatSimilarity(cn.BaseSimilarity), formatSimilarity(cn.CompareSimilarity))
+		if cn.Side == CompareSideBoth {
+			cn.Delta = c.ArcPositive - b.ArcPositive
+			node.SecondaryStat = fmt.Sprintf("Δ %+.3f", cn.Delta)
+		} else {
+			node.SecondaryStat = fmt.Sprintf("only in %s", cn.Side)
+		}
+		data.Nodes = append(data.Nodes, cn)
+	}
+
+	edgeKey := func(edge *Edge) string {
+		return edge.Source + "\x00" + edge.Target
+	}
+	compareEdges := make(map[string]*Edge)
+	for _, edge := range compare.Edges {
+		compareEdges[edgeKey(edge)] = edge
+	}
+	seen := make(map[string]struct{})
+	for _, edge := range base.Edges {
+		side := CompareSideBase
+		if _, ok := compareEdges[edgeKey(edge)]; ok {
+			side = CompareSideBoth
+		}
+		seen[edgeKey(edge)] = struct{}{}
+		data.Edges = append(data.Edges, &CompareEdge{Edge: edge, Side: side})
+	}
+	for _, edge := range compare.Edges {
+		if _, ok := seen[edgeKey(edge)]; ok {
+			continue
+		}
+		data.Edges = append(data.Edges, &CompareEdge{Edge: edge, Side: CompareSideCompare})
+	}
+	for _, edge := range data.Edges {
+		if edge.Side != CompareSideBoth {
+			e := *edge.Edge
+			e.MainStat = fmt.Sprintf("only in %s", edge.Side)
+			edge.Edge = &e
+		}
+	}
+	return data
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareNodeGraphs(t *testing.T) {
+	assert := require.New(t)
+	tree := builtinTrees()[DefaultTreeName]
+	newGraph := func(similarities map[string]float64) *QueryNodeGraphData {
+		data := &QueryNodeGraphData{}
+		for id, similarity := range similarities {
+			node := DefaultNode()
+			node.ID = id
+			node.Title = id
+			node.ArcPositive = similarity
+			node.ArcNegative = 1 - similarity
+			data.Nodes = append(data.Nodes, node)
+		}
+		data.Edges = tree.Link(data.Nodes)
+		return data
+	}
+	base := newGraph(map[string]float64{"8637": 0.9, "11271": 0.8, "9254": 0.7})
+	compare := newGraph(map[string]float64{"8637": 0.6, "11271": 0.8, "9875": 0.75})
+
+	data := CompareNodeGraphs(base, compare)
+	nodes := make(map[string]*CompareNode)
+	for _, node := range data.Nodes {
+		nodes[node.ID] = node
+	}
+	assert.Len(nodes, 4)
+	assert.Equal(CompareSideBoth, nodes["8637"].Side)
+	assert.Equal("0.900 → 0.600", nodes["8637"].MainStat)
+	assert.Equal("Δ -0.300", nodes["8637"].SecondaryStat)
+	assert.InDelta(-0.3, nodes["8637"].Delta, 1e-9)
+	assert.Equal(0.6, nodes["8637"].ArcPositive)
+
+	assert.Equal(CompareSideBase, nodes["9254"].Side)
+	assert.Equal("0.700 → -", nodes["9254"].MainStat)
+	assert.Equal("only in base", nodes["9254"].SecondaryStat)
+	assert.Nil(nodes["9254"].CompareSimilarity)
+	assert.Equal(0.7, nodes["9254"].ArcPositive)
+
+	assert.Equal(CompareSideCompare, nodes["9875"].Side)
+	assert.Nil(nodes["9875"].BaseSimilarity)
+
+	edges := make(map[string]*CompareEdge)
+	for _, edge := range data.Edges {
+		edges[edge.Source+"-"+edge.Target] = edge
+	}
+	assert.Equal(CompareSideBoth, edges["8637-11271"].Side)
+	assert.Equal(CompareSideCompare, edges["11271-9875"].Side)
+	assert.Equal("only in compare", edges["11271-9875"].MainStat)
+	// the input edges are not modified
+	for _, edge := range compare.Edges {
+		assert.Empty(edge.MainStat)
+	}
+
+	// the embedded node fields are inlined for the grafana node graph panel
+	bs, err := json.Marshal(nodes["9254"])
+	assert.Nil(err)
+	m := make(map[string]interface{})
+	assert.Nil(json.Unmarshal(bs, &m))
+	assert.Equal("9254", m["id"])
+	assert.Equal("base", m["detail__side"])
+	assert.Nil(m["detail__compare_similarity"])
+}
+
+func TestCompareNodeGraphParam_Validate(t *testing.T) {
+	assert := require.New(t)
+	param := &CompareNodeGraphParam{Tree: LegacyTreeName}
+	param.Base = QueryNodeGraphParam{TiDBClusterID: "c1", TsRange: TsRange{StartTS: 1, EndTS: 2}}
+	param.Compare.TsRange = TsRange{StartTS: 1, EndTS: 2}
+	assert.NotNil(param.Validate())
+	param.Compare.TsRange = TsRange{StartTS: 3, EndTS: 4}
+	assert.Nil(param.Validate())
+	assert.Equal("c1", param.Compare.TiDBClusterID)
+	assert.Equal(LegacyTreeName, param.Compare.Tree)
+	param.Compare.EndTS = 0
+	assert.NotNil(param.Validate())
+}
@@ -7,19 +7,258 @@ import (
 )
 
 type InfluxDBConfig struct {
-	Endpoint string `yaml:"endpoint"`
-	Org      string `yaml:"org"`
-	Bucket   string `yaml:"bucket"`
-	Token    string `yaml:"token"`
+	Endpoint string               `yaml:"endpoint"`
+	Org      string               `yaml:"org"`
+	Bucket   string               `yaml:"bucket"`
+	Token    string               `yaml:"token"`
+	Write    *InfluxDBWriteConfig `yaml:"write"`
+}
+
+// InfluxDBWriteConfig controls the buffering of the /sample points, they are kept
+// per tidb_cluster_id and flushed by the scheduler, POST /flush or when a cluster
+// has BatchSize points.
+type InfluxDBWriteConfig struct {
+	// BatchSize is the max points of one write request, default is 5000
+	BatchSize uint `yaml:"batch_size"`
+	// FlushInterval is the period of the flush scheduler, default is 1s
+	FlushInterval string `yaml:"flush_interval"`
+	// RetryBufferLimit is the max points kept for retrying the failed writes, default is 50000
+	RetryBufferLimit uint `yaml:"retry_buffer_limit"`
+	// Precision of the timestamps is one of ns, us, ms and s, default is ns
+	Precision string `yaml:"precision"`
+	// UseGzip compresses the write requests
+	UseGzip bool `yaml:"use_gzip"`
 }
 
 type VMConfig struct {
 	Endpoint string `yaml:"endpoint"`
 }
 
+// FormatterConfig declares a value formatter which can be referred by the
+// `type` label or the `format` tag of dynamic text value samples.
+type FormatterConfig struct {
+	Name string `yaml:"name"`
+	// Kind is one of float, int, bytes, percent, duration, rate and timestamp
+	Kind string `yaml:"kind"`
+	// Scale multiplies the raw value before rendering, default is 1
+	Scale float64 `yaml:"scale"`
+	// Precision is the number of decimals of the rendered text, default is 2
+	Precision *int `yaml:"precision"`
+	// Unit is the unit of rate, e.g. ops for `12.00 ops/s`
+	Unit string `yaml:"unit"`
+	// Suffix is appended to the field key to store the rendered text, default is _human
+	Suffix   string `yaml:"suffix"`
+	Timezone string `yaml:"timezone"`
+	Layout   string `yaml:"layout"`
+}
+
+// AnnotationStyleConfig styles the annotations of the category and severity,
+// an empty category or severity matches any.
+type AnnotationStyleConfig struct {
+	Category  string `yaml:"category"`
+	Severity  string `yaml:"severity"`
+	Name      string `yaml:"name"`
+	IconColor string `yaml:"icon_color"`
+	ShowLine  *bool  `yaml:"show_line"`
+}
+
+// AnnotationConfig controls how annotations are post processed
+type AnnotationConfig struct {
+	// DisableMerge returns every annotation point as is
+	DisableMerge bool `yaml:"disable_merge"`
+	// MergeGap is the max gap between two regions to be merged, e.g. 30s
+	MergeGap string                   `yaml:"merge_gap"`
+	Styles   []*AnnotationStyleConfig `yaml:"styles"`
+	// Backend stores the annotations of the write api, influxdb or vm.
+	// Default is vm when the vm endpoint is set.
+	Backend string `yaml:"backend"`
+}
+
+// TreeConfig declares a diagnosis tree, Edges points from a node id to its children
+type TreeConfig struct {
+	Name   string            `yaml:"name"`
+	Edges  map[int64][]int64 `yaml:"edges"`
+	Titles map[int64]string  `yaml:"titles"`
+	// Agg is the default roll-up of the node similarities, one of first, last, max, avg and p95
+	Agg string `yaml:"agg"`
+}
+
+// GrafanaConfig controls the generated grafana dashboard
+type GrafanaConfig struct {
+	// DatasourceType and DatasourceUID refer to the json api datasource pointing to report-api
+	DatasourceType string `yaml:"datasource_type"`
+	DatasourceUID  string `yaml:"datasource_uid"`
+	// TextMeasurements get a text panel each, default is diagnosis_overview
+	TextMeasurements []string `yaml:"text_measurements"`
+}
+
+// ReportConfig points to the report templates, the embedded ones are used when empty
+type ReportConfig struct {
+	MarkdownTemplate string `yaml:"markdown_template"`
+	HTMLTemplate     string `yaml:"html_template"`
+}
+
+type SessionConfig struct {
+	// Dir keeps the session snapshots, default is ./sessions
+	Dir string `yaml:"dir"`
+}
+
+// QueryConfig limits the query params of all endpoints
+type QueryConfig struct {
+	// MaxRange caps end_ts - start_ts, e.g. 168h, default is 31 days
+	MaxRange string `yaml:"max_range"`
+}
+
+// LogConfig configures the global logger, the level can be changed at runtime through /debug/loglevel
+type LogConfig struct {
+	// Level is one of debug, info, warn and error, default is info
+	Level string `yaml:"level"`
+	// Format is text or json, default is text
+	Format string `yaml:"format"`
+	// Sampling drops the repeated log lines in every second when set
+	Sampling *LogSamplingConfig `yaml:"sampling"`
+}
+
+// LogSamplingConfig keeps the first Initial lines with the same level and message
+// in every second, and every Thereafter-th line after that
+type LogSamplingConfig struct {
+	Initial    int `yaml:"initial"`
+	Thereafter int `yaml:"thereafter"`
+}
+
+// TracingConfig exports the spans of the handlers, the service methods and the upstream queries
+type TracingConfig struct {
+	// Exporter is otlp (otlp/http) or stdout, tracing is disabled when empty
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the host:port of the otlp collector, default is localhost:4318
+	Endpoint string `yaml:"endpoint"`
+	// URLPath default is /v1/traces
+	URLPath  string `yaml:"url_path"`
+	Insecure bool   `yaml:"insecure"`
+	// SampleRatio is the fraction of the new traces to sample, default is 1,
+	// the traces started by the callers follow their sampling decision
+	SampleRatio *float64 `yaml:"sample_ratio"`
+	// ServiceName default is report-api
+	ServiceName string `yaml:"service_name"`
+}
+
+// RateLimitConfig limits the requests per client and per tidb_cluster_id with token
+// buckets, the read routes and the /sample ingestion are limited separately
+type RateLimitConfig struct {
+	// ClientHeader identifies the client when TrustClientHeader is set, the remote
+	// ip is used when the header is absent, default is X-Client-ID
+	ClientHeader string `yaml:"client_header"`
+	// TrustClientHeader keys the clients on ClientHeader, only set it behind a proxy
+	// which sets the header, the remote ip is used by default
+	TrustClientHeader bool           `yaml:"trust_client_header"`
+	Read              *RateLimitRule `yaml:"read"`
+	Sample            *RateLimitRule `yaml:"sample"`
+}
+
+// RateLimitRule is the buckets of one kind of routes, a nil bucket does not limit
+type RateLimitRule struct {
+	PerClient  *TokenBucketConfig `yaml:"per_client"`
+	PerCluster *TokenBucketConfig `yaml:"per_cluster"`
+	// Quotas replace PerCluster for the tidb_cluster_id keys
+	Quotas map[string]*TokenBucketConfig `yaml:"quotas"`
+}
+
+type TokenBucketConfig struct {
+	// Rate is the tokens added per second
+	Rate float64 `yaml:"rate"`
+	// Burst is the capacity of the bucket, default is the rate rounded up
+	Burst int `yaml:"burst"`
+}
+
+// UpstreamConfig protects the queries to VM and InfluxDB, each upstream has its
+// own circuit breaker
+type UpstreamConfig struct {
+	// Timeout caps one attempt, default is 30s
+	Timeout string         `yaml:"timeout"`
+	Retry   *RetryConfig   `yaml:"retry"`
+	Breaker *BreakerConfig `yaml:"breaker"`
+	// FallbackToInfluxDB serves the v2 queries with the v1 influxdb ones while the vm breaker is open
+	FallbackToInfluxDB bool `yaml:"fallback_to_influxdb"`
+}
+
+// RetryConfig retries the failed attempts with full jitter exponential backoff
+type RetryConfig struct {
+	// MaxAttempts includes the first attempt, default is 3, 1 disables retry
+	MaxAttempts int `yaml:"max_attempts"`
+	// InitialBackoff default is 100ms, MaxBackoff default is 2s
+	InitialBackoff string `yaml:"initial_backoff"`
+	MaxBackoff     string `yaml:"max_backoff"`
+}
+
+// BreakerConfig opens the breaker after FailureThreshold consecutive failures, the
+// requests fail fast until OpenTimeout passes and a probe request succeeds
+type BreakerConfig struct {
+	// FailureThreshold default is 5
+	FailureThreshold int `yaml:"failure_threshold"`
+	// OpenTimeout default is 30s
+	OpenTimeout string `yaml:"open_timeout"`
+}
+
+// SchemaConfig declares the measurements accepted by /sample and /sample/v2, all
+// samples are accepted when no measurement is declared
+type SchemaConfig struct {
+	// AllowUnknown accepts the measurements not declared, they are rejected by default
+	AllowUnknown bool                       `yaml:"allow_unknown"`
+	Measurements []*MeasurementSchemaConfig `yaml:"measurements"`
+}
+
+type MeasurementSchemaConfig struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// RequiredTags must be set and not empty, tidb_cluster_id is always required
+	RequiredTags []string `yaml:"required_tags"`
+	// Fields are the allowed fields, the others are rejected
+	Fields []*FieldSchemaConfig `yaml:"fields"`
+}
+
+type FieldSchemaConfig struct {
+	Name string `yaml:"name"`
+	// Type is one of float, int, bool and string, default is float
+	Type     string `yaml:"type"`
+	Required bool   `yaml:"required"`
+	// Min and Max bound the values of the float and int fields
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+}
+
+// ServerConfig controls the http server
+type ServerConfig struct {
+	// DrainTimeout caps the graceful shutdown: finishing the in-flight requests,
+	// flushing the influxdb write buffers and the pending spans. Default is 30s.
+	DrainTimeout string `yaml:"drain_timeout"`
+}
+
+// ClusterConfig holds the settings of one tidb cluster
+type ClusterConfig struct {
+	// Timezone is used to render timestamps when the request has no `tz` param
+	Timezone string `yaml:"timezone"`
+}
+
 type Config struct {
-	InfluxDB *InfluxDBConfig `yaml:"influxdb"`
-	VM       *VMConfig       `yaml:"vm"`
+	Server     *ServerConfig      `yaml:"server"`
+	InfluxDB   *InfluxDBConfig    `yaml:"influxdb"`
+	VM         *VMConfig          `yaml:"vm"`
+	Formatters []*FormatterConfig `yaml:"formatters"`
+	Annotation *AnnotationConfig  `yaml:"annotation"`
+	Trees      []*TreeConfig      `yaml:"trees"`
+	Grafana    *GrafanaConfig     `yaml:"grafana"`
+	Report     *ReportConfig      `yaml:"report"`
+	Session    *SessionConfig     `yaml:"session"`
+	Query      *QueryConfig       `yaml:"query"`
+	Log        *LogConfig         `yaml:"log"`
+	Tracing    *TracingConfig     `yaml:"tracing"`
+	RateLimit  *RateLimitConfig   `yaml:"rate_limit"`
+	Upstream   *UpstreamConfig    `yaml:"upstream"`
+	Schema     *SchemaConfig      `yaml:"schema"`
+	// Timezone is the default timezone of clusters not listed in Clusters, default is the server local one
+	Timezone string `yaml:"timezone"`
+	// Clusters is keyed by tidb_cluster_id
+	Clusters map[string]*ClusterConfig `yaml:"clusters"`
 }
 
 func InitConfig(cfgPath string) (*Config, error) {
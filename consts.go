@@ -102,3 +102,57 @@ var EdgeMatrixV2 = map[int64][]int64{
 	// Check SST read latency -> Check Disk read latency
 
 }
+
+// NodeTitlesV2 is the title of each node in EdgeMatrixV2
+var NodeTitlesV2 = map[int64]string{
+	8637:  "Write too slow",
+	11271: "Some instances write too slow",
+	9875:  "Check write stall",
+	9100:  "Check Total compaction flow",
+	8945:  "Check RocksDB compaction flow",
+	8946:  "Check RocksDB compaction flow",
+	9876:  "Check RocksDB compaction flow",
+	11281: "Check RocksDB compaction flow",
+	11282: "Check RocksDB compaction flow",
+	10486: "Check RocksDB write latency",
+	11258: "Check RocksDB write latency",
+	9102:  "Check RocksDB WAL latency",
+	11285: "Check RocksDB WAL latency",
+	8025:  "Check the Disk Write latency",
+	11261: "Check write batch size",
+	11262: "Check write batch size",
+	11270: "Check the RocksDB CPU usage",
+	9099:  "Check the Frontend flow",
+	9101:  "Check the Frontend flow",
+	11284: "Check out Async Write",
+	9407:  "Check out RaftStore Threads",
+	9408:  "Check out RaftStore Threads",
+	11008: "Check out latch",
+	9255:  "Check out Scheduler Threads",
+	8947:  "Check out Scheduler Threads",
+	11263: "Check Perf Context Mutex",
+	9571:  "Check Perf Context Thread wait",
+	11276: "Check PD Scheduling",
+
+	9254:  "Read too slow",
+	11272: "Some instances read too slow",
+	11278: "Get too slow",
+	11260: "Coprocessor too slow",
+	10334: "Coprocessor handle too slow",
+	11279: "Coprocessor-RPC QPS Follow Write-RPC?",
+	9563:  "Check coprocessor threads",
+	10790: "Check coprocessor threads",
+	9561:  "Check scanned data count",
+	10638: "BatchGet-RPC & Get-RPC QPS Follow Write-RPC?",
+	10942: "Check RPC count",
+	10182: "Check scanned RocksDB tombstone count",
+	9567:  "Check KVDB Seek and Get latency",
+	9568:  "Check KVDB Seek and Get latency",
+	10030: "Check KVDB Seek and Get latency",
+	11259: "Check in-lease-read rate",
+	11287: "Check memtable hit count and block-cache hit rate",
+	9570:  "Check memtable hit count and block-cache hit rate",
+	11286: "Check async-snap",
+	9566:  "Check SST read count",
+	9569:  "Check SST read latency",
+}
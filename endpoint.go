@@ -2,34 +2,53 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
+	"math"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 // ReportEndpoint preprocess the request body and query param
 type ReportEndpoint struct {
 	http.HandlerFunc
+	// MaxRange caps the window of the queries, default is 31 days
+	MaxRange time.Duration
+	// RateLimiter throttles the read and sample routes, nil does not limit
+	RateLimiter *RateLimiter
+}
+
+func (ep *ReportEndpoint) decoder(req *http.Request) *ParamDecoder {
+	return NewParamDecoder(req.URL.Query(), ep.MaxRange)
 }
 
 func (ep *ReportEndpoint) QueryNodeGraph(api *ReportAPI) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
 		param := &QueryNodeGraphParam{}
-		param.TiDBClusterID = req.URL.Query().Get("tidb_cluster_id")
-		param.StartTS, _ = strconv.ParseInt(req.URL.Query().Get("start_ts"), 10, 64)
-		param.EndTS, _ = strconv.ParseInt(req.URL.Query().Get("end_ts"), 10, 64)
+		param.TiDBClusterID = d.Required("tidb_cluster_id")
+		param.Tree = d.String("tree")
+		param.Agg = d.String("agg")
+		param.TsRange = d.TsRange("")
 
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
 		if err := param.Validate(); err != nil {
-			log.Error("param validate failed", zap.Error(err))
-			ResponseWithStatus(w, http.StatusBadRequest)
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
 			return
 		}
 
 		data, err := api.QueryNodeGraph(req.Context(), param)
 		if err != nil {
-			log.Error("query node graph failed", zap.Error(err))
-			ResponseWithStatus(w, http.StatusBadRequest)
+			Logger(req.Context()).Error("query node graph failed", zap.Error(err))
+			ResponseWithError(w, err)
 			return
 		}
 		ResponseWithJSON(w, data)
@@ -38,21 +57,119 @@ func (ep *ReportEndpoint) QueryNodeGraph(api *ReportAPI) http.HandlerFunc {
 
 func (ep *ReportEndpoint) QueryNodeGraphV2(api *ReportAPI) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
 		param := &QueryNodeGraphParam{}
-		param.TiDBClusterID = req.URL.Query().Get("tidb_cluster_id")
-		param.StartTS, _ = strconv.ParseInt(req.URL.Query().Get("start_ts"), 10, 64)
-		param.EndTS, _ = strconv.ParseInt(req.URL.Query().Get("end_ts"), 10, 64)
+		param.TiDBClusterID = d.Required("tidb_cluster_id")
+		param.Tree = d.String("tree")
+		param.Agg = d.String("agg")
+		param.TsRange = d.TsRange("")
+		// with step the graph of every sub window is returned instead
+		if step := d.Duration("step"); step != nil {
+			queryNodeGraphTimeline(w, req, api, d, param, *step)
+			return
+		}
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
 		if err := param.Validate(); err != nil {
-			log.Error("param validate failed", zap.Error(err))
-			ResponseWithStatus(w, http.StatusBadRequest)
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
 			return
 		}
 
-		log.Info("QueryNodeGraphV2", zap.Any("param", param))
+		Logger(req.Context()).Debug("QueryNodeGraphV2", zap.Any("param", param))
 		data, err := api.QueryNodeGraphV2(req.Context(), param)
 		if err != nil {
-			log.Error("query node graph failed", zap.Error(err))
-			ResponseWithStatus(w, http.StatusBadRequest)
+			Logger(req.Context()).Error("query node graph failed", zap.Error(err))
+			ResponseWithError(w, err)
+			return
+		}
+		ResponseWithJSON(w, data)
+	}
+}
+
+func queryNodeGraphTimeline(w http.ResponseWriter, req *http.Request, api *ReportAPI, d *ParamDecoder, graphParam *QueryNodeGraphParam, step time.Duration) {
+	param := &NodeGraphTimelineParam{QueryNodeGraphParam: *graphParam, Step: step}
+	if err := d.Err(); err != nil {
+		Logger(req.Context()).Error("param decode failed", zap.Error(err))
+		ResponseWithParamError(w, err)
+		return
+	}
+	if err := param.Validate(); err != nil {
+		Logger(req.Context()).Error("param validate failed", zap.Error(err))
+		ResponseWithParamError(w, err)
+		return
+	}
+
+	Logger(req.Context()).Debug("QueryNodeGraphTimeline", zap.Any("param", param))
+	data, err := api.QueryNodeGraphTimeline(req.Context(), param)
+	if err != nil {
+		Logger(req.Context()).Error("query node graph timeline failed", zap.Error(err))
+		ResponseWithError(w, err)
+		return
+	}
+	ResponseWithJSON(w, data)
+}
+
+func (ep *ReportEndpoint) RenderNodeGraph(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
+		param := &RenderNodeGraphParam{}
+		param.TiDBClusterID = d.Required("tidb_cluster_id")
+		param.Tree = d.String("tree")
+		param.Agg = d.String("agg")
+		param.TsRange = d.TsRange("")
+		param.Format = d.String("format")
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		if err := param.Validate(); err != nil {
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+
+		Logger(req.Context()).Debug("RenderNodeGraph", zap.Any("param", param))
+		image, contentType, err := api.RenderNodeGraph(req.Context(), param)
+		if err != nil {
+			Logger(req.Context()).Error("render node graph failed", zap.Error(err))
+			ResponseWithError(w, err)
+			return
+		}
+		ResponseWithContent(w, contentType, image)
+	}
+}
+
+func (ep *ReportEndpoint) CompareNodeGraph(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
+		param := &CompareNodeGraphParam{}
+		param.Tree = d.String("tree")
+		param.Agg = d.String("agg")
+		param.Base.TiDBClusterID = d.Required("tidb_cluster_id")
+		param.Base.TsRange = d.TsRange("")
+		param.Compare.TiDBClusterID = d.String("compare_tidb_cluster_id")
+		param.Compare.TsRange = d.TsRange("compare_")
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		if err := param.Validate(); err != nil {
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+
+		Logger(req.Context()).Debug("CompareNodeGraph", zap.Any("param", param))
+		data, err := api.CompareNodeGraph(req.Context(), param)
+		if err != nil {
+			Logger(req.Context()).Error("compare node graph failed", zap.Error(err))
+			ResponseWithError(w, err)
 			return
 		}
 		ResponseWithJSON(w, data)
@@ -61,21 +178,28 @@ func (ep *ReportEndpoint) QueryNodeGraphV2(api *ReportAPI) http.HandlerFunc {
 
 func (ep *ReportEndpoint) QueryAnnotation(api *ReportAPI) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
 		param := &QueryAnnotationsParam{}
-		param.TiDBClusterID = req.URL.Query().Get("tidb_cluster_id")
-		param.StartTS, _ = strconv.ParseInt(req.URL.Query().Get("start_ts"), 10, 64)
-		param.EndTS, _ = strconv.ParseInt(req.URL.Query().Get("end_ts"), 10, 64)
-		param.Measurement = req.URL.Query().Get("measurement")
-
+		param.TiDBClusterID = d.Required("tidb_cluster_id")
+		param.TsRange = d.TsRange("")
+		param.Measurement = d.String("measurement")
+		param.TZ = d.String("tz")
+		param.TimeFormat = d.String("time_format")
+		parseAnnotationParam(d, param)
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
 		if err := param.Validate(); err != nil {
-			log.Error("param validate failed", zap.Error(err))
-			ResponseWithStatus(w, http.StatusBadRequest)
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
 			return
 		}
 		// log.Info("QueryAnnotation", zap.Any("param", param))
 		data, err := api.QueryAnnotations(req.Context(), param)
 		if err != nil {
-			log.Error("query annotations failed", zap.Error(err))
+			Logger(req.Context()).Error("query annotations failed", zap.Error(err))
 			ResponseWithStatus(w, http.StatusInternalServerError)
 			return
 		}
@@ -85,20 +209,28 @@ func (ep *ReportEndpoint) QueryAnnotation(api *ReportAPI) http.HandlerFunc {
 
 func (ep *ReportEndpoint) QueryAnnotationV2(api *ReportAPI) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
 		param := &QueryAnnotationsParam{}
-		param.TiDBClusterID = req.URL.Query().Get("tidb_cluster_id")
-		param.StartTS, _ = strconv.ParseInt(req.URL.Query().Get("start_ts"), 10, 64)
-		param.EndTS, _ = strconv.ParseInt(req.URL.Query().Get("end_ts"), 10, 64)
-		param.Measurement = req.URL.Query().Get("measurement")
+		param.TiDBClusterID = d.Required("tidb_cluster_id")
+		param.TsRange = d.TsRange("")
+		param.Measurement = d.String("measurement")
+		param.TZ = d.String("tz")
+		param.TimeFormat = d.String("time_format")
+		parseAnnotationParam(d, param)
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
 		if err := param.Validate(); err != nil {
-			log.Error("param validate failed", zap.Error(err))
-			ResponseWithStatus(w, http.StatusBadRequest)
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
 			return
 		}
 		// log.Info("QueryAnnotationV2", zap.Any("param", param))
 		data, err := api.QueryAnnotationsV2(req.Context(), param)
 		if err != nil {
-			log.Error("query annotations failed", zap.Error(err))
+			Logger(req.Context()).Error("query annotations failed", zap.Error(err))
 			ResponseWithStatus(w, http.StatusInternalServerError)
 			return
 		}
@@ -106,23 +238,133 @@ func (ep *ReportEndpoint) QueryAnnotationV2(api *ReportAPI) http.HandlerFunc {
 	}
 }
 
+// parseAnnotationParam parse the optional `merge`, `merge_gap` and `filter` query params
+func parseAnnotationParam(d *ParamDecoder, param *QueryAnnotationsParam) {
+	param.Merge = d.Bool("merge")
+	param.MergeGap = d.Duration("merge_gap")
+	// filter can be repeated or comma separated
+	for _, expr := range d.Strings("filter") {
+		f, err := ParseAnnotationFilter(expr)
+		if err != nil {
+			d.AddError("filter", "%v", err)
+			continue
+		}
+		param.Filters = append(param.Filters, f)
+	}
+}
+
+func (ep *ReportEndpoint) CreateAnnotation(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		param := &AnnotationParam{}
+		if err := json.NewDecoder(req.Body).Decode(param); err != nil {
+			Logger(req.Context()).Error("json unmarshal failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		if err := param.Validate(); err != nil {
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		data, err := api.CreateAnnotation(req.Context(), param)
+		if err != nil {
+			Logger(req.Context()).Error("create annotation failed", zap.Error(err))
+			ResponseWithStatus(w, http.StatusInternalServerError)
+			return
+		}
+		ResponseWithJSON(w, data)
+	}
+}
+
+func (ep *ReportEndpoint) UpdateAnnotation(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		param := &AnnotationParam{}
+		if err := json.NewDecoder(req.Body).Decode(param); err != nil {
+			Logger(req.Context()).Error("json unmarshal failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		param.ID = mux.Vars(req)["id"]
+		if err := param.Validate(); err != nil {
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		// the id is validated by the service
+		data, err := api.UpdateAnnotation(req.Context(), param)
+		var paramErrs ParamErrors
+		if errors.As(err, &paramErrs) {
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		if errors.Is(err, ErrAnnotationNotFound) {
+			ResponseWithStatus(w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Logger(req.Context()).Error("update annotation failed", zap.Error(err))
+			ResponseWithStatus(w, http.StatusInternalServerError)
+			return
+		}
+		ResponseWithJSON(w, data)
+	}
+}
+
+func (ep *ReportEndpoint) DeleteAnnotation(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
+		id := mux.Vars(req)["id"]
+		clusterID := d.Required("tidb_cluster_id")
+		measurement := d.String("measurement")
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		if err := ValidateAnnotationKey(clusterID, measurement, id); err != nil {
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		err := api.DeleteAnnotation(req.Context(), clusterID, measurement, id)
+		if errors.Is(err, ErrAnnotationNotFound) {
+			ResponseWithStatus(w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Logger(req.Context()).Error("delete annotation failed", zap.Error(err))
+			ResponseWithStatus(w, http.StatusInternalServerError)
+			return
+		}
+		ResponseWithJSON(w, &AnnotationData{ID: id})
+	}
+}
+
 func (ep *ReportEndpoint) QueryDynamicTextValue(api *ReportAPI) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
 		param := &QueryDynamicTextValueParam{}
-		param.TiDBClusterID = req.URL.Query().Get("tidb_cluster_id")
-		param.StartTS, _ = strconv.ParseInt(req.URL.Query().Get("start_ts"), 10, 64)
-		param.EndTS, _ = strconv.ParseInt(req.URL.Query().Get("end_ts"), 10, 64)
-		param.Measurement = req.URL.Query().Get("measurement")
+		param.TiDBClusterID = d.Required("tidb_cluster_id")
+		param.TsRange = d.TsRange("")
+		param.Measurement = d.String("measurement")
+		param.TZ = d.String("tz")
+		param.TimeFormat = d.String("time_format")
 
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
 		if err := param.Validate(); err != nil {
-			log.Error("param validate failed", zap.Error(err))
-			ResponseWithStatus(w, http.StatusBadRequest)
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
 			return
 		}
-		log.Info("QueryDynamicTextValue", zap.Any("param", param))
+		Logger(req.Context()).Debug("QueryDynamicTextValue", zap.Any("param", param))
 		data, err := api.QueryDynamicTextValue(req.Context(), param)
 		if err != nil {
-			log.Error("query dynamic text value failed", zap.Error(err))
+			Logger(req.Context()).Error("query dynamic text value failed", zap.Error(err))
 			ResponseWithStatus(w, http.StatusInternalServerError)
 			return
 		}
@@ -132,22 +374,92 @@ func (ep *ReportEndpoint) QueryDynamicTextValue(api *ReportAPI) http.HandlerFunc
 
 func (ep *ReportEndpoint) QueryDynamicTextValueV2(api *ReportAPI) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
 		param := &QueryDynamicTextValueParam{}
-		param.TiDBClusterID = req.URL.Query().Get("tidb_cluster_id")
-		param.StartTS, _ = strconv.ParseInt(req.URL.Query().Get("start_ts"), 10, 64)
-		param.EndTS, _ = strconv.ParseInt(req.URL.Query().Get("end_ts"), 10, 64)
-		param.Measurement = req.URL.Query().Get("measurement")
-		param.Default1 = req.URL.Query().Get("default_1")
+		param.TiDBClusterID = d.Required("tidb_cluster_id")
+		param.TsRange = d.TsRange("")
+		param.Measurement = d.String("measurement")
+		param.TZ = d.String("tz")
+		param.TimeFormat = d.String("time_format")
+		param.Default1 = d.String("default_1")
 
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
 		if err := param.Validate(); err != nil {
-			log.Error("param validate failed", zap.Error(err))
-			ResponseWithStatus(w, http.StatusBadRequest)
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
 			return
 		}
-		log.Info("QueryDynamicTextValueV2", zap.Any("param", param))
+		Logger(req.Context()).Debug("QueryDynamicTextValueV2", zap.Any("param", param))
 		data, err := api.QueryDynamicTextValueV2(req.Context(), param)
 		if err != nil {
-			log.Error("query dynamic text value v2 failed", zap.Error(err))
+			Logger(req.Context()).Error("query dynamic text value v2 failed", zap.Error(err))
+			ResponseWithStatus(w, http.StatusInternalServerError)
+			return
+		}
+		ResponseWithJSON(w, data)
+	}
+}
+
+func (ep *ReportEndpoint) QueryDynamicTextValueV3(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
+		param := &QueryDynamicTextValueParam{}
+		param.TiDBClusterID = d.Required("tidb_cluster_id")
+		param.TsRange = d.TsRange("")
+		param.Measurement = d.String("measurement")
+		param.TZ = d.String("tz")
+		param.TimeFormat = d.String("time_format")
+		param.Default1 = d.String("default_1")
+
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		if err := param.Validate(); err != nil {
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		data, err := api.QueryDynamicTextValueV3(req.Context(), param)
+		if err != nil {
+			Logger(req.Context()).Error("query dynamic text value v3 failed", zap.Error(err))
+			ResponseWithStatus(w, http.StatusInternalServerError)
+			return
+		}
+		ResponseWithJSON(w, data)
+	}
+}
+
+// QueryDynamicTextValueSchema describe the fields of the comma separated measurements
+func (ep *ReportEndpoint) QueryDynamicTextValueSchema(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
+		param := &QueryDynamicTextValueParam{}
+		param.TiDBClusterID = d.Required("tidb_cluster_id")
+		param.TsRange = d.TsRange("")
+		param.Measurement = d.String("measurement")
+		if len(param.Measurement) == 0 {
+			param.Measurement = "diagnosis_overview"
+		}
+
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		if err := param.Validate(); err != nil {
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		data, err := api.QueryDynamicTextValueSchema(req.Context(), param)
+		if err != nil {
+			Logger(req.Context()).Error("query dynamic text value schema failed", zap.Error(err))
 			ResponseWithStatus(w, http.StatusInternalServerError)
 			return
 		}
@@ -162,18 +474,24 @@ func (ep *ReportEndpoint) InsertSample(api *ReportAPI) http.HandlerFunc {
 			Tags:   make(map[string]string),
 		}
 		if err := json.NewDecoder(req.Body).Decode(param); err != nil {
-			log.Error("json marshal failed", zap.Error(err))
-			ResponseWithStatus(w, http.StatusBadRequest)
+			Logger(req.Context()).Error("json marshal failed", zap.Error(err))
+			ResponseWithParamError(w, err)
 			return
 		}
 		if err := param.Validate(); err != nil {
-			ResponseWithStatus(w, http.StatusBadRequest)
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		if err := api.ValidateSample(param); err != nil {
+			Logger(req.Context()).Warn("sample rejected by schema", zap.String("measurement", param.Measurement), zap.Error(err))
+			ResponseWithParamError(w, err)
 			return
 		}
 
 		data, err := api.InsertSample(req.Context(), param)
 		if err != nil {
-			log.Error("insert sample failed", zap.Error(err))
+			Logger(req.Context()).Error("insert sample failed", zap.Error(err))
 			ResponseWithStatus(w, http.StatusInternalServerError)
 			return
 		}
@@ -181,14 +499,17 @@ func (ep *ReportEndpoint) InsertSample(api *ReportAPI) http.HandlerFunc {
 	}
 }
 
+// Flush pushes the buffered points of the tidb_cluster_id, or of all clusters when
+// it is empty, to influxdb
 func (ep *ReportEndpoint) Flush(api *ReportAPI) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		if err := api.Flush(req.Context()); err != nil {
-			log.Error("flush failed", zap.Error(err))
+		data, err := api.Flush(req.Context(), req.URL.Query().Get("tidb_cluster_id"))
+		if err != nil {
+			Logger(req.Context()).Error("flush failed", zap.Error(err))
 			ResponseWithStatus(w, http.StatusInternalServerError)
 			return
 		}
-		ResponseWithJSON(w, struct{}{})
+		ResponseWithJSON(w, data)
 	}
 }
 
@@ -199,31 +520,210 @@ func (ep *ReportEndpoint) InsertSampleV2(api *ReportAPI) http.HandlerFunc {
 			Tags:   make(map[string]string),
 		}
 		if err := json.NewDecoder(req.Body).Decode(param); err != nil {
-			log.Error("json marshal failed", zap.Error(err))
-			ResponseWithStatus(w, http.StatusBadRequest)
+			Logger(req.Context()).Error("json marshal failed", zap.Error(err))
+			ResponseWithParamError(w, err)
 			return
 		}
 		if err := param.Validate(); err != nil {
-			ResponseWithStatus(w, http.StatusBadRequest)
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		if err := api.ValidateSample(param); err != nil {
+			Logger(req.Context()).Warn("sample rejected by schema", zap.String("measurement", param.Measurement), zap.Error(err))
+			ResponseWithParamError(w, err)
 			return
 		}
 
-		log.Info("InsertSampleV2", zap.Any("param", param))
+		Logger(req.Context()).Debug("InsertSampleV2", zap.Any("param", param))
 		data, err := api.InsertSampleV2(req.Context(), param)
 		if err != nil {
-			log.Error("insert sample failed", zap.Error(err))
+			Logger(req.Context()).Error("insert sample failed", zap.Error(err))
+			ResponseWithStatus(w, http.StatusInternalServerError)
+			return
+		}
+		ResponseWithJSON(w, data)
+	}
+}
+
+func (ep *ReportEndpoint) GrafanaDashboard(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
+		param := &GrafanaDashboardParam{}
+		param.TiDBClusterID = d.Required("tidb_cluster_id")
+		param.Tree = d.String("tree")
+		param.Measurements = d.Strings("measurement")
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		if err := param.Validate(); err != nil {
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		data, err := api.GrafanaDashboard(req.Context(), param)
+		if err != nil {
+			Logger(req.Context()).Error("generate grafana dashboard failed", zap.Error(err))
+			ResponseWithError(w, err)
+			return
+		}
+		ResponseWithJSON(w, data)
+	}
+}
+
+func (ep *ReportEndpoint) Report(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d := ep.decoder(req)
+		param := &ReportParam{}
+		param.TiDBClusterID = d.Required("tidb_cluster_id")
+		param.TsRange = d.TsRange("")
+		param.Tree = d.String("tree")
+		param.Format = d.String("format")
+		param.TZ = d.String("tz")
+		param.TimeFormat = d.String("time_format")
+
+		if err := d.Err(); err != nil {
+			Logger(req.Context()).Error("param decode failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		if err := param.Validate(); err != nil {
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		doc, contentType, err := api.RenderReport(req.Context(), param)
+		if err != nil {
+			Logger(req.Context()).Error("render report failed", zap.Error(err))
+			ResponseWithStatus(w, http.StatusInternalServerError)
+			return
+		}
+		ResponseWithContent(w, contentType, doc)
+	}
+}
+
+func (ep *ReportEndpoint) CreateSession(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		param := &SessionParam{}
+		if err := json.NewDecoder(req.Body).Decode(param); err != nil {
+			Logger(req.Context()).Error("json unmarshal failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		if err := param.Validate(); err != nil {
+			Logger(req.Context()).Error("param validate failed", zap.Error(err))
+			ResponseWithParamError(w, err)
+			return
+		}
+		Logger(req.Context()).Debug("CreateSession", zap.Any("param", param))
+		data, err := api.CreateSession(req.Context(), param)
+		if err != nil {
+			Logger(req.Context()).Error("create session failed", zap.Error(err))
+			ResponseWithStatus(w, http.StatusInternalServerError)
+			return
+		}
+		ResponseWithJSON(w, data)
+	}
+}
+
+func (ep *ReportEndpoint) GetSession(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		data, err := api.GetSession(req.Context(), mux.Vars(req)["id"])
+		if errors.Is(err, ErrSessionNotFound) {
+			ResponseWithStatus(w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			Logger(req.Context()).Error("get session failed", zap.Error(err))
+			ResponseWithStatus(w, http.StatusInternalServerError)
+			return
+		}
+		ResponseWithJSON(w, data)
+	}
+}
+
+func (ep *ReportEndpoint) ListSessions(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		data, err := api.ListSessions(req.Context(), req.URL.Query().Get("tidb_cluster_id"))
+		if err != nil {
+			Logger(req.Context()).Error("list sessions failed", zap.Error(err))
 			ResponseWithStatus(w, http.StatusInternalServerError)
 			return
 		}
 		ResponseWithJSON(w, data)
 	}
 }
+
+// RateLimitStats dump the counters of the throttled requests by client and cluster
+func (ep *ReportEndpoint) RateLimitStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ResponseWithJSON(w, ep.RateLimiter.Throttled())
+	}
+}
+
+// InflightQueries dump the coalesced upstream queries and their waiter counts for debugging
+func (ep *ReportEndpoint) InflightQueries(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ResponseWithJSON(w, api.InflightQueries())
+	}
+}
+
 func ResponseWithStatus(w http.ResponseWriter, statusCode int) {
 	w.Header().Add("Content-type", "application/json")
 	w.WriteHeader(statusCode)
 	_, _ = w.Write([]byte("{}"))
 }
 
+// ResponseWithParamError responds 400 with the message of every invalid param
+func ResponseWithParamError(w http.ResponseWriter, err error) {
+	var errs ParamErrors
+	if !errors.As(err, &errs) {
+		errs = ParamErrors{{Message: err.Error()}}
+	}
+	bs, _ := json.Marshal(struct {
+		Errors ParamErrors `json:"errors"`
+	}{Errors: errs})
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = w.Write(bs)
+}
+
+// ResponseWithError responds 400 to the invalid params and the unknown tree, 503 when
+// the upstream circuit breaker is open and 500 to the other failures
+func ResponseWithError(w http.ResponseWriter, err error) {
+	var errs ParamErrors
+	switch {
+	case errors.As(err, &errs), errors.Is(err, ErrTreeNotFound):
+		ResponseWithParamError(w, err)
+	case errors.Is(err, ErrCircuitOpen):
+		ResponseWithStatus(w, http.StatusServiceUnavailable)
+	default:
+		ResponseWithStatus(w, http.StatusInternalServerError)
+	}
+}
+
+// ResponseWithTooManyRequests responds 429 with the seconds to wait in Retry-After
+func ResponseWithTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	bs, _ := json.Marshal(struct {
+		Errors ParamErrors `json:"errors"`
+	}{Errors: ParamErrors{{Message: msg}}})
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	w.Header().Add("Content-type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, _ = w.Write(bs)
+}
+
+func ResponseWithContent(w http.ResponseWriter, contentType string, content []byte) {
+	w.Header().Add("Content-type", contentType)
+	_, _ = w.Write(content)
+}
+
 func ResponseWithJSON(w http.ResponseWriter, data interface{}) {
 	w.Header().Add("Content-type", "application/json")
 	bs, err := json.Marshal(data)
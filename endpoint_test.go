@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseWithError(t *testing.T) {
+	assert := require.New(t)
+	for _, c := range []struct {
+		err    error
+		status int
+	}{
+		{ParamErrors{{Field: "agg", Message: "unknown"}}, http.StatusBadRequest},
+		{fmt.Errorf("%w: %q", ErrTreeNotFound, "x"), http.StatusBadRequest},
+		{fmt.Errorf("vm: %w", ErrCircuitOpen), http.StatusServiceUnavailable},
+		{&upstreamStatusError{StatusCode: http.StatusBadGateway}, http.StatusInternalServerError},
+		{errors.New("decode failed"), http.StatusInternalServerError},
+	} {
+		w := httptest.NewRecorder()
+		ResponseWithError(w, c.err)
+		assert.Equal(c.status, w.Code, c.err.Error())
+	}
+}
+
+func TestNodeGraphEndpointErrors(t *testing.T) {
+	assert := require.New(t)
+	vm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer vm.Close()
+	reportAPI, err := NewReportAPI("http://127.0.0.1:0", "org", "bucket", "token", WithVMOption(vm.URL),
+		WithSessionOption(&SessionConfig{Dir: filepath.Join(t.TempDir(), "sessions")}),
+		WithUpstreamOption(&UpstreamConfig{
+			Retry:   &RetryConfig{MaxAttempts: 1},
+			Breaker: &BreakerConfig{FailureThreshold: 1, OpenTimeout: "1h"},
+		}))
+	assert.Nil(err)
+	defer reportAPI.Close()
+	dataAPI, err := NewDataAPI(vm.URL)
+	assert.Nil(err)
+	router := NewRouter(&ReportEndpoint{MaxRange: defaultMaxQueryRange}, reportAPI, dataAPI)
+	get := func(target string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w.Code
+	}
+
+	params := "tidb_cluster_id=clinic&start_ts=1000&end_ts=2000"
+	// the unknown tree is a client error, the failed upstream is not
+	assert.Equal(http.StatusBadRequest, get("/node_graph/v2?tree=missing&"+params))
+	assert.Equal(http.StatusBadRequest, get("/grafana/dashboard?tree=missing&tidb_cluster_id=clinic"))
+	assert.Equal(http.StatusInternalServerError, get("/node_graph/v2?"+params))
+	for _, target := range []string{
+		"/node_graph/v2?",
+		"/node_graph/v2?step=5m&",
+		"/node_graph/v2/render?",
+		"/node_graph/v2/compare?compare_start_ts=3000&compare_end_ts=4000&",
+	} {
+		assert.Equal(http.StatusServiceUnavailable, get(target+params), target)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// format kinds which can be declared in config
+const (
+	FormatKindFloat     = "float"
+	FormatKindInt       = "int"
+	FormatKindBytes     = "bytes"
+	FormatKindPercent   = "percent"
+	FormatKindDuration  = "duration"
+	FormatKindRate      = "rate"
+	FormatKindTimestamp = "timestamp"
+)
+
+const defaultTextSuffix = "_human"
+
+// FormattedValue is the rendering of one raw sample value. Value is stored under
+// the field key and Text, if any, under the field key plus TextSuffix.
+type FormattedValue struct {
+	Value      interface{}
+	Text       string
+	TextSuffix string
+}
+
+// Fill puts the formatted value into the flattened dynamic text value data
+func (fv *FormattedValue) Fill(key string, data QueryDynamicTextValueData) {
+	data[key] = fv.Value
+	if len(fv.Text) == 0 {
+		return
+	}
+	suffix := fv.TextSuffix
+	if len(suffix) == 0 {
+		suffix = defaultTextSuffix
+	}
+	data[key+suffix] = fv.Text
+}
+
+// ValueFormatter renders the raw value of the `type` label or the `format` tag,
+// timestamps are rendered with tr.
+type ValueFormatter interface {
+	Format(value float64, tr *TimeRender) *FormattedValue
+}
+
+// ValueFormatterFunc adapts a function to ValueFormatter
+type ValueFormatterFunc func(value float64, tr *TimeRender) *FormattedValue
+
+func (f ValueFormatterFunc) Format(value float64, tr *TimeRender) *FormattedValue {
+	return f(value, tr)
+}
+
+// FormatterRegistry holds the value formatters by name, it is shared by the
+// influxdb and the victoria metrics dynamic text value queries.
+type FormatterRegistry struct {
+	mu         sync.RWMutex
+	formatters map[string]ValueFormatter
+}
+
+// NewFormatterRegistry returns a registry with all builtin formatters registered
+func NewFormatterRegistry() *FormatterRegistry {
+	r := &FormatterRegistry{
+		formatters: make(map[string]ValueFormatter),
+	}
+	r.Register(TextValueTypeFloat, ValueFormatterFunc(func(value float64, _ *TimeRender) *FormattedValue {
+		return &FormattedValue{Value: value}
+	}))
+	r.Register(TextValueTypeInt, ValueFormatterFunc(func(value float64, _ *TimeRender) *FormattedValue {
+		return &FormattedValue{Value: int64(value)}
+	}))
+	r.Register(TextValueTypeUnix, ValueFormatterFunc(func(value float64, tr *TimeRender) *FormattedValue {
+		return &FormattedValue{
+			Value:      int64(value),
+			Text:       tr.FormatUnix(int64(value)),
+			TextSuffix: "_rfc3339",
+		}
+	}))
+	for _, kind := range []string{FormatKindBytes, FormatKindPercent, FormatKindDuration, FormatKindRate, FormatKindTimestamp} {
+		f, _ := NewConfigFormatter(&FormatterConfig{Name: kind, Kind: kind})
+		r.Register(kind, f)
+	}
+	return r
+}
+
+// Register adds or replaces the formatter with the name
+func (r *FormatterRegistry) Register(name string, f ValueFormatter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.formatters[name] = f
+}
+
+// Lookup returns the formatter registered with the name
+func (r *FormatterRegistry) Lookup(name string) (ValueFormatter, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f, ok := r.formatters[name]
+	return f, ok
+}
+
+// RegisterConfig registers the formatters declared in config
+func (r *FormatterRegistry) RegisterConfig(cfgs []*FormatterConfig) error {
+	for _, cfg := range cfgs {
+		f, err := NewConfigFormatter(cfg)
+		if err != nil {
+			return err
+		}
+		r.Register(cfg.Name, f)
+	}
+	return nil
+}
+
+// configFormatter renders a value according to a FormatterConfig
+type configFormatter struct {
+	kind      string
+	scale     float64
+	precision int
+	unit      string
+	suffix    string
+	// loc and layout are nil and empty when not declared, the request ones are used
+	loc    *time.Location
+	layout string
+}
+
+// NewConfigFormatter builds the formatter declared by cfg
+func NewConfigFormatter(cfg *FormatterConfig) (ValueFormatter, error) {
+	if len(cfg.Name) == 0 {
+		return nil, fmt.Errorf("formatter name is empty")
+	}
+	f := &configFormatter{
+		kind:      cfg.Kind,
+		scale:     cfg.Scale,
+		precision: 2,
+		unit:      cfg.Unit,
+		suffix:    cfg.Suffix,
+	}
+	if f.scale == 0 {
+		f.scale = 1
+	}
+	if cfg.Precision != nil {
+		f.precision = *cfg.Precision
+	}
+	switch cfg.Kind {
+	case FormatKindFloat, FormatKindInt, FormatKindBytes, FormatKindPercent, FormatKindDuration, FormatKindRate:
+	case FormatKindTimestamp:
+		if len(cfg.Timezone) > 0 {
+			loc, err := time.LoadLocation(cfg.Timezone)
+			if err != nil {
+				return nil, fmt.Errorf("formatter %s: %v", cfg.Name, err)
+			}
+			f.loc = loc
+		}
+		if len(cfg.Layout) > 0 {
+			layout, err := ParseTimeLayout(cfg.Layout)
+			if err != nil {
+				return nil, fmt.Errorf("formatter %s: %v", cfg.Name, err)
+			}
+			f.layout = layout
+		}
+	default:
+		return nil, fmt.Errorf("formatter %s: unknown kind %q", cfg.Name, cfg.Kind)
+	}
+	return f, nil
+}
+
+func (f *configFormatter) Format(value float64, tr *TimeRender) *FormattedValue {
+	value *= f.scale
+	fv := &FormattedValue{Value: value, TextSuffix: f.suffix}
+	switch f.kind {
+	case FormatKindInt:
+		fv.Value = int64(value)
+	case FormatKindBytes:
+		fv.Text = humanBytes(value, f.precision)
+	case FormatKindPercent:
+		fv.Text = strconv.FormatFloat(value*100, 'f', f.precision, 64) + "%"
+	case FormatKindDuration:
+		fv.Text = humanDuration(time.Duration(value * float64(time.Second)))
+	case FormatKindRate:
+		unit := f.unit
+		if len(unit) > 0 {
+			unit = " " + unit
+		}
+		fv.Text = strconv.FormatFloat(value, 'f', f.precision, 64) + unit + "/s"
+	case FormatKindTimestamp:
+		sec, frac := math.Modf(value)
+		fv.Value = int64(sec)
+		fv.Text = f.timeRender(tr).Format(time.Unix(int64(sec), int64(frac*1e9)))
+	}
+	return fv
+}
+
+// timeRender merges the declared timezone and layout with the request ones
+func (f *configFormatter) timeRender(tr *TimeRender) *TimeRender {
+	merged := *tr
+	if f.loc != nil && !tr.OverrideLocation {
+		merged.Location = f.loc
+	}
+	if len(f.layout) > 0 && !tr.OverrideLayout {
+		merged.Layout = f.layout
+	}
+	return &merged
+}
+
+var byteUnits = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+
+// humanBytes renders bytes with IEC units, e.g. 1.50 GiB
+func humanBytes(value float64, precision int) string {
+	idx := 0
+	abs := math.Abs(value)
+	for abs >= 1024 && idx < len(byteUnits)-1 {
+		abs /= 1024
+		value /= 1024
+		idx++
+	}
+	if idx == 0 {
+		return fmt.Sprintf("%d %s", int64(value), byteUnits[idx])
+	}
+	return fmt.Sprintf("%s %s", strconv.FormatFloat(value, 'f', precision, 64), byteUnits[idx])
+}
+
+// humanDuration drops the precision which is meaningless for the magnitude, e.g. 1h2m3s or 1.5ms
+func humanDuration(d time.Duration) string {
+	abs := d
+	if abs < 0 {
+		abs = -abs
+	}
+	switch {
+	case abs >= time.Minute:
+		d = d.Round(time.Second)
+	case abs >= time.Second:
+		d = d.Round(time.Millisecond)
+	case abs >= time.Millisecond:
+		d = d.Round(time.Microsecond)
+	}
+	return d.String()
+}
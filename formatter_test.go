@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatterRegistry_Builtin(t *testing.T) {
+	assert := require.New(t)
+	r := NewFormatterRegistry()
+
+	cases := []struct {
+		name  string
+		value float64
+		want  QueryDynamicTextValueData
+	}{
+		{TextValueTypeInt, 3.7, QueryDynamicTextValueData{"k": int64(3)}},
+		{FormatKindBytes, 1536, QueryDynamicTextValueData{"k": float64(1536), "k_human": "1.50 KiB"}},
+		{FormatKindBytes, 512, QueryDynamicTextValueData{"k": float64(512), "k_human": "512 B"}},
+		{FormatKindPercent, 0.1234, QueryDynamicTextValueData{"k": 0.1234, "k_human": "12.34%"}},
+		{FormatKindDuration, 3723.4, QueryDynamicTextValueData{"k": 3723.4, "k_human": "1h2m3s"}},
+		{FormatKindDuration, 0.0015, QueryDynamicTextValueData{"k": 0.0015, "k_human": "1.5ms"}},
+		{FormatKindRate, 12, QueryDynamicTextValueData{"k": float64(12), "k_human": "12.00/s"}},
+	}
+	for _, c := range cases {
+		f, ok := r.Lookup(c.name)
+		assert.True(ok, c.name)
+		data := make(QueryDynamicTextValueData)
+		f.Format(c.value, DefaultTimeRender()).Fill("k", data)
+		assert.Equal(c.want, data, c.name)
+	}
+	_, ok := r.Lookup("unknown")
+	assert.False(ok)
+}
+
+func TestFormatterRegistry_RegisterConfig(t *testing.T) {
+	assert := require.New(t)
+	r := NewFormatterRegistry()
+	precision := 1
+	err := r.RegisterConfig([]*FormatterConfig{
+		{Name: "utc_time", Kind: FormatKindTimestamp, Timezone: "UTC", Layout: "2006-01-02 15:04:05", Suffix: "_text"},
+		{Name: "qps", Kind: FormatKindRate, Unit: "ops", Precision: &precision},
+	})
+	assert.Nil(err)
+
+	data := make(QueryDynamicTextValueData)
+	f, ok := r.Lookup("utc_time")
+	assert.True(ok)
+	f.Format(1640995200, DefaultTimeRender()).Fill("ts", data)
+	f, ok = r.Lookup("qps")
+	assert.True(ok)
+	f.Format(1234.56, DefaultTimeRender()).Fill("qps", data)
+	assert.Equal(QueryDynamicTextValueData{
+		"ts":        int64(1640995200),
+		"ts_text":   "2022-01-01 00:00:00",
+		"qps":       1234.56,
+		"qps_human": "1234.6 ops/s",
+	}, data)
+
+	assert.NotNil(r.RegisterConfig([]*FormatterConfig{{Name: "bad", Kind: "unknown"}}))
+	assert.NotNil(r.RegisterConfig([]*FormatterConfig{{Name: "bad", Kind: FormatKindTimestamp, Timezone: "Nowhere/City"}}))
+}
+
+func TestFormatter_TimeRender(t *testing.T) {
+	assert := require.New(t)
+	r := NewFormatterRegistry()
+	assert.Nil(r.RegisterConfig([]*FormatterConfig{
+		{Name: "cn_time", Kind: FormatKindTimestamp, Timezone: "Asia/Shanghai", Layout: "datetime"},
+	}))
+	f, ok := r.Lookup("cn_time")
+	assert.True(ok)
+
+	// the declared timezone and layout are used by default
+	assert.Equal("2022-01-01 08:00:00", f.Format(1640995200, DefaultTimeRender()).Text)
+
+	// the requested timezone and layout take precedence
+	param := &TimeFormatParam{TZ: "UTC", TimeFormat: "rfc3339"}
+	tr, err := param.NewTimeRender(nil)
+	assert.Nil(err)
+	assert.Equal("2022-01-01T00:00:00Z", f.Format(1640995200, tr).Text)
+
+	// the builtin unix_seconds formatter follows the request
+	f, ok = r.Lookup(TextValueTypeUnix)
+	assert.True(ok)
+	data := make(QueryDynamicTextValueData)
+	f.Format(1640995200, tr).Fill("ts", data)
+	assert.Equal("2022-01-01T00:00:00Z", data["ts_rfc3339"])
+
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	assert.Nil(err)
+	tr, err = (&TimeFormatParam{TimeFormat: "2006/01/02 15h"}).NewTimeRender(loc)
+	assert.Nil(err)
+	assert.Equal("2022/01/01 09h", tr.FormatUnix(1640995200))
+
+	assert.NotNil((&TimeFormatParam{TZ: "Nowhere/City"}).validateTimeFormat())
+	assert.NotNil((&TimeFormatParam{TimeFormat: "no layout"}).validateTimeFormat())
+}
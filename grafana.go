@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	defaultGrafanaDatasourceType = "marcusolsson-json-datasource"
+	defaultGrafanaDatasourceUID  = "clinic"
+	grafanaDynamicTextPanel      = "marcusolsson-dynamictext-panel"
+	// grafana fills the range of the dashboard into these variables
+	grafanaStartTS = "${__from:date:seconds}"
+	grafanaEndTS   = "${__to:date:seconds}"
+)
+
+type GrafanaDashboardParam struct {
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Tree          string `json:"tree,omitempty"`
+	// Measurements get a text panel each, default is the ones in config
+	Measurements []string `json:"measurements,omitempty"`
+}
+
+func (param *GrafanaDashboardParam) Validate() error {
+	if len(param.TiDBClusterID) == 0 {
+		return errors.New("tidb_cluster_id is zero")
+	}
+	return nil
+}
+
+type GrafanaDatasourceRef struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type GrafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type GrafanaField struct {
+	JSONPath string `json:"jsonPath"`
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"`
+}
+
+// GrafanaTarget is a query of the json api datasource
+type GrafanaTarget struct {
+	RefID      string                `json:"refId"`
+	Datasource *GrafanaDatasourceRef `json:"datasource"`
+	Method     string                `json:"method"`
+	URLPath    string                `json:"urlPath"`
+	Params     [][2]string           `json:"params"`
+	Fields     []*GrafanaField       `json:"fields"`
+}
+
+type GrafanaPanel struct {
+	ID         int64                  `json:"id"`
+	Type       string                 `json:"type"`
+	Title      string                 `json:"title"`
+	GridPos    GrafanaGridPos         `json:"gridPos"`
+	Datasource *GrafanaDatasourceRef  `json:"datasource"`
+	Targets    []*GrafanaTarget       `json:"targets"`
+	Options    map[string]interface{} `json:"options,omitempty"`
+}
+
+// GrafanaAnnotationQuery is an entry of the dashboard annotation list
+type GrafanaAnnotationQuery struct {
+	Name       string                `json:"name"`
+	Datasource *GrafanaDatasourceRef `json:"datasource"`
+	Enable     bool                  `json:"enable"`
+	IconColor  string                `json:"iconColor"`
+	Target     *GrafanaTarget        `json:"target"`
+}
+
+type GrafanaAnnotations struct {
+	List []*GrafanaAnnotationQuery `json:"list"`
+}
+
+type GrafanaTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// GrafanaDashboard is the dashboard json which can be imported into grafana directly
+type GrafanaDashboard struct {
+	UID           string             `json:"uid"`
+	Title         string             `json:"title"`
+	Tags          []string           `json:"tags"`
+	SchemaVersion int                `json:"schemaVersion"`
+	Time          GrafanaTimeRange   `json:"time"`
+	Annotations   GrafanaAnnotations `json:"annotations"`
+	Panels        []*GrafanaPanel    `json:"panels"`
+}
+
+// NewGrafanaDashboard generates the dashboard with the node graph panel, one text
+// panel per measurement and the annotation query of the cluster. The annotations
+// are shown on the panel whose id matches their panel_id.
+func NewGrafanaDashboard(cfg *GrafanaConfig, tree *DiagnosisTree, param *GrafanaDashboardParam) *GrafanaDashboard {
+	ds := &GrafanaDatasourceRef{Type: cfg.DatasourceType, UID: cfg.DatasourceUID}
+	if len(ds.Type) == 0 {
+		ds.Type = defaultGrafanaDatasourceType
+	}
+	if len(ds.UID) == 0 {
+		ds.UID = defaultGrafanaDatasourceUID
+	}
+	measurements := param.Measurements
+	if len(measurements) == 0 {
+		measurements = cfg.TextMeasurements
+	}
+	if len(measurements) == 0 {
+		measurements = []string{"diagnosis_overview"}
+	}
+	rangeParams := func(extra ...[2]string) [][2]string {
+		params := [][2]string{
+			{"tidb_cluster_id", param.TiDBClusterID},
+			{"start_ts", grafanaStartTS},
+			{"end_ts", grafanaEndTS},
+		}
+		return append(params, extra...)
+	}
+
+	dashboard := &GrafanaDashboard{
+		UID:           fmt.Sprintf("report-%s-%s", param.TiDBClusterID, tree.Name),
+		Title:         fmt.Sprintf("Diagnosis Report %s (%s)", param.TiDBClusterID, tree.Name),
+		Tags:          []string{"report-api", tree.Name},
+		SchemaVersion: 36,
+		Time:          GrafanaTimeRange{From: "now-6h", To: "now"},
+		Panels:        make([]*GrafanaPanel, 0, len(measurements)+1),
+	}
+	dashboard.Annotations.List = []*GrafanaAnnotationQuery{{
+		Name:       DefaultAnomalyAnnotation().Name,
+		Datasource: ds,
+		Enable:     true,
+		IconColor:  DefaultAnomalyAnnotation().IconColor,
+		Target: &GrafanaTarget{
+			RefID:      "Anno",
+			Datasource: ds,
+			Method:     "GET",
+			URLPath:    "/annotations/v2",
+			Params:     rangeParams(),
+			Fields: []*GrafanaField{
+				{JSONPath: "$[*].time", Name: "time", Type: "time"},
+				{JSONPath: "$[*].timeEnd", Name: "timeEnd", Type: "time"},
+				{JSONPath: "$[*].title", Name: "title"},
+				{JSONPath: "$[*].text", Name: "text"},
+				{JSONPath: "$[*].tags", Name: "tags"},
+				{JSONPath: "$[*].panelId", Name: "panelId", Type: "number"},
+			},
+		},
+	}}
+
+	treeParam := [2]string{"tree", tree.Name}
+	dashboard.Panels = append(dashboard.Panels, &GrafanaPanel{
+		ID:         1,
+		Type:       "nodeGraph",
+		Title:      fmt.Sprintf("Diagnosis Tree %s", tree.Name),
+		GridPos:    GrafanaGridPos{H: 16, W: 24, X: 0, Y: 0},
+		Datasource: ds,
+		Targets: []*GrafanaTarget{
+			{
+				RefID:      "nodes",
+				Datasource: ds,
+				Method:     "GET",
+				URLPath:    "/node_graph/v2",
+				Params:     rangeParams(treeParam),
+				Fields: []*GrafanaField{
+					{JSONPath: "$.nodes[*].id", Name: "id"},
+					{JSONPath: "$.nodes[*].title", Name: "title"},
+					{JSONPath: "$.nodes[*].subTitle", Name: "subTitle"},
+					{JSONPath: "$.nodes[*].mainStat", Name: "mainStat"},
+					{JSONPath: "$.nodes[*].secondaryStat", Name: "secondaryStat"},
+					{JSONPath: "$.nodes[*].arc__similarity", Name: "arc__similarity", Type: "number"},
+					{JSONPath: "$.nodes[*].arc__nusimilarity", Name: "arc__nusimilarity", Type: "number"},
+				},
+			},
+			{
+				RefID:      "edges",
+				Datasource: ds,
+				Method:     "GET",
+				URLPath:    "/node_graph/v2",
+				Params:     rangeParams(treeParam),
+				Fields: []*GrafanaField{
+					{JSONPath: "$.edges[*].id", Name: "id"},
+					{JSONPath: "$.edges[*].source", Name: "source"},
+					{JSONPath: "$.edges[*].target", Name: "target"},
+				},
+			},
+		},
+	})
+
+	for i, measurement := range measurements {
+		dashboard.Panels = append(dashboard.Panels, &GrafanaPanel{
+			ID:         int64(i + 2),
+			Type:       grafanaDynamicTextPanel,
+			Title:      measurement,
+			GridPos:    GrafanaGridPos{H: 8, W: 12, X: (i % 2) * 12, Y: 16 + (i/2)*8},
+			Datasource: ds,
+			Targets: []*GrafanaTarget{{
+				RefID:      "text",
+				Datasource: ds,
+				Method:     "GET",
+				URLPath:    "/dynamic_text_value/v2",
+				Params:     rangeParams([2]string{"measurement", measurement}),
+				Fields:     []*GrafanaField{{JSONPath: "$", Name: measurement}},
+			}},
+			Options: map[string]interface{}{
+				"everyRow": false,
+				"content":  "{{#each this}}\n- **{{@key}}**: {{this}}\n{{/each}}",
+			},
+		})
+	}
+	return dashboard
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const defaultDrainTimeout = 30 * time.Second
+
+// ShutdownHook releases one component, it must return when ctx is done
+type ShutdownHook struct {
+	Name string
+	Fn   func(ctx context.Context) error
+}
+
+// Lifecycle runs the shutdown hooks in the registered order, all of them share
+// one drain timeout. The first hooks should stop accepting the work the later
+// ones drain, e.g. the http server before the write buffers.
+type Lifecycle struct {
+	drainTimeout time.Duration
+	hooks        []ShutdownHook
+}
+
+func NewLifecycle(drainTimeout time.Duration) *Lifecycle {
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	return &Lifecycle{drainTimeout: drainTimeout}
+}
+
+// OnShutdown appends a hook
+func (l *Lifecycle) OnShutdown(name string, fn func(ctx context.Context) error) {
+	l.hooks = append(l.hooks, ShutdownHook{Name: name, Fn: fn})
+}
+
+// Shutdown runs every hook even when the former ones fail or time out, the
+// timed out hooks get a done ctx so they can release what is left at once.
+// The first error is returned.
+func (l *Lifecycle) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), l.drainTimeout)
+	defer cancel()
+	var firstErr error
+	for _, hook := range l.hooks {
+		start := time.Now()
+		err := hook.Fn(ctx)
+		if err != nil {
+			log.Error("shutdown failed", zap.String("component", hook.Name),
+				zap.Duration("duration", time.Since(start)), zap.Error(err))
+			if firstErr == nil {
+				firstErr = fmt.Errorf("shutdown %s: %w", hook.Name, err)
+			}
+			continue
+		}
+		log.Info("shutdown", zap.String("component", hook.Name), zap.Duration("duration", time.Since(start)))
+	}
+	return firstErr
+}
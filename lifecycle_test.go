@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycle(t *testing.T) {
+	assert := require.New(t)
+	lc := NewLifecycle(50 * time.Millisecond)
+	calls := make([]string, 0)
+	lc.OnShutdown("server", func(ctx context.Context) error {
+		calls = append(calls, "server")
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	lc.OnShutdown("writes", func(ctx context.Context) error {
+		calls = append(calls, "writes")
+		// the timed out hook leaves a done ctx to the next ones
+		assert.ErrorIs(ctx.Err(), context.DeadlineExceeded)
+		return nil
+	})
+	err := lc.Shutdown()
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	assert.Contains(err.Error(), "shutdown server")
+	assert.Equal([]string{"server", "writes"}, calls)
+
+	assert.Nil(NewLifecycle(0).Shutdown())
+}
+
+func TestReportAPIShutdown(t *testing.T) {
+	assert := require.New(t)
+	influx, lines := newFakeInfluxDB(t)
+	reportAPI, err := NewReportAPI(influx.URL, "org", "bucket", "token")
+	assert.Nil(err)
+	insertSamples(t, reportAPI, "clinic", 3)
+
+	assert.Nil(reportAPI.Shutdown(context.Background()))
+	assert.Equal(int64(3), atomic.LoadInt64(lines))
+	assert.Equal(WriteStats{Accepted: 3, Written: 3}, reportAPI.WriteStats())
+	// the second call returns at once
+	assert.Nil(reportAPI.Shutdown(context.Background()))
+}
+
+func TestReportAPIShutdownTimeout(t *testing.T) {
+	assert := require.New(t)
+	release := make(chan struct{})
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+	defer close(release)
+	reportAPI, err := NewReportAPI(influx.URL, "org", "bucket", "token")
+	assert.Nil(err)
+	insertSamples(t, reportAPI, "clinic", 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = reportAPI.Shutdown(ctx)
+	assert.True(errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.Contains(err.Error(), "3 of 3 points are not written")
+}
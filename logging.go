@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// RequestIDHeader carries the request id from the caller and to the upstream
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLen = 128
+
+type ctxKey int
+
+const (
+	ctxKeyLogger ctxKey = iota
+	ctxKeyRequestID
+)
+
+// InitLogger replaces the global logger according to the config
+func InitLogger(cfg *LogConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	conf := &log.Config{Level: cfg.Level, Format: cfg.Format}
+	if len(conf.Level) == 0 {
+		conf.Level = "info"
+	}
+	if _, err := parseLogLevel(conf.Level); err != nil {
+		return err
+	}
+	switch conf.Format {
+	case "":
+		conf.Format = "text"
+	case "text", "json":
+	default:
+		return fmt.Errorf("log format %q is not text or json", conf.Format)
+	}
+	if cfg.Sampling != nil {
+		if cfg.Sampling.Initial <= 0 || cfg.Sampling.Thereafter <= 0 {
+			return fmt.Errorf("log sampling initial and thereafter must be positive")
+		}
+		conf.Sampling = &zap.SamplingConfig{Initial: cfg.Sampling.Initial, Thereafter: cfg.Sampling.Thereafter}
+	}
+	logger, props, err := log.InitLogger(conf)
+	if err != nil {
+		return err
+	}
+	log.ReplaceGlobals(logger, props)
+	return nil
+}
+
+func parseLogLevel(s string) (zapcore.Level, error) {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return level, fmt.Errorf("log level %q is not one of debug, info, warn and error", s)
+	}
+	return level, nil
+}
+
+// Logger returns the logger of the request, the global one when ctx has no logger
+func Logger(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(ctxKeyLogger).(*zap.Logger); ok {
+		return logger
+	}
+	return log.L()
+}
+
+// RequestID returns the id assigned by AccessLogMiddleware, empty when ctx is not a request one
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeyRequestID).(string)
+	return id
+}
+
+// WithRequestID attaches the request id and a logger with the request_id field to ctx
+func WithRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, ctxKeyRequestID, id)
+	return context.WithValue(ctx, ctxKeyLogger, log.L().With(zap.String("request_id", id)))
+}
+
+func newRequestID() string {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(bs)
+}
+
+// validRequestID accepts the ids generated by common proxies, e.g. uuids, and
+// rejects the ones that could break the log line
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// statusWriter records the status and the size of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(bs []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(bs)
+	w.bytes += n
+	return n, err
+}
+
+// Flush keeps the reverse proxy of the data api streaming
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// AccessLogMiddleware accepts the X-Request-ID of the request or assigns a new one,
+// echoes it in the response and emits one access log line when the request is done
+func AccessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		ctx := WithRequestID(req.Context(), id)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, req.WithContext(ctx))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		Logger(ctx).Info("access",
+			zap.String("method", req.Method),
+			zap.String("path", req.URL.Path),
+			zap.String("query", req.URL.RawQuery),
+			zap.Int("status", sw.status),
+			zap.Int("bytes", sw.bytes),
+			zap.Duration("duration", time.Since(start)),
+			zap.String("remote_addr", req.RemoteAddr),
+			zap.String("user_agent", req.UserAgent()))
+	})
+}
+
+type LogLevelData struct {
+	Level string `json:"level"`
+}
+
+// LogLevel gets the level of the global logger, or changes it with PUT {"level": "debug"}
+func (ep *ReportEndpoint) LogLevel() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPut {
+			param := &LogLevelData{}
+			if err := json.NewDecoder(req.Body).Decode(param); err != nil {
+				ResponseWithParamError(w, err)
+				return
+			}
+			level, err := parseLogLevel(param.Level)
+			if err != nil {
+				ResponseWithParamError(w, ParamErrors{{Field: "level", Message: err.Error()}})
+				return
+			}
+			log.SetLevel(level)
+			Logger(req.Context()).Info("log level changed", zap.Stringer("level", level))
+		}
+		ResponseWithJSON(w, &LogLevelData{Level: log.GetLevel().String()})
+	}
+}
+
+// setRequestIDHeader passes the request id to the upstream so its logs can be correlated
+func setRequestIDHeader(ctx context.Context, req *http.Request) {
+	if id := RequestID(ctx); len(id) > 0 {
+		req.Header.Set(RequestIDHeader, id)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/log"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAccessLogMiddleware(t *testing.T) {
+	assert := require.New(t)
+	core, logs := observer.New(zap.DebugLevel)
+	restore := log.ReplaceGlobals(zap.New(core), &log.ZapProperties{Core: core, Level: zap.NewAtomicLevel()})
+	defer restore()
+
+	var seen string
+	handler := AccessLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = RequestID(req.Context())
+		Logger(req.Context()).Debug("query vm")
+		ResponseWithStatus(w, http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/node_graph/v2?tidb_cluster_id=clinic", nil)
+	req.Header.Set(RequestIDHeader, "3f1c-upstream")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal("3f1c-upstream", seen)
+	assert.Equal("3f1c-upstream", w.Header().Get(RequestIDHeader))
+
+	entries := logs.TakeAll()
+	assert.Len(entries, 2)
+	for _, entry := range entries {
+		assert.Equal("3f1c-upstream", entry.ContextMap()["request_id"])
+	}
+	access := entries[1].ContextMap()
+	assert.Equal("access", entries[1].Message)
+	assert.Equal("/node_graph/v2", access["path"])
+	assert.Equal(int64(http.StatusTeapot), access["status"])
+	assert.Equal(int64(2), access["bytes"])
+
+	// the invalid id is replaced
+	req = httptest.NewRequest(http.MethodGet, "/node_graph/v2", nil)
+	req.Header.Set(RequestIDHeader, "bad id\n")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Len(seen, 32)
+	assert.Equal(seen, w.Header().Get(RequestIDHeader))
+
+	// the id is passed to the upstream
+	upstream := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	setRequestIDHeader(WithRequestID(req.Context(), "abc"), upstream)
+	assert.Equal("abc", upstream.Header.Get(RequestIDHeader))
+}
+
+func TestLogLevel(t *testing.T) {
+	assert := require.New(t)
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(zapcore.InfoLevel)
+	handler := (&ReportEndpoint{}).LogLevel()
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/debug/loglevel", nil))
+	assert.JSONEq(`{"level":"info"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPut, "/debug/loglevel", strings.NewReader(`{"level":"debug"}`)))
+	assert.JSONEq(`{"level":"debug"}`, w.Body.String())
+	assert.Equal(zapcore.DebugLevel, log.GetLevel())
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPut, "/debug/loglevel", strings.NewReader(`{"level":"verbose"}`)))
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), `"field":"level"`)
+	assert.Equal(zapcore.DebugLevel, log.GetLevel())
+
+	assert.NotNil(InitLogger(&LogConfig{Format: "xml"}))
+	assert.NotNil(InitLogger(&LogConfig{Level: "verbose"}))
+	assert.NotNil(InitLogger(&LogConfig{Sampling: &LogSamplingConfig{}}))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"github.com/gorilla/mux"
 	"log"
@@ -11,63 +12,143 @@ import (
 	"syscall"
 )
 
-var (
-	cfgPath string
-)
-
 func main() {
-	flag.StringVar(&cfgPath, "c", "./", "reportd -c=/path/to/config.yaml")
-	flag.Parse()
+	os.Exit(runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
 
-	cfg, err := InitConfig(cfgPath)
-	if err != nil {
-		log.Fatalln(err)
+// runServe runs the http server until ctx is done, then drains it
+func runServe(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	cfgPath := configFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
 	}
 
-	dataAPI, err := NewDataAPI(cfg.VM.Endpoint)
+	cfg, err := InitConfig(*cfgPath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	reportAPI, err := NewReportAPI(
-		cfg.InfluxDB.Endpoint, cfg.InfluxDB.Org, cfg.InfluxDB.Bucket, cfg.InfluxDB.Token,
-		WithVMOption(cfg.VM.Endpoint))
+	if err := InitLogger(cfg.Log); err != nil {
+		return err
+	}
+	drainTimeout, err := drainTimeoutFromConfig(cfg)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	defer reportAPI.Close()
 	ep := ReportEndpoint{}
-	// construct  router
+	if ep.MaxRange, err = maxRangeFromConfig(cfg); err != nil {
+		return err
+	}
+	if ep.RateLimiter, err = NewRateLimiter(cfg.RateLimit); err != nil {
+		return err
+	}
+	shutdownTracer, err := InitTracer(context.Background(), cfg.Tracing)
+	if err != nil {
+		return err
+	}
+
+	reportAPI, err := NewReportAPIFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+	dataAPI, err := NewDataAPI(cfg.VM.Endpoint)
+	if err != nil {
+		return err
+	}
+	router := NewRouter(&ep, reportAPI, dataAPI)
+	// construct http server
+	httpServer := &http.Server{
+		Addr:    ":8081",
+		Handler: AccessLogMiddleware(router),
+	}
+	// stop accepting requests before draining the writes they made
+	lc := NewLifecycle(drainTimeout)
+	lc.OnShutdown("http server", func(ctx context.Context) error {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			// drop the requests still running
+			httpServer.Close()
+			return err
+		}
+		return nil
+	})
+	lc.OnShutdown("influxdb writes", reportAPI.Shutdown)
+	lc.OnShutdown("tracer", shutdownTracer)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("start listen and serve on %s\n", httpServer.Addr)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+	}()
+	select {
+	case <-ctx.Done():
+	case err = <-serveErr:
+	}
+	// a second signal kills the process at once
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("shutting down, drain timeout is %s ...\n", drainTimeout)
+	if shutdownErr := lc.Shutdown(); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// NewReportAPIFromConfig builds the ReportAPI with all options of the config
+func NewReportAPIFromConfig(cfg *Config) (*ReportAPI, error) {
+	if cfg.InfluxDB == nil || cfg.VM == nil {
+		return nil, errors.New("influxdb and vm must be configured")
+	}
+	return NewReportAPI(
+		cfg.InfluxDB.Endpoint, cfg.InfluxDB.Org, cfg.InfluxDB.Bucket, cfg.InfluxDB.Token,
+		WithVMOption(cfg.VM.Endpoint),
+		WithInfluxDBWriteOption(cfg.InfluxDB.Write),
+		WithSchemaOption(cfg.Schema),
+		WithFormattersOption(cfg.Formatters),
+		WithTimezoneOption(cfg.Timezone, cfg.Clusters),
+		WithAnnotationOption(cfg.Annotation),
+		WithTreesOption(cfg.Trees),
+		WithGrafanaOption(cfg.Grafana),
+		WithReportOption(cfg.Report),
+		WithSessionOption(cfg.Session),
+		WithUpstreamOption(cfg.Upstream))
+}
+
+// NewRouter registers all routes, the openapi.json documents each of them
+func NewRouter(ep *ReportEndpoint, reportAPI *ReportAPI, dataAPI *DataAPI) *mux.Router {
 	router := mux.NewRouter()
+	router.Use(TracingMiddleware)
+	if ep.RateLimiter != nil {
+		router.Use(ep.RateLimiter.Middleware)
+	}
 	// report api
 	router.HandleFunc("/node_graph", ep.QueryNodeGraph(reportAPI)).Methods(http.MethodGet)
 	router.HandleFunc("/node_graph/v2", ep.QueryNodeGraphV2(reportAPI)).Methods(http.MethodGet)
+	router.HandleFunc("/node_graph/v2/render", ep.RenderNodeGraph(reportAPI)).Methods(http.MethodGet)
+	router.HandleFunc("/node_graph/v2/compare", ep.CompareNodeGraph(reportAPI)).Methods(http.MethodGet)
 	router.HandleFunc("/annotations", ep.QueryAnnotation(reportAPI)).Methods(http.MethodGet)
+	router.HandleFunc("/annotations", ep.CreateAnnotation(reportAPI)).Methods(http.MethodPost)
+	router.HandleFunc("/annotations/{id}", ep.UpdateAnnotation(reportAPI)).Methods(http.MethodPut)
+	router.HandleFunc("/annotations/{id}", ep.DeleteAnnotation(reportAPI)).Methods(http.MethodDelete)
 	router.HandleFunc("/annotations/v2", ep.QueryAnnotationV2(reportAPI)).Methods(http.MethodGet)
 	router.HandleFunc("/dynamic_text_value", ep.QueryDynamicTextValue(reportAPI)).Methods(http.MethodGet)
 	router.HandleFunc("/dynamic_text_value/v2", ep.QueryDynamicTextValueV2(reportAPI)).Methods(http.MethodGet)
+	router.HandleFunc("/dynamic_text_value/v3", ep.QueryDynamicTextValueV3(reportAPI)).Methods(http.MethodGet)
+	router.HandleFunc("/dynamic_text_value/v3/schema", ep.QueryDynamicTextValueSchema(reportAPI)).Methods(http.MethodGet)
 	router.HandleFunc("/sample", ep.InsertSample(reportAPI)).Methods(http.MethodPost)
 	router.HandleFunc("/sample/v2", ep.InsertSampleV2(reportAPI)).Methods(http.MethodPost)
 	router.HandleFunc("/flush", ep.Flush(reportAPI)).Methods(http.MethodPost)
+	router.HandleFunc("/schemas", ep.Schemas(reportAPI)).Methods(http.MethodGet)
+	router.HandleFunc("/report", ep.Report(reportAPI)).Methods(http.MethodGet)
+	router.HandleFunc("/sessions", ep.ListSessions(reportAPI)).Methods(http.MethodGet)
+	router.HandleFunc("/sessions", ep.CreateSession(reportAPI)).Methods(http.MethodPost)
+	router.HandleFunc("/sessions/{id}", ep.GetSession(reportAPI)).Methods(http.MethodGet)
+	router.HandleFunc("/grafana/dashboard", ep.GrafanaDashboard(reportAPI)).Methods(http.MethodGet)
+	router.HandleFunc("/debug/inflight", ep.InflightQueries(reportAPI)).Methods(http.MethodGet)
+	router.HandleFunc("/debug/ratelimit", ep.RateLimitStats()).Methods(http.MethodGet)
+	router.HandleFunc("/debug/loglevel", ep.LogLevel()).Methods(http.MethodGet, http.MethodPut)
 	// data api just forward request to vm
 	router.HandleFunc("/data/metrics", dataAPI.GetMetricsFrowardHandlerFunc()).Methods(http.MethodGet)
-	// construct http server
-	httpServer := &http.Server{
-		Addr:    ":8081",
-		Handler: router,
-	}
-	go func() {
-		log.Printf("start listen and serve on %s\n", httpServer.Addr)
-		if err := httpServer.ListenAndServe(); err != nil {
-			log.Fatalln(err)
-		}
-	}()
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	<-ctx.Done()
-	defer stop()
-	// graceful shutdown the http server
-	log.Println("shutting down ...")
-	if err := httpServer.Shutdown(ctx); err != nil {
-		log.Fatal(err)
-	}
-	os.Exit(0)
+	router.HandleFunc("/openapi.json", ep.OpenAPI()).Methods(http.MethodGet)
+	return router
 }
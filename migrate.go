@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/query"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMigrateChunk     = time.Hour
+	defaultMigrateBatchSize = 5000
+)
+
+// defaultMigrateMeasurements are the measurements read by the v1 influxdb queries
+var defaultMigrateMeasurements = []string{"fast-tune-similarity", "fast_tune_anomaly", "diagnosis_overview"}
+
+// MigrateOptions selects the influxdb data to copy to victoria metrics
+type MigrateOptions struct {
+	Bucket       string
+	Measurements []string
+	// Start and End bound the time range, it is migrated in chunks of Chunk
+	Start time.Time
+	End   time.Time
+	Chunk time.Duration
+	// BatchSize is the max points of one write request to vm
+	BatchSize int
+	// Rename maps the influxdb measurement to the vm one, the measurements not
+	// listed have their dashes replaced by underscores
+	Rename map[string]string
+	// Checkpoint is the file recording the migrated chunks, empty disables resuming
+	Checkpoint string
+	// DryRun counts the points without writing them or the checkpoint
+	DryRun bool
+}
+
+// MeasurementMigrateStats counts the points of one measurement, Metrics are keyed by the vm metric name
+type MeasurementMigrateStats struct {
+	Measurement string `json:"measurement"`
+	// ResumedFrom is the unix time the migration starts from
+	ResumedFrom int64            `json:"resumed_from"`
+	Points      int64            `json:"points"`
+	Skipped     int64            `json:"skipped"`
+	Batches     int64            `json:"batches"`
+	Metrics     map[string]int64 `json:"metrics"`
+}
+
+type MigrateReport struct {
+	DryRun       bool                       `json:"dry_run"`
+	Measurements []*MeasurementMigrateStats `json:"measurements"`
+}
+
+// migrateCheckpoint records the end of the last migrated chunk by measurement
+type migrateCheckpoint struct {
+	Bucket string           `json:"bucket"`
+	Done   map[string]int64 `json:"done"`
+}
+
+func loadMigrateCheckpoint(path, bucket string) (*migrateCheckpoint, error) {
+	cp := &migrateCheckpoint{Bucket: bucket, Done: make(map[string]int64)}
+	if len(path) == 0 {
+		return cp, nil
+	}
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bs, cp); err != nil {
+		return nil, fmt.Errorf("checkpoint %s: %w", path, err)
+	}
+	if cp.Bucket != bucket {
+		return nil, fmt.Errorf("checkpoint %s is of bucket %q, not %q", path, cp.Bucket, bucket)
+	}
+	if cp.Done == nil {
+		cp.Done = make(map[string]int64)
+	}
+	return cp, nil
+}
+
+// save replaces the checkpoint file at once so a crash never leaves a partial one
+func (cp *migrateCheckpoint) save(path string) error {
+	bs, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// vmMeasurement returns the measurement name used by the v2 queries
+func vmMeasurement(measurement string, rename map[string]string) string {
+	if name, ok := rename[measurement]; ok {
+		return name
+	}
+	return strings.ReplaceAll(measurement, "-", "_")
+}
+
+// migratePoint converts a flux record to the point written to vm, which stores it
+// as <measurement>_<field>. The leading underscores of the field are trimmed, e.g.
+// _value becomes value. The string values can not be stored and are skipped.
+func migratePoint(record *query.FluxRecord, measurement string) (point *write.Point, metric string, ok bool) {
+	var value interface{}
+	switch v := record.Value().(type) {
+	case float64, int64, uint64:
+		value = v
+	case bool:
+		value = 0.0
+		if v {
+			value = 1.0
+		}
+	default:
+		return nil, "", false
+	}
+	field := strings.TrimLeft(record.Field(), "_")
+	if len(field) == 0 {
+		field = "value"
+	}
+	tags := make(map[string]string)
+	for k, v := range record.Values() {
+		if k == "result" || k == "table" || strings.HasPrefix(k, "_") {
+			continue
+		}
+		if s, ok := v.(string); ok && len(s) > 0 {
+			tags[k] = s
+		}
+	}
+	point = influxdb2.NewPoint(measurement, tags, map[string]interface{}{field: value}, record.Time())
+	return point, measurement + "_" + field, true
+}
+
+// Migrate copies the measurements of the influxdb bucket to victoria metrics chunk
+// by chunk, the checkpoint is saved after every chunk so an interrupted migration
+// resumes from the last finished chunk.
+func (api *ReportAPI) Migrate(ctx context.Context, opts *MigrateOptions) (*MigrateReport, error) {
+	if !opts.End.After(opts.Start) {
+		return nil, fmt.Errorf("end %v is not after start %v", opts.End, opts.Start)
+	}
+	if opts.Chunk <= 0 {
+		opts.Chunk = defaultMigrateChunk
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultMigrateBatchSize
+	}
+	if len(opts.Bucket) == 0 {
+		opts.Bucket = api.bucket
+	}
+	if !opts.DryRun && len(api.vmEndpoint) == 0 {
+		return nil, errors.New("vm endpoint is not configured")
+	}
+	cp, err := loadMigrateCheckpoint(opts.Checkpoint, opts.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	report := &MigrateReport{DryRun: opts.DryRun, Measurements: make([]*MeasurementMigrateStats, 0, len(opts.Measurements))}
+	for _, measurement := range opts.Measurements {
+		start := opts.Start
+		if done, ok := cp.Done[measurement]; ok && time.Unix(done, 0).After(start) {
+			start = time.Unix(done, 0)
+		}
+		stats := &MeasurementMigrateStats{Measurement: measurement, ResumedFrom: start.Unix(), Metrics: make(map[string]int64)}
+		report.Measurements = append(report.Measurements, stats)
+		for chunkStart := start; chunkStart.Before(opts.End); chunkStart = chunkStart.Add(opts.Chunk) {
+			chunkEnd := chunkStart.Add(opts.Chunk)
+			if chunkEnd.After(opts.End) {
+				chunkEnd = opts.End
+			}
+			points := stats.Points
+			if err := api.migrateChunk(ctx, opts, measurement, chunkStart, chunkEnd, stats); err != nil {
+				return report, fmt.Errorf("migrate %s [%v, %v): %w", measurement, chunkStart, chunkEnd, err)
+			}
+			Logger(ctx).Info("migrated chunk", zap.String("measurement", measurement),
+				zap.Time("start", chunkStart), zap.Time("end", chunkEnd),
+				zap.Int64("points", stats.Points-points), zap.Bool("dry_run", opts.DryRun))
+			if opts.DryRun || len(opts.Checkpoint) == 0 {
+				continue
+			}
+			cp.Done[measurement] = chunkEnd.Unix()
+			if err := cp.save(opts.Checkpoint); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// migrateChunk streams the records of the chunk and writes them to vm in batches
+func (api *ReportAPI) migrateChunk(ctx context.Context, opts *MigrateOptions, measurement string, start, end time.Time, stats *MeasurementMigrateStats) error {
+	fluxQuery := fmt.Sprintf(`from(bucket: %q) |> range(start: %s, stop: %s) |> filter(fn: (r) => r._measurement == %q)`,
+		opts.Bucket, start.UTC().Format(time.RFC3339Nano), end.UTC().Format(time.RFC3339Nano), measurement)
+	result, err := api.queryAPI.Query(ctx, fluxQuery)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+	target := vmMeasurement(measurement, opts.Rename)
+	batch := &bytes.Buffer{}
+	n := 0
+	flush := func() error {
+		if n == 0 {
+			return nil
+		}
+		if !opts.DryRun {
+			payload := batch.Bytes()
+			u := fmt.Sprintf("%s%s", api.vmEndpoint, "/influx/api/v2/write")
+			err := api.vmUpstream.Do(ctx, func(ctx context.Context) error {
+				return api.doVMRequest(ctx, http.MethodPost, u, bytes.NewReader(payload))
+			})
+			if err != nil {
+				return err
+			}
+		}
+		stats.Batches++
+		batch.Reset()
+		n = 0
+		return nil
+	}
+	for result.Next() {
+		point, metric, ok := migratePoint(result.Record(), target)
+		if !ok {
+			stats.Skipped++
+			continue
+		}
+		line, err := encodePoints(point)
+		if err != nil {
+			return err
+		}
+		batch.WriteString(line)
+		n++
+		stats.Points++
+		stats.Metrics[metric]++
+		if n >= opts.BatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if result.Err() != nil {
+		return result.Err()
+	}
+	return flush()
+}
+
+// parseMigrateTime accepts RFC3339 or unix seconds
+func parseMigrateTime(s string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// runMigrate is the `report-api migrate` subcommand, the report is written to w as json
+func runMigrate(ctx context.Context, args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	var (
+		cfgPath      = configFlag(fs)
+		bucket       = fs.String("bucket", "", "influxdb bucket, default is the configured one")
+		measurements = fs.String("measurements", strings.Join(defaultMigrateMeasurements, ","), "comma separated influxdb measurements")
+		start        = fs.String("start", "", "start of the time range, RFC3339 or unix seconds")
+		end          = fs.String("end", "", "end of the time range, RFC3339 or unix seconds, default is now")
+		chunk        = fs.Duration("chunk", defaultMigrateChunk, "time range of one flux query")
+		batchSize    = fs.Int("batch-size", defaultMigrateBatchSize, "max points of one write to vm")
+		rename       = fs.String("rename", "", "comma separated influxdb=vm measurement names, default replaces - with _")
+		checkpoint   = fs.String("checkpoint", "./migrate.checkpoint.json", "file recording the migrated chunks, empty disables resuming")
+		dryRun       = fs.Bool("dry-run", false, "count the points without writing them")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	opts := &MigrateOptions{
+		Bucket:     *bucket,
+		Chunk:      *chunk,
+		BatchSize:  *batchSize,
+		Rename:     make(map[string]string),
+		Checkpoint: *checkpoint,
+		DryRun:     *dryRun,
+		End:        time.Now(),
+	}
+	for _, m := range strings.Split(*measurements, ",") {
+		if m = strings.TrimSpace(m); len(m) > 0 {
+			opts.Measurements = append(opts.Measurements, m)
+		}
+	}
+	if len(*rename) > 0 {
+		for _, pair := range strings.Split(*rename, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || len(kv[0]) == 0 || len(kv[1]) == 0 {
+				return fmt.Errorf("rename %q is not influxdb=vm", pair)
+			}
+			opts.Rename[kv[0]] = kv[1]
+		}
+	}
+	var err error
+	if len(*start) == 0 {
+		return errors.New("start is required")
+	}
+	if opts.Start, err = parseMigrateTime(*start); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	if len(*end) > 0 {
+		if opts.End, err = parseMigrateTime(*end); err != nil {
+			return fmt.Errorf("end: %w", err)
+		}
+	}
+
+	_, reportAPI, err := loadReportAPI(*cfgPath)
+	if err != nil {
+		return err
+	}
+	defer reportAPI.Close()
+	report, err := reportAPI.Migrate(ctx, opts)
+	if report != nil {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(report); encErr != nil && err == nil {
+			err = encErr
+		}
+	}
+	return err
+}
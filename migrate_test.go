@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const migrateCSV = `#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string,string
+#group,false,false,true,true,false,false,true,true,true,true
+#default,_result,,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,id,tidb_cluster_id
+,,0,2022-01-01T00:00:00Z,2022-01-01T01:00:00Z,2022-01-01T00:00:10Z,0.9,_value,fast-tune-similarity,0x1,clinic
+,,0,2022-01-01T00:00:00Z,2022-01-01T01:00:00Z,2022-01-01T00:00:20Z,0.8,_value,fast-tune-similarity,0x1,clinic
+,,0,2022-01-01T00:00:00Z,2022-01-01T01:00:00Z,2022-01-01T00:00:30Z,0.7,_value,fast-tune-similarity,0x1,clinic
+
+#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,string,string,string,string,string
+#group,false,false,true,true,false,false,true,true,true,true
+#default,_result,,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,id,tidb_cluster_id
+,,1,2022-01-01T00:00:00Z,2022-01-01T01:00:00Z,2022-01-01T00:00:10Z,high,level,fast-tune-similarity,0x1,clinic
+
+`
+
+type fakeMigrateBackends struct {
+	influx *httptest.Server
+	vm     *httptest.Server
+
+	mu      sync.Mutex
+	queries []string
+	writes  []string
+}
+
+// newFakeMigrateBackends serves migrateCSV to the flux query of the first hour of
+// 2022-01-01 and records the writes to vm
+func newFakeMigrateBackends(t *testing.T) *fakeMigrateBackends {
+	f := &fakeMigrateBackends{}
+	f.influx = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body := struct {
+			Query string `json:"query"`
+		}{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		f.mu.Lock()
+		f.queries = append(f.queries, body.Query)
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "text/csv")
+		if strings.Contains(body.Query, "range(start: 2022-01-01T00:00:00Z") {
+			fmt.Fprint(w, migrateCSV)
+		}
+	}))
+	t.Cleanup(f.influx.Close)
+	f.vm = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		bs, _ := io.ReadAll(req.Body)
+		f.mu.Lock()
+		f.writes = append(f.writes, string(bs))
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(f.vm.Close)
+	return f
+}
+
+func (f *fakeMigrateBackends) counts() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.queries), len(f.writes)
+}
+
+func TestMigrate(t *testing.T) {
+	assert := require.New(t)
+	backends := newFakeMigrateBackends(t)
+	reportAPI, err := NewReportAPI(backends.influx.URL, "org", "clinic", "token", WithVMOption(backends.vm.URL))
+	assert.Nil(err)
+	defer reportAPI.Close()
+
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint.json")
+	opts := func(dryRun bool) *MigrateOptions {
+		return &MigrateOptions{
+			Measurements: []string{"fast-tune-similarity"},
+			Start:        start,
+			End:          start.Add(2 * time.Hour),
+			Chunk:        time.Hour,
+			BatchSize:    2,
+			Checkpoint:   checkpoint,
+			DryRun:       dryRun,
+		}
+	}
+
+	// dry run counts without writing
+	report, err := reportAPI.Migrate(context.Background(), opts(true))
+	assert.Nil(err)
+	assert.Equal(&MeasurementMigrateStats{
+		Measurement: "fast-tune-similarity",
+		ResumedFrom: start.Unix(),
+		Points:      3,
+		Skipped:     1,
+		Batches:     2,
+		Metrics:     map[string]int64{"fast_tune_similarity_value": 3},
+	}, report.Measurements[0])
+	queries, writes := backends.counts()
+	assert.Equal(2, queries)
+	assert.Equal(0, writes)
+	_, err = os.Stat(checkpoint)
+	assert.True(os.IsNotExist(err))
+
+	report, err = reportAPI.Migrate(context.Background(), opts(false))
+	assert.Nil(err)
+	assert.Equal(int64(3), report.Measurements[0].Points)
+	assert.Equal(int64(2), report.Measurements[0].Batches)
+	assert.Len(backends.writes, 2)
+	assert.Equal("fast_tune_similarity,id=0x1,tidb_cluster_id=clinic value=0.9 1640995210000000000\n"+
+		"fast_tune_similarity,id=0x1,tidb_cluster_id=clinic value=0.8 1640995220000000000\n", backends.writes[0])
+	assert.Contains(backends.queries[2], `from(bucket: "clinic") |> range(start: 2022-01-01T00:00:00Z, stop: 2022-01-01T01:00:00Z)`)
+
+	// the migrated chunks are skipped
+	report, err = reportAPI.Migrate(context.Background(), opts(false))
+	assert.Nil(err)
+	assert.Equal(start.Add(2*time.Hour).Unix(), report.Measurements[0].ResumedFrom)
+	assert.Equal(int64(0), report.Measurements[0].Points)
+	queries, writes = backends.counts()
+	assert.Equal(4, queries)
+	assert.Equal(2, writes)
+
+	_, err = reportAPI.Migrate(context.Background(), &MigrateOptions{Bucket: "other", Start: start, End: start.Add(time.Hour), Checkpoint: checkpoint})
+	assert.NotNil(err)
+}
+
+func TestRunMigrate(t *testing.T) {
+	assert := require.New(t)
+	backends := newFakeMigrateBackends(t)
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.yaml")
+	cfg := fmt.Sprintf("influxdb:\n  endpoint: %q\n  org: org\n  bucket: clinic\n  token: token\nvm:\n  endpoint: %q\n",
+		backends.influx.URL, backends.vm.URL)
+	assert.Nil(os.WriteFile(cfgPath, []byte(cfg), 0644))
+
+	out := &bytes.Buffer{}
+	err := runMigrate(context.Background(), []string{"-c", cfgPath, "-measurements", "fast-tune-similarity",
+		"-start", "2022-01-01T00:00:00Z", "-end", "1641000600", "-rename", "fast-tune-similarity=similarity",
+		"-checkpoint", filepath.Join(dir, "checkpoint.json"), "-dry-run"}, out)
+	assert.Nil(err)
+	report := &MigrateReport{}
+	assert.Nil(json.Unmarshal(out.Bytes(), report))
+	assert.True(report.DryRun)
+	assert.Equal(map[string]int64{"similarity_value": 3}, report.Measurements[0].Metrics)
+
+	assert.NotNil(runMigrate(context.Background(), []string{"-c", cfgPath}, out))
+	assert.NotNil(runMigrate(context.Background(), []string{"-c", cfgPath, "-start", "1", "-rename", "x"}, out))
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec documents every route registered by NewRouter, keep it in sync
+// when adding routes, params or response fields.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPI serves the OpenAPI 3 spec of the api
+func (ep *ReportEndpoint) OpenAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ResponseWithContent(w, "application/json", openAPISpec)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mashenjun/report-api/pkg/client"
+	"github.com/stretchr/testify/require"
+)
+
+type openAPIDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+// jsonFields returns the json names of the struct fields, embedded structs are flattened
+func jsonFields(typ reflect.Type) []string {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	var names []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.Anonymous && len(name) == 0 {
+			names = append(names, jsonFields(field.Type)...)
+			continue
+		}
+		if name == "-" || len(name) == 0 {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newTestRouter(t *testing.T) *mux.Router {
+	reportAPI, err := NewReportAPI("http://127.0.0.1:0", "org", "bucket", "token",
+		WithSessionOption(&SessionConfig{Dir: filepath.Join(t.TempDir(), "sessions")}))
+	require.Nil(t, err)
+	t.Cleanup(reportAPI.Close)
+	dataAPI, err := NewDataAPI("http://127.0.0.1:0")
+	require.Nil(t, err)
+	return NewRouter(&ReportEndpoint{MaxRange: defaultMaxQueryRange}, reportAPI, dataAPI)
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	assert := require.New(t)
+	doc := &openAPIDoc{}
+	assert.Nil(json.Unmarshal(openAPISpec, doc))
+
+	// every route is documented and every documented operation is routed
+	documented := make(map[string]bool)
+	for path, ops := range doc.Paths {
+		for method := range ops {
+			if method == "parameters" {
+				continue
+			}
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+	routed := make(map[string]bool)
+	err := newTestRouter(t).Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		for _, method := range methods {
+			routed[method+" "+path] = true
+		}
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal(routed, documented)
+
+	// every $ref resolves
+	schemas := doc.Components.Schemas
+	var raw map[string]interface{}
+	assert.Nil(json.Unmarshal(openAPISpec, &raw))
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				parts := strings.Split(strings.TrimPrefix(ref, "#/"), "/")
+				var node interface{} = raw
+				for _, part := range parts {
+					m, ok := node.(map[string]interface{})
+					assert.True(ok, ref)
+					node, ok = m[part]
+					assert.True(ok, ref)
+				}
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(raw)
+
+	// the schemas, the server types and the client types agree on the fields
+	for name, pair := range map[string][2]interface{}{
+		"Node":                        {Node{}, client.Node{}},
+		"Edge":                        {Edge{}, client.Edge{}},
+		"QueryNodeGraphData":          {QueryNodeGraphData{}, client.QueryNodeGraphData{}},
+		"CompareNodeGraphData":        {CompareNodeGraphData{}, client.CompareNodeGraphData{}},
+		"NodeGraphSlice":              {NodeGraphSlice{}, client.NodeGraphSlice{}},
+		"SimilarityPoint":             {SimilarityPoint{}, client.SimilarityPoint{}},
+		"NodeSimilaritySeries":        {NodeSimilaritySeries{}, client.NodeSimilaritySeries{}},
+		"NodeGraphTimelineData":       {NodeGraphTimelineData{}, client.NodeGraphTimelineData{}},
+		"Annotation":                  {Annotation{}, client.Annotation{}},
+		"QueryAnnotationItem":         {QueryAnnotationItem{}, client.QueryAnnotationItem{}},
+		"AnnotationParam":             {AnnotationParam{}, client.AnnotationParam{}},
+		"AnnotationData":              {AnnotationData{}, client.AnnotationData{}},
+		"TextValueField":              {TextValueField{}, client.TextValueField{}},
+		"DurationInterval":            {DurationInterval{}, client.DurationInterval{}},
+		"InstanceValue":               {InstanceValue{}, client.InstanceValue{}},
+		"TextValueOccurrence":         {TextValueOccurrence{}, client.TextValueOccurrence{}},
+		"QueryDynamicTextValueV3Data": {QueryDynamicTextValueV3Data{}, client.QueryDynamicTextValueV3Data{}},
+		"TextValueFieldSchema":        {TextValueFieldSchema{}, client.TextValueFieldSchema{}},
+		"TextValueSchema":             {TextValueSchema{}, client.TextValueSchema{}},
+		"InsertSampleParam":           {InsertSampleParam{}, client.InsertSampleParam{}},
+		"SessionParam":                {SessionParam{}, client.SessionParam{}},
+		"SessionSummary":              {SessionSummary{}, client.SessionSummary{}},
+		"Session":                     {Session{}, client.Session{}},
+		"InflightQuery":               {InflightQuery{}, client.InflightQuery{}},
+		"LogLevel":                    {LogLevelData{}, client.LogLevel{}},
+		"ThrottleCounter":             {ThrottleCounter{}, client.ThrottleCounter{}},
+		"FlushData":                   {FlushData{}, client.FlushData{}},
+		"ClusterFlushData":            {ClusterFlushData{}, client.ClusterFlushData{}},
+		"SchemasData":                 {SchemasData{}, client.SchemasData{}},
+		"MeasurementSchema":           {MeasurementSchema{}, client.MeasurementSchema{}},
+		"FieldSchema":                 {FieldSchema{}, client.FieldSchema{}},
+		"ParamError":                  {ParamError{}, client.ParamError{}},
+	} {
+		schema, ok := schemas[name]
+		assert.True(ok, name)
+		var props []string
+		for prop := range schema.Properties {
+			props = append(props, prop)
+		}
+		sort.Strings(props)
+		assert.Equal(props, jsonFields(reflect.TypeOf(pair[0])), name)
+		assert.Equal(props, jsonFields(reflect.TypeOf(pair[1])), name)
+	}
+}
+
+func TestClient(t *testing.T) {
+	assert := require.New(t)
+	srv := httptest.NewServer(newTestRouter(t))
+	defer srv.Close()
+	cli := client.NewClient(srv.URL+"/", client.WithHTTPClient(srv.Client()))
+	ctx := context.Background()
+
+	// the params are rejected before any upstream query
+	_, err := cli.QueryNodeGraphV2(ctx, &client.QueryNodeGraphParam{TsRange: client.TsRange{StartTS: 200, EndTS: 100}})
+	cerr := &client.Error{}
+	assert.ErrorAs(err, &cerr)
+	assert.Equal(http.StatusBadRequest, cerr.StatusCode)
+	fields := make([]string, 0, len(cerr.Errors))
+	for _, pe := range cerr.Errors {
+		fields = append(fields, pe.Field)
+	}
+	assert.Contains(fields, "tidb_cluster_id")
+	assert.Contains(fields, "end_ts")
+
+	_, err = cli.GetSession(ctx, "0a")
+	assert.ErrorAs(err, &cerr)
+	assert.Equal(http.StatusNotFound, cerr.StatusCode)
+	sessions, err := cli.ListSessions(ctx, "clinic")
+	assert.Nil(err)
+	assert.Len(sessions, 0)
+
+	inflight, err := cli.InflightQueries(ctx)
+	assert.Nil(err)
+	assert.Len(inflight, 0)
+
+	schemas, err := cli.Schemas(ctx)
+	assert.Nil(err)
+	assert.Len(schemas.Measurements, 0)
+
+	flushed, err := cli.Flush(ctx, "clinic")
+	assert.Nil(err)
+	assert.Equal(0, flushed.Points)
+	assert.Len(flushed.Clusters, 0)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMaxQueryRange caps the window of a query when not configured
+const defaultMaxQueryRange = 31 * 24 * time.Hour
+
+// ParamError is the error of one request param
+type ParamError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// ParamErrors is returned by the ParamDecoder with every invalid param
+type ParamErrors []*ParamError
+
+func (errs ParamErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		if len(err.Field) == 0 {
+			msgs = append(msgs, err.Message)
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %s", err.Field, err.Message))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ParamDecoder reads the typed query params and collects the errors of all fields,
+// so the client sees every problem of the request at once.
+type ParamDecoder struct {
+	values   url.Values
+	now      time.Time
+	maxRange time.Duration
+	errs     ParamErrors
+}
+
+func NewParamDecoder(values url.Values, maxRange time.Duration) *ParamDecoder {
+	if maxRange <= 0 {
+		maxRange = defaultMaxQueryRange
+	}
+	return &ParamDecoder{values: values, now: time.Now(), maxRange: maxRange}
+}
+
+// AddError records the error of the field
+func (d *ParamDecoder) AddError(field string, format string, args ...interface{}) {
+	d.errs = append(d.errs, &ParamError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Err returns the ParamErrors, or nil when all params are valid
+func (d *ParamDecoder) Err() error {
+	if len(d.errs) == 0 {
+		return nil
+	}
+	return d.errs
+}
+
+func (d *ParamDecoder) String(name string) string {
+	return strings.TrimSpace(d.values.Get(name))
+}
+
+// Required returns the param and records an error when it is empty
+func (d *ParamDecoder) Required(name string) string {
+	v := d.String(name)
+	if len(v) == 0 {
+		d.AddError(name, "is required")
+	}
+	return v
+}
+
+// Strings returns the values of the repeated or comma separated param
+func (d *ParamDecoder) Strings(name string) []string {
+	var vs []string
+	for _, v := range d.values[name] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				vs = append(vs, s)
+			}
+		}
+	}
+	return vs
+}
+
+// Bool returns nil when the param is not set
+func (d *ParamDecoder) Bool(name string) *bool {
+	v := d.String(name)
+	if len(v) == 0 {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		d.AddError(name, "%q is not a bool", v)
+		return nil
+	}
+	return &b
+}
+
+// Duration accepts a go duration like 5m or a number of seconds, returns nil when
+// the param is not set
+func (d *ParamDecoder) Duration(name string) *time.Duration {
+	v := d.String(name)
+	if len(v) == 0 {
+		return nil
+	}
+	dur, err := ParseStep(v)
+	if err != nil || dur < 0 {
+		d.AddError(name, "%q is not a duration like 30s, 5m or a number of seconds", v)
+		return nil
+	}
+	return &dur
+}
+
+// Time returns the unix seconds of the first param set in names, see ParseTimeParam.
+// The error is recorded on the first name.
+func (d *ParamDecoder) Time(names ...string) (int64, bool) {
+	for _, name := range names {
+		v := d.String(name)
+		if len(v) == 0 {
+			continue
+		}
+		ts, err := ParseTimeParam(v, d.now)
+		if err != nil {
+			d.AddError(name, "%v", err)
+			return 0, false
+		}
+		return ts, true
+	}
+	return 0, false
+}
+
+// TsRange decodes `<prefix>start_ts` and `<prefix>end_ts`, grafana's `from` and `to`
+// are accepted as well without prefix. Both are required, start must be before end
+// and the range must not exceed the max range.
+func (d *ParamDecoder) TsRange(prefix string) TsRange {
+	startNames := []string{prefix + "start_ts"}
+	endNames := []string{prefix + "end_ts"}
+	if len(prefix) == 0 {
+		startNames = append(startNames, "from")
+		endNames = append(endNames, "to")
+	}
+	errCnt := len(d.errs)
+	start, startOK := d.Time(startNames...)
+	end, endOK := d.Time(endNames...)
+	if len(d.errs) > errCnt {
+		return TsRange{StartTS: start, EndTS: end}
+	}
+	if !startOK {
+		d.AddError(startNames[0], "is required")
+	}
+	if !endOK {
+		d.AddError(endNames[0], "is required")
+	}
+	if !startOK || !endOK {
+		return TsRange{StartTS: start, EndTS: end}
+	}
+	if start >= end {
+		d.AddError(endNames[0], "must be after %s", startNames[0])
+	} else if window := time.Duration(end-start) * time.Second; window > d.maxRange {
+		d.AddError(endNames[0], "range %v exceeds the max range %v", window, d.maxRange)
+	}
+	return TsRange{StartTS: start, EndTS: end}
+}
+
+// millisThreshold separates unix seconds from milliseconds, it is year 5138 in seconds
+const millisThreshold = 1e11
+
+// ParseTimeParam parses the time into unix seconds. It accepts unix seconds, unix
+// milliseconds as grafana sends in `from` and `to`, RFC3339 and the relative forms
+// now, now-1h and now+30m. Relative durations support the d and w units.
+func ParseTimeParam(s string, now time.Time) (int64, error) {
+	if strings.HasPrefix(s, "now") {
+		rest := s[len("now"):]
+		if len(rest) == 0 {
+			return now.Unix(), nil
+		}
+		sign := time.Duration(1)
+		switch rest[0] {
+		case '-':
+			sign = -1
+		case '+':
+		default:
+			return 0, fmt.Errorf("%q is not a relative time like now-1h", s)
+		}
+		dur, err := parseRelativeDuration(rest[1:])
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a relative time like now-1h", s)
+		}
+		return now.Add(sign * dur).Unix(), nil
+	}
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		if v <= 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			return 0, fmt.Errorf("%q is not a positive timestamp", s)
+		}
+		if v >= millisThreshold {
+			return int64(v / 1e3), nil
+		}
+		return int64(v), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.Unix(), nil
+	}
+	return 0, fmt.Errorf("%q is not a unix timestamp, RFC3339 time or relative time like now-1h", s)
+}
+
+// parseRelativeDuration is time.ParseDuration with the day and week units
+func parseRelativeDuration(s string) (time.Duration, error) {
+	for unit, size := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if !strings.HasSuffix(s, unit) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(s, unit), 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * size, nil
+	}
+	return time.ParseDuration(s)
+}
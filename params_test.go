@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimeParam(t *testing.T) {
+	assert := require.New(t)
+	now := time.Unix(1650000000, 0)
+	for s, expect := range map[string]int64{
+		"1640000000":                1640000000,
+		"1640000000.9":              1640000000,
+		"1640000000123":             1640000000,
+		"2022-04-15T05:20:00Z":      1650000000,
+		"2022-04-15T13:20:00+08:00": 1650000000,
+		"now":                       1650000000,
+		"now-1h":                    1650000000 - 3600,
+		"now+30m":                   1650000000 + 1800,
+		"now-2d":                    1650000000 - 2*86400,
+		"now-1w":                    1650000000 - 7*86400,
+	} {
+		ts, err := ParseTimeParam(s, now)
+		assert.Nil(err, s)
+		assert.Equal(expect, ts, s)
+	}
+	for _, s := range []string{"abc", "0", "-1", "now-", "now-1x", "now/d", "2022-04-15", "now-1.5d"} {
+		_, err := ParseTimeParam(s, now)
+		assert.NotNil(err, s)
+	}
+}
+
+func TestParamDecoder(t *testing.T) {
+	assert := require.New(t)
+	decode := func(query string) (*ParamDecoder, TsRange) {
+		values, err := url.ParseQuery(query)
+		assert.Nil(err)
+		d := NewParamDecoder(values, 24*time.Hour)
+		return d, d.TsRange("")
+	}
+
+	d, tr := decode("start_ts=1640000000&end_ts=1640003600")
+	assert.Nil(d.Err())
+	assert.Equal(TsRange{StartTS: 1640000000, EndTS: 1640003600}, tr)
+
+	// grafana sends milliseconds in from and to
+	d, tr = decode("from=1640000000000&to=1640003600000")
+	assert.Nil(d.Err())
+	assert.Equal(TsRange{StartTS: 1640000000, EndTS: 1640003600}, tr)
+
+	d, _ = decode("start_ts=abc")
+	errs := d.Err().(ParamErrors)
+	assert.Len(errs, 1)
+	assert.Equal("start_ts", errs[0].Field)
+	assert.Contains(errs[0].Message, `"abc"`)
+
+	d, _ = decode("")
+	assert.Equal("start_ts: is required; end_ts: is required", d.Err().Error())
+
+	d, _ = decode("start_ts=1640003600&end_ts=1640000000")
+	assert.Equal("end_ts: must be after start_ts", d.Err().Error())
+
+	d, _ = decode("start_ts=now-2d&end_ts=now")
+	assert.Contains(d.Err().Error(), "exceeds the max range")
+
+	values, _ := url.ParseQuery("merge=maybe&merge_gap=5x&filter=severity>=warning,level=1&step=300")
+	d = NewParamDecoder(values, 0)
+	param := &QueryAnnotationsParam{}
+	parseAnnotationParam(d, param)
+	assert.Len(param.Filters, 1)
+	assert.Equal(5*time.Minute, *d.Duration("step"))
+	errs = d.Err().(ParamErrors)
+	fields := make([]string, 0, len(errs))
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+	assert.Equal([]string{"merge", "merge_gap", "filter"}, fields)
+	assert.Equal(defaultMaxQueryRange, d.maxRange)
+}
+
+func TestResponseWithParamError(t *testing.T) {
+	assert := require.New(t)
+	ep := &ReportEndpoint{}
+	req := httptest.NewRequest(http.MethodGet, "/node_graph/v2?start_ts=abc&end_ts=now&agg=sum", nil)
+	w := httptest.NewRecorder()
+	ep.QueryNodeGraphV2(nil)(w, req)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	resp := struct {
+		Errors ParamErrors `json:"errors"`
+	}{}
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Len(resp.Errors, 2)
+	assert.Equal("tidb_cluster_id", resp.Errors[0].Field)
+	assert.Equal("start_ts", resp.Errors[1].Field)
+
+	// the errors of Validate have no field
+	req = httptest.NewRequest(http.MethodGet, "/node_graph/v2?tidb_cluster_id=c1&from=now-1h&to=now&agg=sum", nil)
+	w = httptest.NewRecorder()
+	ep.QueryNodeGraphV2(nil)(w, req)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.JSONEq(`{"errors":[{"message":"agg \"sum\" is not supported"}]}`, w.Body.String())
+}
@@ -0,0 +1,385 @@
+// Package client is a typed client of the report api, the routes and types follow
+// the openapi.json served at /openapi.json.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is returned when the server responds a non 2xx status
+type Error struct {
+	StatusCode int
+	// RetryAfter is set when the request is throttled with 429
+	RetryAfter time.Duration `json:"-"`
+	// Errors is set when the server rejects the request params
+	Errors []*ParamError `json:"errors"`
+}
+
+func (e *Error) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("report api: %s", http.StatusText(e.StatusCode))
+	}
+	msgs := make([]string, 0, len(e.Errors))
+	for _, pe := range e.Errors {
+		if len(pe.Field) == 0 {
+			msgs = append(msgs, pe.Message)
+			continue
+		}
+		msgs = append(msgs, pe.Field+": "+pe.Message)
+	}
+	return fmt.Sprintf("report api: %s: %s", http.StatusText(e.StatusCode), strings.Join(msgs, "; "))
+}
+
+type Client struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+type Option func(c *Client)
+
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// NewClient creates a client of the report api served at endpoint, e.g. http://127.0.0.1:8080
+func NewClient(endpoint string, opts ...Option) *Client {
+	c := &Client{
+		endpoint:   strings.TrimRight(endpoint, "/"),
+		httpClient: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Client) QueryNodeGraph(ctx context.Context, param *QueryNodeGraphParam) (*QueryNodeGraphData, error) {
+	data := &QueryNodeGraphData{}
+	err := c.get(ctx, "/node_graph", nodeGraphQuery(param), data)
+	return data, err
+}
+
+func (c *Client) QueryNodeGraphV2(ctx context.Context, param *QueryNodeGraphParam) (*QueryNodeGraphData, error) {
+	data := &QueryNodeGraphData{}
+	err := c.get(ctx, "/node_graph/v2", nodeGraphQuery(param), data)
+	return data, err
+}
+
+// QueryNodeGraphTimeline splits the range into windows of step seconds
+func (c *Client) QueryNodeGraphTimeline(ctx context.Context, param *QueryNodeGraphParam, step int64) (*NodeGraphTimelineData, error) {
+	q := nodeGraphQuery(param)
+	q.Set("step", strconv.FormatInt(step, 10))
+	data := &NodeGraphTimelineData{}
+	err := c.get(ctx, "/node_graph/v2", q, data)
+	return data, err
+}
+
+// RenderNodeGraph returns the image of the node graph and its content type, format is svg or png
+func (c *Client) RenderNodeGraph(ctx context.Context, param *QueryNodeGraphParam, format string) ([]byte, string, error) {
+	q := nodeGraphQuery(param)
+	setIfNotEmpty(q, "format", format)
+	return c.getRaw(ctx, "/node_graph/v2/render", q)
+}
+
+func (c *Client) CompareNodeGraph(ctx context.Context, param *CompareNodeGraphParam) (*CompareNodeGraphData, error) {
+	q := url.Values{}
+	setIfNotEmpty(q, "tree", param.Tree)
+	setIfNotEmpty(q, "agg", param.Agg)
+	q.Set("tidb_cluster_id", param.Base.TiDBClusterID)
+	setTsRange(q, "", param.Base.TsRange)
+	setIfNotEmpty(q, "compare_tidb_cluster_id", param.Compare.TiDBClusterID)
+	setTsRange(q, "compare_", param.Compare.TsRange)
+	data := &CompareNodeGraphData{}
+	err := c.get(ctx, "/node_graph/v2/compare", q, data)
+	return data, err
+}
+
+func (c *Client) QueryAnnotations(ctx context.Context, param *QueryAnnotationsParam) ([]QueryAnnotationItem, error) {
+	var data []QueryAnnotationItem
+	err := c.get(ctx, "/annotations", annotationsQuery(param), &data)
+	return data, err
+}
+
+func (c *Client) QueryAnnotationsV2(ctx context.Context, param *QueryAnnotationsParam) ([]QueryAnnotationItem, error) {
+	var data []QueryAnnotationItem
+	err := c.get(ctx, "/annotations/v2", annotationsQuery(param), &data)
+	return data, err
+}
+
+func (c *Client) CreateAnnotation(ctx context.Context, param *AnnotationParam) (*AnnotationData, error) {
+	data := &AnnotationData{}
+	err := c.do(ctx, http.MethodPost, "/annotations", nil, param, data)
+	return data, err
+}
+
+func (c *Client) UpdateAnnotation(ctx context.Context, id string, param *AnnotationParam) (*AnnotationData, error) {
+	data := &AnnotationData{}
+	err := c.do(ctx, http.MethodPut, "/annotations/"+url.PathEscape(id), nil, param, data)
+	return data, err
+}
+
+func (c *Client) DeleteAnnotation(ctx context.Context, clusterID, measurement, id string) error {
+	q := url.Values{}
+	q.Set("tidb_cluster_id", clusterID)
+	setIfNotEmpty(q, "measurement", measurement)
+	return c.do(ctx, http.MethodDelete, "/annotations/"+url.PathEscape(id), q, nil, nil)
+}
+
+func (c *Client) QueryDynamicTextValue(ctx context.Context, param *QueryDynamicTextValueParam) (QueryDynamicTextValueData, error) {
+	data := QueryDynamicTextValueData{}
+	err := c.get(ctx, "/dynamic_text_value", textValueQuery(param), &data)
+	return data, err
+}
+
+func (c *Client) QueryDynamicTextValueV2(ctx context.Context, param *QueryDynamicTextValueParam) (QueryDynamicTextValueData, error) {
+	data := QueryDynamicTextValueData{}
+	err := c.get(ctx, "/dynamic_text_value/v2", textValueQuery(param), &data)
+	return data, err
+}
+
+func (c *Client) QueryDynamicTextValueV3(ctx context.Context, param *QueryDynamicTextValueParam) (*QueryDynamicTextValueV3Data, error) {
+	data := &QueryDynamicTextValueV3Data{}
+	err := c.get(ctx, "/dynamic_text_value/v3", textValueQuery(param), data)
+	return data, err
+}
+
+func (c *Client) QueryDynamicTextValueSchema(ctx context.Context, param *QueryDynamicTextValueParam) (*TextValueSchema, error) {
+	data := &TextValueSchema{}
+	err := c.get(ctx, "/dynamic_text_value/v3/schema", textValueQuery(param), data)
+	return data, err
+}
+
+func (c *Client) InsertSample(ctx context.Context, param *InsertSampleParam) error {
+	return c.do(ctx, http.MethodPost, "/sample", nil, param, &InsertSampleData{})
+}
+
+func (c *Client) InsertSampleV2(ctx context.Context, param *InsertSampleParam) error {
+	return c.do(ctx, http.MethodPost, "/sample/v2", nil, param, &InsertSampleData{})
+}
+
+// Flush pushes the buffered points of the cluster to influxdb, all clusters when clusterID is empty
+func (c *Client) Flush(ctx context.Context, clusterID string) (*FlushData, error) {
+	q := url.Values{}
+	setIfNotEmpty(q, "tidb_cluster_id", clusterID)
+	data := &FlushData{}
+	err := c.do(ctx, http.MethodPost, "/flush", q, nil, data)
+	return data, err
+}
+
+// Schemas lists the measurements accepted by InsertSample and InsertSampleV2
+func (c *Client) Schemas(ctx context.Context) (*SchemasData, error) {
+	data := &SchemasData{}
+	err := c.get(ctx, "/schemas", nil, data)
+	return data, err
+}
+
+// Report returns the rendered report and its content type
+func (c *Client) Report(ctx context.Context, param *ReportParam) ([]byte, string, error) {
+	q := url.Values{}
+	q.Set("tidb_cluster_id", param.TiDBClusterID)
+	setTsRange(q, "", param.TsRange)
+	setIfNotEmpty(q, "tree", param.Tree)
+	setIfNotEmpty(q, "format", param.Format)
+	setTimeFormat(q, param.TimeFormatParam)
+	return c.getRaw(ctx, "/report", q)
+}
+
+func (c *Client) CreateSession(ctx context.Context, param *SessionParam) (*Session, error) {
+	data := &Session{}
+	err := c.do(ctx, http.MethodPost, "/sessions", nil, param, data)
+	return data, err
+}
+
+func (c *Client) GetSession(ctx context.Context, id string) (*Session, error) {
+	data := &Session{}
+	err := c.get(ctx, "/sessions/"+url.PathEscape(id), nil, data)
+	return data, err
+}
+
+// ListSessions lists the sessions newest first, all clusters when clusterID is empty
+func (c *Client) ListSessions(ctx context.Context, clusterID string) ([]*SessionSummary, error) {
+	q := url.Values{}
+	setIfNotEmpty(q, "tidb_cluster_id", clusterID)
+	var data []*SessionSummary
+	err := c.get(ctx, "/sessions", q, &data)
+	return data, err
+}
+
+// GrafanaDashboard returns the dashboard model to import into grafana
+func (c *Client) GrafanaDashboard(ctx context.Context, clusterID, tree string, measurements ...string) (json.RawMessage, error) {
+	q := url.Values{}
+	q.Set("tidb_cluster_id", clusterID)
+	setIfNotEmpty(q, "tree", tree)
+	for _, m := range measurements {
+		q.Add("measurement", m)
+	}
+	var data json.RawMessage
+	err := c.get(ctx, "/grafana/dashboard", q, &data)
+	return data, err
+}
+
+func (c *Client) InflightQueries(ctx context.Context) ([]*InflightQuery, error) {
+	var data []*InflightQuery
+	err := c.get(ctx, "/debug/inflight", nil, &data)
+	return data, err
+}
+
+// RateLimitStats returns the counters of the throttled requests by client and cluster
+func (c *Client) RateLimitStats(ctx context.Context) ([]*ThrottleCounter, error) {
+	var data []*ThrottleCounter
+	err := c.get(ctx, "/debug/ratelimit", nil, &data)
+	return data, err
+}
+
+func (c *Client) LogLevel(ctx context.Context) (string, error) {
+	data := &LogLevel{}
+	err := c.get(ctx, "/debug/loglevel", nil, data)
+	return data.Level, err
+}
+
+// SetLogLevel changes the log level of the server, level is one of debug, info, warn and error
+func (c *Client) SetLogLevel(ctx context.Context, level string) error {
+	return c.do(ctx, http.MethodPut, "/debug/loglevel", nil, &LogLevel{Level: level}, &LogLevel{})
+}
+
+// QueryMetrics forwards the promql query to the metrics storage, q holds the
+// params of the prometheus instant query api
+func (c *Client) QueryMetrics(ctx context.Context, q url.Values) (json.RawMessage, error) {
+	var data json.RawMessage
+	err := c.get(ctx, "/data/metrics", q, &data)
+	return data, err
+}
+
+func (c *Client) get(ctx context.Context, path string, q url.Values, out interface{}) error {
+	return c.do(ctx, http.MethodGet, path, q, nil, out)
+}
+
+func (c *Client) getRaw(ctx context.Context, path string, q url.Values) ([]byte, string, error) {
+	resp, err := c.send(ctx, http.MethodGet, path, q, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return bs, resp.Header.Get("Content-Type"), nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		bs, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(bs)
+	}
+	resp, err := c.send(ctx, method, path, q, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send returns the response when the status is 2xx, otherwise the *Error
+func (c *Client) send(ctx context.Context, method, path string, q url.Values, body io.Reader) (*http.Response, error) {
+	u := c.endpoint + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	e := &Error{StatusCode: resp.StatusCode}
+	if seconds, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	// the body is {} or {"errors":[...]}, ignore the body that is not json
+	_ = json.NewDecoder(resp.Body).Decode(e)
+	return nil, e
+}
+
+func nodeGraphQuery(param *QueryNodeGraphParam) url.Values {
+	q := url.Values{}
+	q.Set("tidb_cluster_id", param.TiDBClusterID)
+	setTsRange(q, "", param.TsRange)
+	setIfNotEmpty(q, "tree", param.Tree)
+	setIfNotEmpty(q, "agg", param.Agg)
+	return q
+}
+
+func annotationsQuery(param *QueryAnnotationsParam) url.Values {
+	q := url.Values{}
+	q.Set("tidb_cluster_id", param.TiDBClusterID)
+	setTsRange(q, "", param.TsRange)
+	setIfNotEmpty(q, "measurement", param.Measurement)
+	setTimeFormat(q, param.TimeFormatParam)
+	if param.Merge != nil {
+		q.Set("merge", strconv.FormatBool(*param.Merge))
+	}
+	setIfNotEmpty(q, "merge_gap", param.MergeGap)
+	for _, f := range param.Filters {
+		q.Add("filter", f)
+	}
+	return q
+}
+
+func textValueQuery(param *QueryDynamicTextValueParam) url.Values {
+	q := url.Values{}
+	q.Set("tidb_cluster_id", param.TiDBClusterID)
+	setTsRange(q, "", param.TsRange)
+	setIfNotEmpty(q, "measurement", param.Measurement)
+	setTimeFormat(q, param.TimeFormatParam)
+	setIfNotEmpty(q, "default_1", param.Default1)
+	return q
+}
+
+func setTsRange(q url.Values, prefix string, tr TsRange) {
+	if tr.StartTS != 0 {
+		q.Set(prefix+"start_ts", strconv.FormatInt(tr.StartTS, 10))
+	}
+	if tr.EndTS != 0 {
+		q.Set(prefix+"end_ts", strconv.FormatInt(tr.EndTS, 10))
+	}
+}
+
+func setTimeFormat(q url.Values, tf TimeFormatParam) {
+	setIfNotEmpty(q, "tz", tf.TZ)
+	setIfNotEmpty(q, "time_format", tf.TimeFormat)
+}
+
+func setIfNotEmpty(q url.Values, key, value string) {
+	if len(value) > 0 {
+		q.Set(key, value)
+	}
+}
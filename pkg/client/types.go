@@ -0,0 +1,308 @@
+package client
+
+// The types mirror the request and response bodies in openapi.json, the json tags
+// must match the server side ones in proto.go.
+
+// TsRange is in unix seconds
+type TsRange struct {
+	StartTS int64 `json:"start_ts"`
+	EndTS   int64 `json:"end_ts"`
+}
+
+type TimeFormatParam struct {
+	TZ         string `json:"tz,omitempty"`
+	TimeFormat string `json:"time_format,omitempty"`
+}
+
+type QueryNodeGraphParam struct {
+	TsRange
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Tree          string `json:"tree,omitempty"`
+	Agg           string `json:"agg,omitempty"`
+}
+
+type Node struct {
+	ID               string  `json:"id"`
+	Title            string  `json:"title"`
+	SubTitle         string  `json:"subTitle"`
+	MainStat         string  `json:"mainStat"`
+	SecondaryStat    string  `json:"secondaryStat"`
+	ArcPositive      float64 `json:"arc__similarity"`
+	ArcNegative      float64 `json:"arc__nusimilarity"`
+	ArcPositiveColor string  `json:"arc__similarity_color"`
+	ArcNegativeColor string  `json:"arc__nusimilarity_color"`
+}
+
+type Edge struct {
+	ID            string `json:"id"`
+	Source        string `json:"source"`
+	Target        string `json:"target"`
+	MainStat      string `json:"mainStat,omitempty"`
+	SecondaryStat string `json:"secondaryStat,omitempty"`
+}
+
+type QueryNodeGraphData struct {
+	Nodes []*Node `json:"nodes"`
+	Edges []*Edge `json:"edges"`
+}
+
+type NodeGraphSlice struct {
+	TsRange
+	NodeGraph *QueryNodeGraphData `json:"node_graph"`
+}
+
+type SimilarityPoint struct {
+	// Time is the end of the window in unix milliseconds
+	Time       int64   `json:"time"`
+	Similarity float64 `json:"similarity"`
+}
+
+type NodeSimilaritySeries struct {
+	ID       string             `json:"id"`
+	Title    string             `json:"title"`
+	SubTitle string             `json:"subTitle"`
+	Points   []*SimilarityPoint `json:"points"`
+}
+
+type NodeGraphTimelineData struct {
+	// Step is in seconds
+	Step   int64                   `json:"step"`
+	Slices []*NodeGraphSlice       `json:"slices"`
+	Series []*NodeSimilaritySeries `json:"series"`
+}
+
+// CompareNodeGraphParam compares two ranges, the compare cluster defaults to the base one
+type CompareNodeGraphParam struct {
+	Tree    string              `json:"tree,omitempty"`
+	Agg     string              `json:"agg,omitempty"`
+	Base    QueryNodeGraphParam `json:"base"`
+	Compare QueryNodeGraphParam `json:"compare"`
+}
+
+type CompareNode struct {
+	*Node
+	Side              string   `json:"detail__side"`
+	BaseSimilarity    *float64 `json:"detail__base_similarity"`
+	CompareSimilarity *float64 `json:"detail__compare_similarity"`
+	Delta             float64  `json:"detail__delta"`
+}
+
+type CompareEdge struct {
+	*Edge
+	Side string `json:"detail__side"`
+}
+
+type CompareNodeGraphData struct {
+	Nodes []*CompareNode `json:"nodes"`
+	Edges []*CompareEdge `json:"edges"`
+}
+
+type QueryAnnotationsParam struct {
+	TsRange
+	TimeFormatParam
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Measurement   string `json:"measurement"`
+	// Merge and MergeGap override the server config when set, MergeGap is like 5m
+	Merge    *bool    `json:"merge,omitempty"`
+	MergeGap string   `json:"merge_gap,omitempty"`
+	Filters  []string `json:"filters,omitempty"`
+}
+
+type Annotation struct {
+	Name       string `json:"name"`
+	Datasource string `json:"datasource"`
+	IconColor  string `json:"iconColor"`
+	Enable     bool   `json:"enable"`
+	ShowLine   bool   `json:"showLine"`
+	Query      string `json:"query"`
+}
+
+type QueryAnnotationItem struct {
+	ID          string      `json:"id,omitempty"`
+	Annotation  *Annotation `json:"annotation"`
+	Time        int64       `json:"time"`
+	TimeEnd     int64       `json:"timeEnd,omitempty"`
+	TimeText    string      `json:"timeText"`
+	TimeEndText string      `json:"timeEndText,omitempty"`
+	Title       string      `json:"title"`
+	Tags        string      `json:"tags"`
+	Text        string      `json:"text"`
+	PanelID     int64       `json:"panelId"`
+	Severity    string      `json:"severity,omitempty"`
+	Category    string      `json:"category,omitempty"`
+}
+
+// AnnotationParam is the body to create or update an annotation, the times are in milliseconds
+type AnnotationParam struct {
+	ID            string `json:"id,omitempty"`
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Measurement   string `json:"measurement,omitempty"`
+	Time          int64  `json:"time"`
+	TimeEnd       int64  `json:"timeEnd,omitempty"`
+	PanelID       int64  `json:"panelId"`
+	Title         string `json:"title"`
+	Text          string `json:"text"`
+	Tags          string `json:"tags"`
+	Severity      string `json:"severity,omitempty"`
+	Category      string `json:"category,omitempty"`
+}
+
+type AnnotationData struct {
+	ID string `json:"id"`
+}
+
+type QueryDynamicTextValueParam struct {
+	TsRange
+	TimeFormatParam
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Measurement   string `json:"measurement"`
+	Default1      string `json:"default_1"`
+}
+
+type QueryDynamicTextValueData map[string]interface{}
+
+type TextValueField struct {
+	Type  string  `json:"type"`
+	Value float64 `json:"value"`
+	Text  string  `json:"text,omitempty"`
+}
+
+type DurationInterval struct {
+	Seconds   int64  `json:"seconds"`
+	StartUnix int64  `json:"startUnix"`
+	EndUnix   int64  `json:"endUnix"`
+	Start     string `json:"start"`
+	End       string `json:"end"`
+}
+
+type InstanceValue struct {
+	Address string `json:"address"`
+	Value   int64  `json:"value"`
+}
+
+type TextValueOccurrence struct {
+	Index     int                          `json:"index"`
+	Timestamp int64                        `json:"timestamp"`
+	Fields    map[string]*TextValueField   `json:"fields"`
+	Durations map[string]*DurationInterval `json:"durations"`
+	Instances map[string][]*InstanceValue  `json:"instances"`
+}
+
+type QueryDynamicTextValueV3Data struct {
+	Measurement string                     `json:"measurement"`
+	Fields      map[string]*TextValueField `json:"fields"`
+	Occurrences []*TextValueOccurrence     `json:"occurrences"`
+}
+
+type TextValueFieldSchema struct {
+	Name    string `json:"name"`
+	Metric  string `json:"metric"`
+	Type    string `json:"type"`
+	Aggr    string `json:"aggr,omitempty"`
+	Section string `json:"section"`
+}
+
+type TextValueSchema struct {
+	Measurement string                  `json:"measurement"`
+	Fields      []*TextValueFieldSchema `json:"fields"`
+}
+
+type InsertSampleParam struct {
+	// Timestamp is in unix seconds
+	Timestamp     int64                  `json:"timestamp"`
+	Measurement   string                 `json:"measurement"`
+	TiDBClusterID string                 `json:"tidb_cluster_id"`
+	Fields        map[string]interface{} `json:"fields"`
+	Tags          map[string]string      `json:"tags"`
+}
+
+type InsertSampleData struct{}
+
+type FlushData struct {
+	Points   int                 `json:"points"`
+	Clusters []*ClusterFlushData `json:"clusters"`
+}
+
+type ClusterFlushData struct {
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Points        int    `json:"points"`
+}
+
+type SchemasData struct {
+	AllowUnknown bool                 `json:"allow_unknown"`
+	Measurements []*MeasurementSchema `json:"measurements"`
+}
+
+type MeasurementSchema struct {
+	Name         string         `json:"name"`
+	Description  string         `json:"description,omitempty"`
+	RequiredTags []string       `json:"required_tags"`
+	Fields       []*FieldSchema `json:"fields"`
+}
+
+type FieldSchema struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+}
+
+type ReportParam struct {
+	TsRange
+	TimeFormatParam
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Tree          string `json:"tree,omitempty"`
+	// Format is markdown or html, default is markdown
+	Format string `json:"format,omitempty"`
+}
+
+type SessionParam struct {
+	TsRange
+	TimeFormatParam
+	TiDBClusterID string   `json:"tidb_cluster_id"`
+	Tree          string   `json:"tree,omitempty"`
+	Title         string   `json:"title,omitempty"`
+	Measurements  []string `json:"measurements,omitempty"`
+}
+
+type SessionSummary struct {
+	ID            string `json:"id"`
+	Link          string `json:"link"`
+	Title         string `json:"title,omitempty"`
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Tree          string `json:"tree"`
+	StartTS       int64  `json:"start_ts"`
+	EndTS         int64  `json:"end_ts"`
+	// CreatedAt is in unix seconds
+	CreatedAt int64 `json:"created_at"`
+}
+
+type Session struct {
+	SessionSummary
+	NodeGraph   *QueryNodeGraphData                     `json:"node_graph"`
+	Annotations []QueryAnnotationItem                   `json:"annotations"`
+	TextValues  map[string]*QueryDynamicTextValueV3Data `json:"text_values"`
+}
+
+type InflightQuery struct {
+	Key     string `json:"key"`
+	Waiters int64  `json:"waiters"`
+}
+
+type ThrottleCounter struct {
+	Class     string `json:"class"`
+	Scope     string `json:"scope"`
+	Key       string `json:"key"`
+	Throttled int64  `json:"throttled"`
+}
+
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+// ParamError is the error of one request param
+type ParamError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	pngBackground = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	pngEdgeColor  = color.RGBA{R: 136, G: 136, B: 136, A: 255}
+	pngTextColor  = color.RGBA{R: 34, G: 34, B: 34, A: 255}
+	pngMutedColor = color.RGBA{R: 85, G: 85, B: 85, A: 255}
+	pngEmptyRing  = color.RGBA{R: 204, G: 204, B: 204, A: 255}
+)
+
+// namedColors are the css color names used by the node colors
+var namedColors = map[string]color.RGBA{
+	"black":  {A: 255},
+	"white":  {R: 255, G: 255, B: 255, A: 255},
+	"red":    {R: 255, A: 255},
+	"green":  {G: 128, A: 255},
+	"blue":   {B: 255, A: 255},
+	"yellow": {R: 255, G: 255, A: 255},
+	"orange": {R: 255, G: 165, A: 255},
+	"purple": {R: 128, B: 128, A: 255},
+	"gray":   {R: 128, G: 128, B: 128, A: 255},
+	"grey":   {R: 128, G: 128, B: 128, A: 255},
+}
+
+// parseColor parses a css color name, #rgb, #rrggbb, rgb() or rgba()
+func parseColor(s string) (color.RGBA, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if c, ok := namedColors[s]; ok {
+		return c, nil
+	}
+	if strings.HasPrefix(s, "#") {
+		hex := s[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		if len(hex) != 6 {
+			return color.RGBA{}, fmt.Errorf("color %q is invalid", s)
+		}
+		v, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return color.RGBA{}, fmt.Errorf("color %q is invalid", s)
+		}
+		return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+	}
+	for _, fn := range []string{"rgba(", "rgb("} {
+		if !strings.HasPrefix(s, fn) || !strings.HasSuffix(s, ")") {
+			continue
+		}
+		parts := strings.Split(s[len(fn):len(s)-1], ",")
+		if len(parts) != len(fn)-1 {
+			return color.RGBA{}, fmt.Errorf("color %q is invalid", s)
+		}
+		values := make([]float64, len(parts))
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return color.RGBA{}, fmt.Errorf("color %q is invalid", s)
+			}
+			values[i] = v
+		}
+		c := color.RGBA{R: clampByte(values[0]), G: clampByte(values[1]), B: clampByte(values[2]), A: 255}
+		if len(values) == 4 {
+			c.A = clampByte(values[3] * 255)
+		}
+		return c, nil
+	}
+	return color.RGBA{}, fmt.Errorf("color %q is not supported", s)
+}
+
+func clampByte(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, math.Round(v))))
+}
+
+// canvas is a minimal anti-aliased rasterizer on top of image.RGBA
+type canvas struct {
+	img *image.RGBA
+}
+
+func newCanvas(width, height int) *canvas {
+	c := &canvas{img: image.NewRGBA(image.Rect(0, 0, width, height))}
+	for i := 0; i < len(c.img.Pix); i += 4 {
+		c.img.Pix[i], c.img.Pix[i+1], c.img.Pix[i+2], c.img.Pix[i+3] = pngBackground.R, pngBackground.G, pngBackground.B, pngBackground.A
+	}
+	return c
+}
+
+// blend paints the color onto the pixel with the coverage in [0, 1]
+func (c *canvas) blend(x, y int, col color.RGBA, coverage float64) {
+	if !(image.Point{X: x, Y: y}.In(c.img.Rect)) || coverage <= 0 {
+		return
+	}
+	alpha := math.Min(1, coverage) * float64(col.A) / 255
+	i := c.img.PixOffset(x, y)
+	for k, v := range []uint8{col.R, col.G, col.B} {
+		dst := float64(c.img.Pix[i+k])
+		c.img.Pix[i+k] = clampByte(dst + (float64(v)-dst)*alpha)
+	}
+	c.img.Pix[i+3] = 255
+}
+
+// line draws a segment of the width
+func (c *canvas) line(from, to svgPoint, width float64, col color.RGBA) {
+	minX, maxX := math.Min(from.X, to.X)-width, math.Max(from.X, to.X)+width
+	minY, maxY := math.Min(from.Y, to.Y)-width, math.Max(from.Y, to.Y)+width
+	dx, dy := to.X-from.X, to.Y-from.Y
+	length2 := dx*dx + dy*dy
+	for y := int(minY); y <= int(maxY); y++ {
+		for x := int(minX); x <= int(maxX); x++ {
+			px, py := float64(x)+0.5, float64(y)+0.5
+			t := 0.0
+			if length2 > 0 {
+				t = math.Max(0, math.Min(1, ((px-from.X)*dx+(py-from.Y)*dy)/length2))
+			}
+			d := math.Hypot(px-(from.X+t*dx), py-(from.Y+t*dy))
+			c.blend(x, y, col, width/2+0.5-d)
+		}
+	}
+}
+
+// triangle fills the triangle, used for the arrow heads
+func (c *canvas) triangle(a, b, d svgPoint, col color.RGBA) {
+	minX, maxX := math.Min(a.X, math.Min(b.X, d.X)), math.Max(a.X, math.Max(b.X, d.X))
+	minY, maxY := math.Min(a.Y, math.Min(b.Y, d.Y)), math.Max(a.Y, math.Max(b.Y, d.Y))
+	edge := func(p, q svgPoint, x, y float64) float64 {
+		return (q.X-p.X)*(y-p.Y) - (q.Y-p.Y)*(x-p.X)
+	}
+	for y := int(minY); y <= int(maxY); y++ {
+		for x := int(minX); x <= int(maxX); x++ {
+			px, py := float64(x)+0.5, float64(y)+0.5
+			e1, e2, e3 := edge(a, b, px, py), edge(b, d, px, py), edge(d, a, px, py)
+			if (e1 >= 0 && e2 >= 0 && e3 >= 0) || (e1 <= 0 && e2 <= 0 && e3 <= 0) {
+				c.blend(x, y, col, 1)
+			}
+		}
+	}
+}
+
+// ring draws the annulus between inner and outer radius, colorAt picks the color by
+// the clockwise angle from the top
+func (c *canvas) ring(p svgPoint, inner, outer float64, colorAt func(angle float64) color.RGBA) {
+	for y := int(p.Y - outer - 1); y <= int(p.Y+outer+1); y++ {
+		for x := int(p.X - outer - 1); x <= int(p.X+outer+1); x++ {
+			px, py := float64(x)+0.5-p.X, float64(y)+0.5-p.Y
+			d := math.Hypot(px, py)
+			coverage := math.Min(outer+0.5-d, d-inner+0.5)
+			if coverage <= 0 {
+				continue
+			}
+			angle := math.Atan2(px, -py)
+			if angle < 0 {
+				angle += 2 * math.Pi
+			}
+			c.blend(x, y, colorAt(angle), coverage)
+		}
+	}
+}
+
+// text draws the string centered at x with the 5x7 bitmap font, characters without
+// a glyph are drawn as '?'. The text is cut to maxWidth.
+func (c *canvas) text(s string, x, y float64, maxWidth float64, bold bool, col color.RGBA) {
+	runes := []rune(strings.ToUpper(s))
+	if maxChars := int(maxWidth) / glyphAdvance; len(runes) > maxChars && maxChars > 2 {
+		runes = append(runes[:maxChars-2], '.', '.')
+	}
+	left := int(math.Round(x - float64(len(runes)*glyphAdvance)/2))
+	top := int(math.Round(y - glyphHeight/2))
+	for i, r := range runes {
+		glyph, ok := glyphs[r]
+		if !ok {
+			glyph = glyphs['?']
+		}
+		for row, bits := range glyph {
+			for col5 := 0; col5 < glyphWidth; col5++ {
+				if bits&(1<<(glyphWidth-1-col5)) == 0 {
+					continue
+				}
+				px, py := left+i*glyphAdvance+col5, top+row
+				c.blend(px, py, col, 1)
+				if bold {
+					c.blend(px+1, py, col, 1)
+				}
+			}
+		}
+	}
+}
+
+func ringColors(node *Node) func(angle float64) color.RGBA {
+	fraction := arcFraction(node)
+	if fraction < 0 {
+		return func(float64) color.RGBA { return pngEmptyRing }
+	}
+	positive, err := parseColor(node.ArcPositiveColor)
+	if err != nil {
+		positive = pngEmptyRing
+	}
+	negative, err := parseColor(node.ArcNegativeColor)
+	if err != nil {
+		negative = pngEmptyRing
+	}
+	split := 2 * math.Pi * fraction
+	return func(angle float64) color.RGBA {
+		if angle < split {
+			return positive
+		}
+		return negative
+	}
+}
+
+// RenderNodeGraphPNG rasterizes the node graph with the same layout as RenderNodeGraphSVG
+func RenderNodeGraphPNG(data *QueryNodeGraphData) ([]byte, error) {
+	layout := layoutNodeGraph(data)
+	c := newCanvas(int(layout.Width), int(layout.Height))
+	pos := layout.Pos
+	for _, edge := range data.Edges {
+		from, ok := pos[edge.Source]
+		if !ok {
+			continue
+		}
+		to, ok := pos[edge.Target]
+		if !ok {
+			continue
+		}
+		start := svgPoint{X: from.X, Y: from.Y + svgNodeRadius}
+		end := svgPoint{X: to.X, Y: to.Y - svgNodeRadius}
+		length := math.Hypot(end.X-start.X, end.Y-start.Y)
+		if length == 0 {
+			continue
+		}
+		ux, uy := (end.X-start.X)/length, (end.Y-start.Y)/length
+		const head = 8.0
+		base := svgPoint{X: end.X - ux*head, Y: end.Y - uy*head}
+		c.line(start, base, 1.5, pngEdgeColor)
+		c.triangle(end,
+			svgPoint{X: base.X - uy*head/2, Y: base.Y + ux*head/2},
+			svgPoint{X: base.X + uy*head/2, Y: base.Y - ux*head/2},
+			pngEdgeColor)
+	}
+	labelWidth := float64(svgNodeSpacing - 10)
+	for _, layer := range layout.Layers {
+		for _, node := range layer {
+			p := pos[node.ID]
+			c.ring(p, svgNodeRadius-svgArcWidth, svgNodeRadius, ringColors(node))
+			c.text(node.MainStat, p.X, p.Y, 2*(svgNodeRadius-svgArcWidth), false, pngTextColor)
+			c.text(node.Title, p.X, p.Y+svgNodeRadius+12, labelWidth, true, pngTextColor)
+			c.text(node.SubTitle, p.X, p.Y+svgNodeRadius+26, labelWidth, false, pngMutedColor)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, c.img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+const (
+	glyphWidth   = 5
+	glyphHeight  = 7
+	glyphAdvance = glyphWidth + 1
+)
+
+// glyphs is a 5x7 bitmap font, each row keeps the pixels in the low 5 bits
+var glyphs = map[rune][glyphHeight]uint8{
+	' ':  {},
+	'0':  {0x0E, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0E},
+	'1':  {0x04, 0x0C, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'2':  {0x0E, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1F},
+	'3':  {0x1F, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0E},
+	'4':  {0x02, 0x06, 0x0A, 0x12, 0x1F, 0x02, 0x02},
+	'5':  {0x1F, 0x10, 0x1E, 0x01, 0x01, 0x11, 0x0E},
+	'6':  {0x06, 0x08, 0x10, 0x1E, 0x11, 0x11, 0x0E},
+	'7':  {0x1F, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8':  {0x0E, 0x11, 0x11, 0x0E, 0x11, 0x11, 0x0E},
+	'9':  {0x0E, 0x11, 0x11, 0x0F, 0x01, 0x02, 0x0C},
+	'A':  {0x0E, 0x11, 0x11, 0x11, 0x1F, 0x11, 0x11},
+	'B':  {0x1E, 0x11, 0x11, 0x1E, 0x11, 0x11, 0x1E},
+	'C':  {0x0E, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0E},
+	'D':  {0x1C, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1C},
+	'E':  {0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x1F},
+	'F':  {0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x10},
+	'G':  {0x0E, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0F},
+	'H':  {0x11, 0x11, 0x11, 0x1F, 0x11, 0x11, 0x11},
+	'I':  {0x0E, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'J':  {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0C},
+	'K':  {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L':  {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1F},
+	'M':  {0x11, 0x1B, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N':  {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O':  {0x0E, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0E},
+	'P':  {0x1E, 0x11, 0x11, 0x1E, 0x10, 0x10, 0x10},
+	'Q':  {0x0E, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0D},
+	'R':  {0x1E, 0x11, 0x11, 0x1E, 0x14, 0x12, 0x11},
+	'S':  {0x0F, 0x10, 0x10, 0x0E, 0x01, 0x01, 0x1E},
+	'T':  {0x1F, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U':  {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0E},
+	'V':  {0x11, 0x11, 0x11, 0x11, 0x11, 0x0A, 0x04},
+	'W':  {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0A},
+	'X':  {0x11, 0x11, 0x0A, 0x04, 0x0A, 0x11, 0x11},
+	'Y':  {0x11, 0x11, 0x11, 0x0A, 0x04, 0x04, 0x04},
+	'Z':  {0x1F, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1F},
+	'.':  {0x00, 0x00, 0x00, 0x00, 0x00, 0x0C, 0x0C},
+	',':  {0x00, 0x00, 0x00, 0x00, 0x0C, 0x04, 0x08},
+	'-':  {0x00, 0x00, 0x00, 0x1F, 0x00, 0x00, 0x00},
+	'_':  {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1F},
+	':':  {0x00, 0x0C, 0x0C, 0x00, 0x0C, 0x0C, 0x00},
+	'/':  {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00},
+	'(':  {0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02},
+	')':  {0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08},
+	'%':  {0x18, 0x19, 0x02, 0x04, 0x08, 0x13, 0x03},
+	'<':  {0x02, 0x04, 0x08, 0x10, 0x08, 0x04, 0x02},
+	'>':  {0x08, 0x04, 0x02, 0x01, 0x02, 0x04, 0x08},
+	'+':  {0x00, 0x04, 0x04, 0x1F, 0x04, 0x04, 0x00},
+	'=':  {0x00, 0x00, 0x1F, 0x00, 0x1F, 0x00, 0x00},
+	'#':  {0x0A, 0x0A, 0x1F, 0x0A, 0x1F, 0x0A, 0x0A},
+	'&':  {0x0C, 0x12, 0x14, 0x08, 0x15, 0x12, 0x0D},
+	'\'': {0x0C, 0x04, 0x08, 0x00, 0x00, 0x00, 0x00},
+	'?':  {0x0E, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04},
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/prometheus/common/model"
 )
@@ -11,6 +16,10 @@ import (
 type QueryNodeGraphParam struct {
 	TsRange
 	TiDBClusterID string `json:"tidb_cluster_id"`
+	// Tree is the name of the diagnosis tree, empty means the default one
+	Tree string `json:"tree,omitempty"`
+	// Agg is the roll-up of the similarities in the range, empty means the tree default
+	Agg string `json:"agg,omitempty"`
 }
 
 func (param *QueryNodeGraphParam) GetRollUpParam() (int64, string) {
@@ -28,7 +37,7 @@ func (param *QueryNodeGraphParam) Validate() error {
 	if len(param.TiDBClusterID) == 0 {
 		return errors.New("tidb_cluster_id is zero")
 	}
-	return nil
+	return ValidateRollUp(param.Agg)
 }
 
 type Node struct {
@@ -80,8 +89,14 @@ func (tr *TsRange) GetRollUpParam() (int64, string) {
 
 type QueryAnnotationsParam struct {
 	TsRange
+	TimeFormatParam
 	TiDBClusterID string `json:"tidb_cluster_id"`
 	Measurement   string `json:"measurement"`
+	// Merge and MergeGap override the annotation config when not nil
+	Merge    *bool          `json:"merge,omitempty"`
+	MergeGap *time.Duration `json:"merge_gap,omitempty"`
+	// Filters are all required to match, e.g. severity>=warning and category=disk
+	Filters []*AnnotationFilter `json:"filters,omitempty"`
 }
 
 // GetRollUpParam retunr timestamp in unix and the window size
@@ -100,7 +115,7 @@ func (param *QueryAnnotationsParam) Validate() error {
 	if len(param.TiDBClusterID) == 0 {
 		return errors.New("tidb_cluster_id is zero")
 	}
-	return nil
+	return param.validateTimeFormat()
 }
 
 type Annotation struct {
@@ -113,13 +128,19 @@ type Annotation struct {
 }
 
 type QueryAnnotationItem struct {
+	ID         string      `json:"id,omitempty"`
 	Annotation *Annotation `json:"annotation"`
 	Time       int64       `json:"time"`
 	TimeEnd    int64       `json:"timeEnd,omitempty"`
-	Title      string      `json:"title"`
-	Tags       string      `json:"tags"`
-	Text       string      `json:"text"`
-	PanelID    int64       `json:"panelId"`
+	// TimeText and TimeEndText are rendered with the `tz` and `time_format` params
+	TimeText    string `json:"timeText"`
+	TimeEndText string `json:"timeEndText,omitempty"`
+	Title       string `json:"title"`
+	Tags        string `json:"tags"`
+	Text        string `json:"text"`
+	PanelID     int64  `json:"panelId"`
+	Severity    string `json:"severity,omitempty"`
+	Category    string `json:"category,omitempty"`
 }
 
 func DefaultAnomalyAnnotation() *Annotation {
@@ -135,8 +156,135 @@ func DefaultAnomalyAnnotation() *Annotation {
 
 type QueryAnnotationsData = []QueryAnnotationItem
 
+// backends to store annotations created by the write api
+const (
+	AnnotationBackendInfluxDB = "influxdb"
+	AnnotationBackendVM       = "vm"
+)
+
+// AnnotationParam is the body to create or update an annotation, the times are in milliseconds
+type AnnotationParam struct {
+	ID            string `json:"id,omitempty"`
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Measurement   string `json:"measurement,omitempty"`
+	Time          int64  `json:"time"`
+	TimeEnd       int64  `json:"timeEnd,omitempty"`
+	PanelID       int64  `json:"panelId"`
+	Title         string `json:"title"`
+	Text          string `json:"text"`
+	Tags          string `json:"tags"`
+	Severity      string `json:"severity,omitempty"`
+	Category      string `json:"category,omitempty"`
+	// Revision tells the writes of the same id apart, it is set by each write
+	Revision string `json:"-"`
+}
+
+func (param *AnnotationParam) Validate() error {
+	if len(param.TiDBClusterID) == 0 {
+		return errors.New("tidb_cluster_id is empty")
+	}
+	if param.Time <= 0 {
+		return errors.New("time must be positive")
+	}
+	if param.TimeEnd != 0 && param.TimeEnd < param.Time {
+		return errors.New("timeEnd is before time")
+	}
+	if param.PanelID < 0 {
+		return errors.New("panelId is negative")
+	}
+	if len(param.Title) == 0 {
+		return errors.New("title is empty")
+	}
+	if _, ok := severityRank[param.Severity]; !ok && len(param.Severity) > 0 {
+		return fmt.Errorf("severity %q is unknown", param.Severity)
+	}
+	if len(param.Measurement) == 0 {
+		param.Measurement = "fast_tune_anomaly"
+	}
+	return ValidateAnnotationKey(param.TiDBClusterID, param.Measurement, "")
+}
+
+var (
+	// annotationIDPattern matches the ids made by NewAnnotationID
+	annotationIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+	// clusterIDPattern and measurementPattern keep the values out of the quoting of the
+	// vm selector and the influxdb predicate, the measurement is also a regex prefix
+	clusterIDPattern   = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+	measurementPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	// revisionPattern matches the revisions made by writeAnnotation and the missing one
+	revisionPattern = regexp.MustCompile(`^[0-9a-f]*$`)
+)
+
+// ValidateAnnotationKey checks the values which select an annotation in the vm
+// selector and the influxdb predicate, the empty measurement and id are skipped
+func ValidateAnnotationKey(clusterID string, measurement string, id string) error {
+	var errs ParamErrors
+	if !clusterIDPattern.MatchString(clusterID) {
+		errs = append(errs, &ParamError{Field: "tidb_cluster_id", Message: fmt.Sprintf("%q has characters other than letters, digits and _.:-", clusterID)})
+	}
+	if len(measurement) > 0 && !measurementPattern.MatchString(measurement) {
+		errs = append(errs, &ParamError{Field: "measurement", Message: fmt.Sprintf("%q has characters other than letters, digits and _-", measurement)})
+	}
+	if len(id) > 0 && !annotationIDPattern.MatchString(id) {
+		errs = append(errs, &ParamError{Field: "id", Message: fmt.Sprintf("%q is not an annotation id", id)})
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// GetTags returns the tags read back by QueryAnnotations and QueryAnnotationsV2
+func (param *AnnotationParam) GetTags() map[string]string {
+	tags := map[string]string{
+		"tidb_cluster_id": param.TiDBClusterID,
+		"annotation_id":   param.ID,
+		"panel_id":        strconv.FormatInt(param.PanelID, 10),
+		"title":           param.Title,
+	}
+	for k, v := range map[string]string{"text": param.Text, "tags": param.Tags, "severity": param.Severity, "category": param.Category, "revision": param.Revision} {
+		if len(v) > 0 {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// GetFields returns the end time in seconds, which is the sample value read by QueryAnnotationsV2
+func (param *AnnotationParam) GetFields() map[string]interface{} {
+	return map[string]interface{}{
+		"end_time": float64(param.TimeEnd) / 1e3,
+	}
+}
+
+func (param *AnnotationParam) GetTime() time.Time {
+	return time.Unix(0, param.Time*int64(time.Millisecond))
+}
+
+// newRandomID returns n random bytes in hex
+func newRandomID(n int) (string, error) {
+	bs := make([]byte, n)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bs), nil
+}
+
+// NewAnnotationID returns a random id of the annotation
+func NewAnnotationID() (string, error) {
+	return newRandomID(8)
+}
+
+// ErrAnnotationNotFound is returned when no annotation has the id in the cluster and measurement
+var ErrAnnotationNotFound = errors.New("annotation not found")
+
+type AnnotationData struct {
+	ID string `json:"id"`
+}
+
 type QueryDynamicTextValueParam struct {
 	TsRange
+	TimeFormatParam
 	TiDBClusterID string `json:"tidb_cluster_id"`
 	Measurement   string `json:"measurement"`
 	Default1      string `json:"default_1"`
@@ -152,11 +300,141 @@ func (param *QueryDynamicTextValueParam) Validate() error {
 	if len(param.TiDBClusterID) == 0 {
 		return errors.New("tidb_cluster_id is zero")
 	}
-	return nil
+	return param.validateTimeFormat()
 }
 
 type QueryDynamicTextValueData map[string]interface{}
 
+// value types carried by the `type` label of dynamic text value samples
+const (
+	TextValueTypeFloat    = "float"
+	TextValueTypeInt      = "int"
+	TextValueTypeDuration = "duration_seconds"
+	TextValueTypeUnix     = "unix_seconds"
+	TextValueTypeAddress  = "address"
+)
+
+type TextValueField struct {
+	Type  string  `json:"type"`
+	Value float64 `json:"value"`
+	// Text is the human readable rendering by the formatter of Type
+	Text string `json:"text,omitempty"`
+}
+
+func NewTextValueField(valueType string, value model.SampleValue) *TextValueField {
+	field := &TextValueField{
+		Type:  valueType,
+		Value: float64(value),
+	}
+	switch valueType {
+	case TextValueTypeInt, TextValueTypeUnix:
+		field.Value = float64(int64(value))
+	case "":
+		field.Type = TextValueTypeFloat
+	}
+	return field
+}
+
+type DurationInterval struct {
+	Seconds   int64  `json:"seconds"`
+	StartUnix int64  `json:"startUnix"`
+	EndUnix   int64  `json:"endUnix"`
+	Start     string `json:"start"`
+	End       string `json:"end"`
+}
+
+func NewDurationInterval(startUnix int64, seconds int64, tr *TimeRender) *DurationInterval {
+	endUnix := startUnix + seconds
+	return &DurationInterval{
+		Seconds:   seconds,
+		StartUnix: startUnix,
+		EndUnix:   endUnix,
+		Start:     tr.FormatUnix(startUnix),
+		End:       tr.FormatUnix(endUnix),
+	}
+}
+
+type InstanceValue struct {
+	Address string `json:"address"`
+	Value   int64  `json:"value"`
+}
+
+// TextValueOccurrence groups the fields reported for one duration_seconds sample
+type TextValueOccurrence struct {
+	Index     int                          `json:"index"`
+	Timestamp int64                        `json:"timestamp"`
+	Fields    map[string]*TextValueField   `json:"fields"`
+	Durations map[string]*DurationInterval `json:"durations"`
+	Instances map[string][]*InstanceValue  `json:"instances"`
+}
+
+func NewTextValueOccurrence(index int, timestamp int64) *TextValueOccurrence {
+	return &TextValueOccurrence{
+		Index:     index,
+		Timestamp: timestamp,
+		Fields:    make(map[string]*TextValueField),
+		Durations: make(map[string]*DurationInterval),
+		Instances: make(map[string][]*InstanceValue),
+	}
+}
+
+type QueryDynamicTextValueV3Data struct {
+	Measurement string                     `json:"measurement"`
+	Fields      map[string]*TextValueField `json:"fields"`
+	Occurrences []*TextValueOccurrence     `json:"occurrences"`
+}
+
+func NewQueryDynamicTextValueV3Data(measurement string) *QueryDynamicTextValueV3Data {
+	return &QueryDynamicTextValueV3Data{
+		Measurement: measurement,
+		Fields:      make(map[string]*TextValueField),
+		Occurrences: make([]*TextValueOccurrence, 0),
+	}
+}
+
+// sections of the v3 response a field can appear in
+const (
+	TextValueSectionFields     = "fields"
+	TextValueSectionOccurrence = "occurrences.fields"
+	TextValueSectionDurations  = "occurrences.durations"
+	TextValueSectionInstances  = "occurrences.instances"
+)
+
+type TextValueFieldSchema struct {
+	Name    string `json:"name"`
+	Metric  string `json:"metric"`
+	Type    string `json:"type"`
+	Aggr    string `json:"aggr,omitempty"`
+	Section string `json:"section"`
+}
+
+func NewTextValueFieldSchema(name string, metric string, valueType string, aggr string) *TextValueFieldSchema {
+	fs := &TextValueFieldSchema{
+		Name:    name,
+		Metric:  metric,
+		Type:    valueType,
+		Aggr:    aggr,
+		Section: TextValueSectionOccurrence,
+	}
+	if len(fs.Type) == 0 {
+		fs.Type = TextValueTypeFloat
+	}
+	switch {
+	case aggr == "first":
+		fs.Section = TextValueSectionFields
+	case valueType == TextValueTypeDuration:
+		fs.Section = TextValueSectionDurations
+	case valueType == TextValueTypeAddress:
+		fs.Section = TextValueSectionInstances
+	}
+	return fs
+}
+
+type TextValueSchema struct {
+	Measurement string                  `json:"measurement"`
+	Fields      []*TextValueFieldSchema `json:"fields"`
+}
+
 type InsertSampleParam struct {
 	Timestamp   int64  `json:"timestamp"`
 	Measurement string `json:"measurement"`
@@ -187,6 +465,17 @@ func (param *InsertSampleParam) GetTags() map[string]string {
 // TODO(shenjun): define fields
 type InsertSampleData struct{}
 
+// FlushData counts the points pushed to influxdb by tidb_cluster_id
+type FlushData struct {
+	Points   int                 `json:"points"`
+	Clusters []*ClusterFlushData `json:"clusters"`
+}
+
+type ClusterFlushData struct {
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Points        int    `json:"points"`
+}
+
 // copy from prometheus client golang.
 type MetricsResp struct {
 	Status string              `json:"status"`
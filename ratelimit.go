@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	RateLimitClassRead   = "read"
+	RateLimitClassSample = "sample"
+
+	RateLimitScopeClient  = "client"
+	RateLimitScopeCluster = "cluster"
+)
+
+const defaultClientHeader = "X-Client-ID"
+
+// maxRateLimitKeys bounds the buckets and the throttle counters, the full buckets
+// are dropped when there are more, a full bucket is the same as a missing one.
+// The new keys share the bucket of overflowRateLimitKey when none can be dropped.
+const maxRateLimitKeys = 10000
+
+const overflowRateLimitKey = "*"
+
+// rateLimitSweepInterval keeps the full buckets from being scanned on every new key
+const rateLimitSweepInterval = time.Second
+
+// maxPeekBodySize caps the /sample body read for its tidb_cluster_id
+const maxPeekBodySize = 1 << 20
+
+type tokenBucket struct {
+	cfg    *TokenBucketConfig
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last refill
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.cfg.Burst), b.tokens+elapsed*b.cfg.Rate)
+		b.last = now
+	}
+}
+
+type throttleKey struct {
+	class string
+	scope string
+	key   string
+}
+
+// ThrottleCounter counts the rejected requests of a client or a cluster
+type ThrottleCounter struct {
+	Class     string `json:"class"`
+	Scope     string `json:"scope"`
+	Key       string `json:"key"`
+	Throttled int64  `json:"throttled"`
+}
+
+// RateLimiter keeps a token bucket per client and per tidb_cluster_id for each class of routes
+type RateLimiter struct {
+	clientHeader      string
+	trustClientHeader bool
+	rules             map[string]*RateLimitRule
+	now               func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	throttled map[throttleKey]int64
+}
+
+// NewRateLimiter returns nil when cfg is nil, the nil limiter allows all requests
+func NewRateLimiter(cfg *RateLimitConfig) (*RateLimiter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	l := &RateLimiter{
+		clientHeader:      cfg.ClientHeader,
+		trustClientHeader: cfg.TrustClientHeader,
+		rules:             make(map[string]*RateLimitRule),
+		now:               time.Now,
+		buckets:           make(map[string]*tokenBucket),
+		throttled:         make(map[throttleKey]int64),
+	}
+	if len(l.clientHeader) == 0 {
+		l.clientHeader = defaultClientHeader
+	}
+	for class, rule := range map[string]*RateLimitRule{RateLimitClassRead: cfg.Read, RateLimitClassSample: cfg.Sample} {
+		if rule == nil {
+			continue
+		}
+		buckets := []*TokenBucketConfig{rule.PerClient, rule.PerCluster}
+		for _, quota := range rule.Quotas {
+			buckets = append(buckets, quota)
+		}
+		for _, bucket := range buckets {
+			if bucket == nil {
+				continue
+			}
+			if bucket.Rate <= 0 {
+				return nil, fmt.Errorf("rate limit of %s: rate %v is not positive", class, bucket.Rate)
+			}
+			if bucket.Burst < 0 {
+				return nil, fmt.Errorf("rate limit of %s: burst %v is negative", class, bucket.Burst)
+			}
+			if bucket.Burst == 0 {
+				bucket.Burst = int(math.Ceil(bucket.Rate))
+			}
+		}
+		l.rules[class] = rule
+	}
+	return l, nil
+}
+
+// Allow takes a token from the client bucket and the cluster bucket of the class,
+// no token is taken when either is empty. scope and retryAfter tell the bucket
+// rejecting the request and how long until it has a token.
+func (l *RateLimiter) Allow(class, client, cluster string) (ok bool, scope string, retryAfter time.Duration) {
+	if l == nil {
+		return true, "", 0
+	}
+	rule, ok := l.rules[class]
+	if !ok {
+		return true, "", 0
+	}
+	type scoped struct {
+		scope  string
+		key    string
+		bucket *tokenBucket
+	}
+	candidates := make([]scoped, 0, 2)
+	if rule.PerClient != nil {
+		candidates = append(candidates, scoped{scope: RateLimitScopeClient, key: client})
+	}
+	clusterCfg := rule.PerCluster
+	if quota, ok := rule.Quotas[cluster]; ok {
+		clusterCfg = quota
+	}
+	if clusterCfg != nil && len(cluster) > 0 {
+		candidates = append(candidates, scoped{scope: RateLimitScopeCluster, key: cluster})
+	}
+
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range candidates {
+		c := &candidates[i]
+		cfg := rule.PerClient
+		if c.scope == RateLimitScopeCluster {
+			cfg = clusterCfg
+		}
+		c.bucket, c.key = l.bucket(class, c.scope, c.key, cfg, now)
+		if c.bucket.tokens < 1 {
+			l.countThrottled(throttleKey{class: class, scope: c.scope, key: c.key})
+			wait := (1 - c.bucket.tokens) / c.bucket.cfg.Rate
+			return false, c.scope, time.Duration(wait * float64(time.Second))
+		}
+	}
+	for _, c := range candidates {
+		c.bucket.tokens--
+	}
+	return true, "", 0
+}
+
+// bucket returns the refilled bucket of the key and the key it is counted by, the
+// new bucket is full. The key shares the overflow bucket of the scope when there
+// are maxRateLimitKeys buckets and none of them is full.
+func (l *RateLimiter) bucket(class, scope, key string, cfg *TokenBucketConfig, now time.Time) (*tokenBucket, string) {
+	prefix := class + "/" + scope + "/"
+	b, ok := l.buckets[prefix+key]
+	if ok && b.cfg == cfg {
+		b.refill(now)
+		return b, key
+	}
+	if !ok && len(l.buckets) >= maxRateLimitKeys && now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.lastSweep = now
+		for k, b := range l.buckets {
+			b.refill(now)
+			if b.tokens >= float64(b.cfg.Burst) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	if !ok && len(l.buckets) >= maxRateLimitKeys {
+		key = overflowRateLimitKey
+		if b, ok := l.buckets[prefix+key]; ok && b.cfg == cfg {
+			b.refill(now)
+			return b, key
+		}
+	}
+	b = &tokenBucket{cfg: cfg, tokens: float64(cfg.Burst), last: now}
+	l.buckets[prefix+key] = b
+	return b, key
+}
+
+func (l *RateLimiter) countThrottled(key throttleKey) {
+	if _, ok := l.throttled[key]; !ok && len(l.throttled) >= maxRateLimitKeys {
+		key.key = overflowRateLimitKey
+	}
+	l.throttled[key]++
+}
+
+// Throttled returns the counters of the rejected requests
+func (l *RateLimiter) Throttled() []*ThrottleCounter {
+	counters := make([]*ThrottleCounter, 0)
+	if l == nil {
+		return counters
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, n := range l.throttled {
+		counters = append(counters, &ThrottleCounter{Class: key.class, Scope: key.scope, Key: key.key, Throttled: n})
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].Class != counters[j].Class {
+			return counters[i].Class < counters[j].Class
+		}
+		if counters[i].Scope != counters[j].Scope {
+			return counters[i].Scope < counters[j].Scope
+		}
+		return counters[i].Key < counters[j].Key
+	})
+	return counters
+}
+
+// rateLimitClass returns the class of the request, the debug routes, the spec and
+// the annotation and session writes are not limited
+func rateLimitClass(req *http.Request) string {
+	switch {
+	case req.Method == http.MethodPost && (req.URL.Path == "/sample" || req.URL.Path == "/sample/v2"):
+		return RateLimitClassSample
+	case req.Method == http.MethodGet && !strings.HasPrefix(req.URL.Path, "/debug/") && req.URL.Path != "/openapi.json":
+		return RateLimitClassRead
+	}
+	return ""
+}
+
+// clientID returns the remote ip, or the client header when it is trusted
+func (l *RateLimiter) clientID(req *http.Request) string {
+	if l.trustClientHeader {
+		if id := req.Header.Get(l.clientHeader); len(id) > 0 {
+			return id
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// peekClusterID reads the tidb_cluster_id of the json body and leaves the body intact
+func peekClusterID(req *http.Request) string {
+	if req.Body == nil {
+		return ""
+	}
+	bs, err := io.ReadAll(io.LimitReader(req.Body, maxPeekBodySize))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(bs), req.Body), req.Body}
+	if err != nil {
+		return ""
+	}
+	v := struct {
+		TiDBClusterID string `json:"tidb_cluster_id"`
+	}{}
+	_ = json.Unmarshal(bs, &v)
+	return v.TiDBClusterID
+}
+
+// Middleware responds 429 to the requests exceeding the limits
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		class := rateLimitClass(req)
+		if len(class) == 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+		client := l.clientID(req)
+		cluster := req.URL.Query().Get("tidb_cluster_id")
+		if class == RateLimitClassSample {
+			cluster = peekClusterID(req)
+		}
+		ok, scope, retryAfter := l.Allow(class, client, cluster)
+		if !ok {
+			Logger(req.Context()).Warn("request throttled",
+				zap.String("class", class), zap.String("scope", scope),
+				zap.String("client", client), zap.String("tidb_cluster_id", cluster))
+			ResponseWithTooManyRequests(w, retryAfter, fmt.Sprintf("%s rate limit of the %s is exceeded", class, scope))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
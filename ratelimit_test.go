@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	assert := require.New(t)
+	l, err := NewRateLimiter(&RateLimitConfig{
+		Read: &RateLimitRule{
+			PerClient:  &TokenBucketConfig{Rate: 1, Burst: 2},
+			PerCluster: &TokenBucketConfig{Rate: 1, Burst: 3},
+			Quotas:     map[string]*TokenBucketConfig{"big": {Rate: 100}},
+		},
+	})
+	assert.Nil(err)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		ok, _, _ := l.Allow(RateLimitClassRead, "a", "c1")
+		assert.True(ok)
+	}
+	ok, scope, retryAfter := l.Allow(RateLimitClassRead, "a", "c1")
+	assert.False(ok)
+	assert.Equal(RateLimitScopeClient, scope)
+	assert.Equal(time.Second, retryAfter)
+	now = now.Add(500 * time.Millisecond)
+	_, _, retryAfter = l.Allow(RateLimitClassRead, "a", "c1")
+	assert.Equal(500*time.Millisecond, retryAfter)
+
+	// the cluster bucket has 1.5 tokens after the two requests of a and the refill
+	ok, _, _ = l.Allow(RateLimitClassRead, "b", "c1")
+	assert.True(ok)
+	ok, scope, _ = l.Allow(RateLimitClassRead, "b", "c1")
+	assert.False(ok)
+	assert.Equal(RateLimitScopeCluster, scope)
+	// the request rejected by the cluster bucket does not take the token of the client
+	ok, _, _ = l.Allow(RateLimitClassRead, "b", "c2")
+	assert.True(ok)
+
+	// the quota replaces the per cluster bucket, the burst defaults to the rate
+	for i := 0; i < 5; i++ {
+		ok, _, _ = l.Allow(RateLimitClassRead, string(rune('c'+i)), "big")
+		assert.True(ok)
+	}
+	// the requests without a cluster are only limited by the client
+	ok, _, _ = l.Allow(RateLimitClassRead, "x", "")
+	assert.True(ok)
+	// the class without a rule is not limited
+	ok, _, _ = l.Allow(RateLimitClassSample, "a", "c1")
+	assert.True(ok)
+
+	assert.Equal([]*ThrottleCounter{
+		{Class: RateLimitClassRead, Scope: RateLimitScopeClient, Key: "a", Throttled: 2},
+		{Class: RateLimitClassRead, Scope: RateLimitScopeCluster, Key: "c1", Throttled: 1},
+	}, l.Throttled())
+
+	var nilLimiter *RateLimiter
+	ok, _, _ = nilLimiter.Allow(RateLimitClassRead, "a", "c1")
+	assert.True(ok)
+	assert.Len(nilLimiter.Throttled(), 0)
+
+	_, err = NewRateLimiter(&RateLimitConfig{Sample: &RateLimitRule{PerClient: &TokenBucketConfig{}}})
+	assert.NotNil(err)
+	_, err = NewRateLimiter(&RateLimitConfig{Sample: &RateLimitRule{Quotas: map[string]*TokenBucketConfig{"c1": {Rate: 1, Burst: -1}}}})
+	assert.NotNil(err)
+}
+
+func TestRateLimiter_Middleware(t *testing.T) {
+	assert := require.New(t)
+	l, err := NewRateLimiter(&RateLimitConfig{
+		TrustClientHeader: true,
+		Read:              &RateLimitRule{PerClient: &TokenBucketConfig{Rate: 1}},
+		Sample:            &RateLimitRule{PerCluster: &TokenBucketConfig{Rate: 0.5}},
+	})
+	assert.Nil(err)
+	var body string
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		bs, _ := io.ReadAll(req.Body)
+		body = string(bs)
+		ResponseWithJSON(w, struct{}{})
+	}))
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	newRead := func(client string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/node_graph/v2?tidb_cluster_id=c1", nil)
+		req.Header.Set(defaultClientHeader, client)
+		return req
+	}
+	assert.Equal(http.StatusOK, serve(newRead("a")).Code)
+	w := serve(newRead("a"))
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.Equal("1", w.Header().Get("Retry-After"))
+	assert.Contains(w.Body.String(), "read rate limit of the client")
+	assert.Equal(http.StatusOK, serve(newRead("b")).Code)
+	// the debug routes are not limited
+	for i := 0; i < 3; i++ {
+		assert.Equal(http.StatusOK, serve(httptest.NewRequest(http.MethodGet, "/debug/inflight", nil)).Code)
+	}
+
+	// the cluster of the sample is read from the body, which is still readable by the handler
+	sample := `{"tidb_cluster_id":"c1","measurement":"m","timestamp":1}`
+	assert.Equal(http.StatusOK, serve(httptest.NewRequest(http.MethodPost, "/sample", strings.NewReader(sample))).Code)
+	assert.Equal(sample, body)
+	w = serve(httptest.NewRequest(http.MethodPost, "/sample/v2", strings.NewReader(sample)))
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.Equal("2", w.Header().Get("Retry-After"))
+	assert.Equal(http.StatusOK, serve(httptest.NewRequest(http.MethodPost, "/sample", strings.NewReader(`{"tidb_cluster_id":"c2"}`))).Code)
+
+	// the client header is ignored unless it is trusted
+	l.trustClientHeader = false
+	assert.Equal(http.StatusOK, serve(newRead("c")).Code)
+	assert.Equal(http.StatusTooManyRequests, serve(newRead("d")).Code)
+}
+
+func TestRateLimiter_MaxKeys(t *testing.T) {
+	assert := require.New(t)
+	l, err := NewRateLimiter(&RateLimitConfig{Read: &RateLimitRule{PerClient: &TokenBucketConfig{Rate: 1, Burst: 2}}})
+	assert.Nil(err)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+	for i := 0; i < maxRateLimitKeys; i++ {
+		ok, _, _ := l.Allow(RateLimitClassRead, fmt.Sprintf("c%d", i), "")
+		assert.True(ok)
+	}
+
+	// no bucket is full, the new clients share the overflow bucket
+	for i := 0; i < 2; i++ {
+		ok, _, _ := l.Allow(RateLimitClassRead, fmt.Sprintf("new%d", i), "")
+		assert.True(ok)
+	}
+	ok, scope, _ := l.Allow(RateLimitClassRead, "new2", "")
+	assert.False(ok)
+	assert.Equal(RateLimitScopeClient, scope)
+	assert.Len(l.buckets, maxRateLimitKeys+1)
+	assert.Equal([]*ThrottleCounter{
+		{Class: RateLimitClassRead, Scope: RateLimitScopeClient, Key: overflowRateLimitKey, Throttled: 1},
+	}, l.Throttled())
+	// the known clients keep their own buckets
+	ok, _, _ = l.Allow(RateLimitClassRead, "c0", "")
+	assert.True(ok)
+
+	// the refilled buckets are dropped for the new clients
+	now = now.Add(2 * time.Second)
+	ok, _, _ = l.Allow(RateLimitClassRead, "new3", "")
+	assert.True(ok)
+	assert.Len(l.buckets, 1)
+}
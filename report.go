@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+)
+
+// report formats and their content types
+const (
+	ReportFormatMarkdown = "markdown"
+	ReportFormatHTML     = "html"
+)
+
+var reportContentTypes = map[string]string{
+	ReportFormatMarkdown: "text/markdown; charset=utf-8",
+	ReportFormatHTML:     "text/html; charset=utf-8",
+}
+
+//go:embed templates/report.md.tmpl templates/report.html.tmpl
+var defaultReportTemplates embed.FS
+
+type ReportParam struct {
+	TsRange
+	TimeFormatParam
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Tree          string `json:"tree,omitempty"`
+	// Format is markdown or html, default is markdown
+	Format string `json:"format,omitempty"`
+}
+
+func (param *ReportParam) Validate() error {
+	if param.StartTS == 0 {
+		return errors.New("start_ts is zero")
+	}
+	if param.EndTS == 0 {
+		return errors.New("end_ts is zero")
+	}
+	if len(param.TiDBClusterID) == 0 {
+		return errors.New("tidb_cluster_id is zero")
+	}
+	if len(param.Format) == 0 {
+		param.Format = ReportFormatMarkdown
+	}
+	if _, ok := reportContentTypes[param.Format]; !ok {
+		return fmt.Errorf("format %q is not supported", param.Format)
+	}
+	return param.validateTimeFormat()
+}
+
+// ReportStep is a node of the diagnosis path
+type ReportStep struct {
+	Rank       int     `json:"rank"`
+	ID         string  `json:"id"`
+	Title      string  `json:"title"`
+	Similarity float64 `json:"similarity"`
+}
+
+// ReportData is everything a report template can refer to
+type ReportData struct {
+	TiDBClusterID string                       `json:"tidb_cluster_id"`
+	Tree          string                       `json:"tree"`
+	Start         string                       `json:"start"`
+	End           string                       `json:"end"`
+	GeneratedAt   string                       `json:"generated_at"`
+	Path          []*ReportStep                `json:"path"`
+	Timeline      QueryAnnotationsData         `json:"timeline"`
+	Overview      *QueryDynamicTextValueV3Data `json:"overview"`
+	NodeGraph     *QueryNodeGraphData          `json:"node_graph"`
+	NodeGraphSVG  string                       `json:"-"`
+}
+
+// RankDiagnosisPath walks from the most similar root down to the leaf, taking the
+// most similar child at each step, which is the most likely root cause path.
+func RankDiagnosisPath(data *QueryNodeGraphData) []*ReportStep {
+	nodesLookup := make(map[string]*Node)
+	for _, node := range data.Nodes {
+		nodesLookup[node.ID] = node
+	}
+	children := make(map[string][]*Node)
+	hasParent := make(map[string]bool)
+	for _, edge := range data.Edges {
+		target, ok := nodesLookup[edge.Target]
+		if !ok {
+			continue
+		}
+		if _, ok := nodesLookup[edge.Source]; !ok {
+			continue
+		}
+		children[edge.Source] = append(children[edge.Source], target)
+		hasParent[edge.Target] = true
+	}
+	roots := make([]*Node, 0)
+	for _, node := range data.Nodes {
+		if !hasParent[node.ID] {
+			roots = append(roots, node)
+		}
+	}
+
+	mostSimilar := func(nodes []*Node) *Node {
+		if len(nodes) == 0 {
+			return nil
+		}
+		sorted := make([]*Node, len(nodes))
+		copy(sorted, nodes)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			if sorted[i].ArcPositive != sorted[j].ArcPositive {
+				return sorted[i].ArcPositive > sorted[j].ArcPositive
+			}
+			return sorted[i].ID < sorted[j].ID
+		})
+		return sorted[0]
+	}
+
+	path := make([]*ReportStep, 0)
+	visited := make(map[string]bool)
+	for node := mostSimilar(roots); node != nil && !visited[node.ID]; node = mostSimilar(children[node.ID]) {
+		visited[node.ID] = true
+		path = append(path, &ReportStep{
+			Rank:       len(path) + 1,
+			ID:         node.ID,
+			Title:      node.SubTitle,
+			Similarity: node.ArcPositive,
+		})
+	}
+	return path
+}
+
+// ReportRenderer renders the report data with the markdown or html template
+type ReportRenderer struct {
+	markdown *texttemplate.Template
+	html     *htmltemplate.Template
+}
+
+// NewReportRenderer parses the templates in config, the embedded ones are used when not set
+func NewReportRenderer(cfg *ReportConfig) (*ReportRenderer, error) {
+	if cfg == nil {
+		cfg = &ReportConfig{}
+	}
+	mdText, err := readReportTemplate(cfg.MarkdownTemplate, "templates/report.md.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	htmlText, err := readReportTemplate(cfg.HTMLTemplate, "templates/report.html.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReportRenderer{}
+	r.markdown, err = texttemplate.New("markdown").Funcs(texttemplate.FuncMap{
+		"svgDataURI": svgDataURI,
+		"mdCell":     markdownCell,
+	}).Parse(mdText)
+	if err != nil {
+		return nil, fmt.Errorf("parse markdown template failed: %v", err)
+	}
+	r.html, err = htmltemplate.New("html").Funcs(htmltemplate.FuncMap{
+		"svgDataURI": func(svg string) htmltemplate.URL {
+			return htmltemplate.URL(svgDataURI(svg))
+		},
+		// the svg is generated by RenderNodeGraphSVG with all text escaped
+		"safeSVG": func(svg string) htmltemplate.HTML {
+			return htmltemplate.HTML(svg)
+		},
+	}).Parse(htmlText)
+	if err != nil {
+		return nil, fmt.Errorf("parse html template failed: %v", err)
+	}
+	return r, nil
+}
+
+// markdownCell escapes the pipes and the line breaks which would end the table cell
+func markdownCell(s string) string {
+	return markdownCellReplacer.Replace(s)
+}
+
+var markdownCellReplacer = strings.NewReplacer("|", `\|`, "\r\n", "<br>", "\n", "<br>", "\r", "<br>")
+
+func readReportTemplate(path string, embedded string) (string, error) {
+	if len(path) == 0 {
+		bs, err := defaultReportTemplates.ReadFile(embedded)
+		return string(bs), err
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
+// Render returns the rendered document and its content type
+func (r *ReportRenderer) Render(format string, data *ReportData) ([]byte, string, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case ReportFormatHTML:
+		err = r.html.Execute(&buf, data)
+	case ReportFormatMarkdown:
+		err = r.markdown.Execute(&buf, data)
+	default:
+		err = fmt.Errorf("format %q is not supported", format)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), reportContentTypes[format], nil
+}
+
+func svgDataURI(svg string) string {
+	return "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(svg))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testNodeGraph() *QueryNodeGraphData {
+	tree := builtinTrees()[DefaultTreeName]
+	data := &QueryNodeGraphData{}
+	for id, similarity := range map[string]float64{"8637": 0.9, "11271": 0.8, "9875": 0.6, "9254": 0.7, "11272": 0.95} {
+		node := DefaultNode()
+		node.ID = id
+		node.Title = id
+		node.SubTitle = "title <" + id + ">"
+		node.MainStat = "stat"
+		node.ArcPositive = similarity
+		node.ArcNegative = 1 - similarity
+		data.Nodes = append(data.Nodes, node)
+	}
+	data.Edges = tree.Link(data.Nodes)
+	return data
+}
+
+func TestRankDiagnosisPath(t *testing.T) {
+	assert := require.New(t)
+	path := RankDiagnosisPath(testNodeGraph())
+	ids := make([]string, 0, len(path))
+	for _, step := range path {
+		ids = append(ids, step.ID)
+	}
+	assert.Equal([]string{"8637", "11271", "9875"}, ids)
+	assert.Equal(3, path[2].Rank)
+	assert.Len(RankDiagnosisPath(&QueryNodeGraphData{}), 0)
+}
+
+func TestReportRenderer_Render(t *testing.T) {
+	assert := require.New(t)
+	r, err := NewReportRenderer(nil)
+	assert.Nil(err)
+	graph := testNodeGraph()
+	overview := NewQueryDynamicTextValueV3Data("diagnosis_overview")
+	overview.Fields["qps"] = &TextValueField{Type: FormatKindRate, Value: 12, Text: "12.00/s"}
+	occurrence := NewTextValueOccurrence(1, 1640995200)
+	occurrence.Fields["max_latency"] = &TextValueField{Type: TextValueTypeFloat, Value: 2.5}
+	occurrence.Durations["stall"] = &DurationInterval{Seconds: 60, Start: "00:00:00", End: "00:01:00"}
+	occurrence.Instances["busy_tikv"] = []*InstanceValue{{Address: "tikv-0", Value: 3}, {Address: "tikv-1", Value: 1}}
+	overview.Occurrences = append(overview.Occurrences, occurrence)
+	timeline := QueryAnnotationsData{
+		{Title: "write stall", TimeText: "2022-01-01T00:00:00Z", Severity: SeverityCritical},
+		{Title: "a | b", Text: "line1\nline2", TimeText: "2022-01-01T00:10:00Z", Severity: SeverityCritical},
+	}
+	data := &ReportData{
+		TiDBClusterID: "clinic",
+		Tree:          DefaultTreeName,
+		Path:          RankDiagnosisPath(graph),
+		Timeline:      timeline,
+		Overview:      overview,
+		NodeGraph:     graph,
+		NodeGraphSVG:  string(RenderNodeGraphSVG(graph)),
+	}
+
+	doc, contentType, err := r.Render(ReportFormatMarkdown, data)
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(contentType, "text/markdown"))
+	assert.Contains(string(doc), "| 1 | 8637 | title <8637> | 0.900 |")
+	assert.Contains(string(doc), "data:image/svg+xml;base64,")
+	assert.Contains(string(doc), "| 2022-01-01T00:00:00Z |  | critical | write stall |")
+	assert.Contains(string(doc), "- **qps**: 12.00/s")
+	// the pipes and the line breaks do not break the table
+	assert.Contains(string(doc), "| 2022-01-01T00:10:00Z |  | critical | a \\| b | line1<br>line2 |\n")
+	assert.Contains(string(doc), "### Occurrence 1")
+	assert.Contains(string(doc), "| max_latency | 2.5 |")
+	assert.Contains(string(doc), "| stall | 00:00:00 ~ 00:01:00 (60s) |")
+	assert.Contains(string(doc), "| busy_tikv | tikv-0: 3, tikv-1: 1 |")
+
+	doc, contentType, err = r.Render(ReportFormatHTML, data)
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(contentType, "text/html"))
+	assert.Contains(string(doc), "<svg xmlns")
+	// node titles are escaped inside the svg as well as in the tables
+	assert.Contains(string(doc), "title &lt;8637&gt;")
+	assert.NotContains(string(doc), "title <8637>")
+	assert.Contains(string(doc), "<h3>Occurrence 1</h3>")
+	assert.Contains(string(doc), "<tr><td>busy_tikv</td><td>tikv-0: 3, tikv-1: 1</td></tr>")
+
+	// the occurrences alone fill the overview
+	delete(overview.Fields, "qps")
+	doc, _, err = r.Render(ReportFormatMarkdown, data)
+	assert.Nil(err)
+	assert.NotContains(string(doc), "No overview value")
+
+	_, _, err = r.Render("pdf", data)
+	assert.NotNil(err)
+}
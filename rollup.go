@@ -0,0 +1,54 @@
+package main
+
+import "fmt"
+
+// roll-up aggregations of the similarity samples in the query window
+const (
+	RollUpFirst = "first"
+	RollUpLast  = "last"
+	RollUpMax   = "max"
+	RollUpAvg   = "avg"
+	RollUpP95   = "p95"
+	// DefaultRollUp keeps the behaviour before the aggregation is configurable
+	DefaultRollUp = RollUpFirst
+)
+
+// rollUpFlux and rollUpPromQL translate the aggregation to the flux pipeline and the
+// promql range function
+var (
+	rollUpFlux = map[string]string{
+		RollUpFirst: `first()`,
+		RollUpLast:  `last()`,
+		RollUpMax:   `max()`,
+		RollUpAvg:   `mean()`,
+		RollUpP95:   `quantile(q: 0.95, method: "estimate_tdigest")`,
+	}
+	rollUpPromQL = map[string]string{
+		RollUpFirst: `first_over_time(%s[%s])`,
+		RollUpLast:  `last_over_time(%s[%s])`,
+		RollUpMax:   `max_over_time(%s[%s])`,
+		RollUpAvg:   `avg_over_time(%s[%s])`,
+		RollUpP95:   `quantile_over_time(0.95, %s[%s])`,
+	}
+)
+
+// ValidateRollUp returns error when the aggregation is not supported, empty is allowed
+func ValidateRollUp(agg string) error {
+	if len(agg) == 0 {
+		return nil
+	}
+	if _, ok := rollUpFlux[agg]; !ok {
+		return fmt.Errorf("agg %q is not supported", agg)
+	}
+	return nil
+}
+
+// RollUpFlux returns the flux function aggregating each table
+func RollUpFlux(agg string) string {
+	return rollUpFlux[agg]
+}
+
+// RollUpPromQL wraps the selector with the range function over the window
+func RollUpPromQL(agg string, selector string, window string) string {
+	return fmt.Sprintf(rollUpPromQL[agg], selector, window)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	FieldTypeFloat  = "float"
+	FieldTypeInt    = "int"
+	FieldTypeBool   = "bool"
+	FieldTypeString = "string"
+)
+
+// maxSuggestDistance is the max edit distance of a name to be suggested for a misspelled one
+const maxSuggestDistance = 2
+
+type FieldSchema struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+}
+
+type MeasurementSchema struct {
+	Name         string         `json:"name"`
+	Description  string         `json:"description,omitempty"`
+	RequiredTags []string       `json:"required_tags"`
+	Fields       []*FieldSchema `json:"fields"`
+
+	fields map[string]*FieldSchema
+}
+
+type SchemasData struct {
+	AllowUnknown bool                 `json:"allow_unknown"`
+	Measurements []*MeasurementSchema `json:"measurements"`
+}
+
+// SchemaRegistry validates the samples against the declared measurements, the
+// empty registry accepts all samples
+type SchemaRegistry struct {
+	allowUnknown bool
+	measurements map[string]*MeasurementSchema
+	names        []string
+}
+
+// NewSchemaRegistry builds the registry declared in config, nil cfg is an empty registry
+func NewSchemaRegistry(cfg *SchemaConfig) (*SchemaRegistry, error) {
+	r := &SchemaRegistry{
+		measurements: make(map[string]*MeasurementSchema),
+		names:        make([]string, 0),
+	}
+	if cfg == nil {
+		return r, nil
+	}
+	r.allowUnknown = cfg.AllowUnknown
+	for _, mc := range cfg.Measurements {
+		if len(mc.Name) == 0 {
+			return nil, fmt.Errorf("measurement name is empty")
+		}
+		if _, ok := r.measurements[mc.Name]; ok {
+			return nil, fmt.Errorf("measurement %q is declared twice", mc.Name)
+		}
+		m := &MeasurementSchema{
+			Name:         mc.Name,
+			Description:  mc.Description,
+			RequiredTags: append([]string{}, mc.RequiredTags...),
+			Fields:       make([]*FieldSchema, 0, len(mc.Fields)),
+			fields:       make(map[string]*FieldSchema),
+		}
+		for _, fc := range mc.Fields {
+			f, err := newFieldSchema(fc)
+			if err != nil {
+				return nil, fmt.Errorf("measurement %q: %w", mc.Name, err)
+			}
+			if _, ok := m.fields[f.Name]; ok {
+				return nil, fmt.Errorf("measurement %q: field %q is declared twice", mc.Name, f.Name)
+			}
+			m.fields[f.Name] = f
+			m.Fields = append(m.Fields, f)
+		}
+		r.measurements[m.Name] = m
+		r.names = append(r.names, m.Name)
+	}
+	sort.Strings(r.names)
+	return r, nil
+}
+
+func newFieldSchema(cfg *FieldSchemaConfig) (*FieldSchema, error) {
+	if len(cfg.Name) == 0 {
+		return nil, fmt.Errorf("field name is empty")
+	}
+	f := &FieldSchema{Name: cfg.Name, Type: cfg.Type, Required: cfg.Required, Min: cfg.Min, Max: cfg.Max}
+	switch f.Type {
+	case "":
+		f.Type = FieldTypeFloat
+	case FieldTypeFloat, FieldTypeInt:
+	case FieldTypeBool, FieldTypeString:
+		if f.Min != nil || f.Max != nil {
+			return nil, fmt.Errorf("field %q of type %s can not have min or max", f.Name, f.Type)
+		}
+	default:
+		return nil, fmt.Errorf("field %q: type %q is not one of float, int, bool and string", f.Name, f.Type)
+	}
+	if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+		return nil, fmt.Errorf("field %q: min %v is greater than max %v", f.Name, *f.Min, *f.Max)
+	}
+	return f, nil
+}
+
+// Schemas returns the declared measurements by name
+func (r *SchemaRegistry) Schemas() *SchemasData {
+	data := &SchemasData{AllowUnknown: r.allowUnknown, Measurements: make([]*MeasurementSchema, 0, len(r.names))}
+	for _, name := range r.names {
+		data.Measurements = append(data.Measurements, r.measurements[name])
+	}
+	return data
+}
+
+// Validate checks the sample against the schema of its measurement and converts
+// the int fields to int64. Every problem is returned in ParamErrors, the misspelled
+// names come with the closest declared ones.
+func (r *SchemaRegistry) Validate(param *InsertSampleParam) error {
+	if len(r.measurements) == 0 {
+		return nil
+	}
+	m, ok := r.measurements[param.Measurement]
+	if !ok {
+		if r.allowUnknown {
+			return nil
+		}
+		msg := fmt.Sprintf("measurement %q is not declared", param.Measurement)
+		if s := suggest(param.Measurement, r.names); len(s) > 0 {
+			msg += fmt.Sprintf(", did you mean %q?", s)
+		}
+		return ParamErrors{{Field: "measurement", Message: msg}}
+	}
+
+	var errs ParamErrors
+	tags := make([]string, 0, len(param.Tags))
+	for tag := range param.Tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for _, tag := range m.RequiredTags {
+		if len(param.Tags[tag]) > 0 {
+			continue
+		}
+		msg := fmt.Sprintf("tag %q is required by %s", tag, m.Name)
+		if s := suggest(tag, tags); len(s) > 0 {
+			msg += fmt.Sprintf(", got %q", s)
+		}
+		errs = append(errs, &ParamError{Field: "tags." + tag, Message: msg})
+	}
+	fieldNames := make([]string, 0, len(m.Fields))
+	for _, f := range m.Fields {
+		fieldNames = append(fieldNames, f.Name)
+	}
+	names := make([]string, 0, len(param.Fields))
+	for name := range param.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f, ok := m.fields[name]
+		if !ok {
+			msg := fmt.Sprintf("field %q is not declared by %s", name, m.Name)
+			if s := suggest(name, fieldNames); len(s) > 0 {
+				msg += fmt.Sprintf(", did you mean %q?", s)
+			}
+			errs = append(errs, &ParamError{Field: "fields." + name, Message: msg})
+			continue
+		}
+		v, err := f.check(param.Fields[name])
+		if err != nil {
+			errs = append(errs, &ParamError{Field: "fields." + name, Message: err.Error()})
+			continue
+		}
+		param.Fields[name] = v
+	}
+	for _, f := range m.Fields {
+		if _, ok := param.Fields[f.Name]; f.Required && !ok {
+			errs = append(errs, &ParamError{Field: "fields." + f.Name, Message: fmt.Sprintf("field %q is required by %s", f.Name, m.Name)})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// check returns the value converted to the field type
+func (f *FieldSchema) check(value interface{}) (interface{}, error) {
+	switch f.Type {
+	case FieldTypeBool:
+		if _, ok := value.(bool); !ok {
+			return nil, fmt.Errorf("%v is not a bool", value)
+		}
+		return value, nil
+	case FieldTypeString:
+		if _, ok := value.(string); !ok {
+			return nil, fmt.Errorf("%v is not a string", value)
+		}
+		return value, nil
+	}
+	var v float64
+	switch n := value.(type) {
+	case float64:
+		v = n
+	case int:
+		v = float64(n)
+	case int64:
+		v = float64(n)
+	default:
+		return nil, fmt.Errorf("%v is not a number", value)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("%v is not a finite number", v)
+	}
+	if (f.Min != nil && v < *f.Min) || (f.Max != nil && v > *f.Max) {
+		return nil, fmt.Errorf("%v is out of range %s", v, f.rangeString())
+	}
+	if f.Type == FieldTypeInt {
+		if v != math.Trunc(v) {
+			return nil, fmt.Errorf("%v is not an int", v)
+		}
+		return int64(v), nil
+	}
+	return v, nil
+}
+
+func (f *FieldSchema) rangeString() string {
+	min, max := "-inf", "+inf"
+	if f.Min != nil {
+		min = strconv.FormatFloat(*f.Min, 'g', -1, 64)
+	}
+	if f.Max != nil {
+		max = strconv.FormatFloat(*f.Max, 'g', -1, 64)
+	}
+	return fmt.Sprintf("[%s, %s]", min, max)
+}
+
+// suggest returns the closest candidate within maxSuggestDistance edits, empty when none
+func suggest(name string, candidates []string) string {
+	best, bestDist := "", maxSuggestDistance+1
+	for _, c := range candidates {
+		if c == name {
+			continue
+		}
+		if d := editDistance(name, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// editDistance is the levenshtein distance of a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Schemas lists the measurements accepted by /sample and /sample/v2
+func (ep *ReportEndpoint) Schemas(api *ReportAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ResponseWithJSON(w, api.Schemas())
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSchemaRegistry(t *testing.T) *SchemaRegistry {
+	zero, one := 0.0, 1.0
+	registry, err := NewSchemaRegistry(&SchemaConfig{
+		Measurements: []*MeasurementSchemaConfig{
+			{
+				Name:         "fast_tune_anomaly",
+				RequiredTags: []string{"panel_id"},
+				Fields: []*FieldSchemaConfig{
+					{Name: "similarity", Required: true, Min: &zero, Max: &one},
+					{Name: "count", Type: FieldTypeInt},
+					{Name: "resolved", Type: FieldTypeBool},
+					{Name: "title", Type: FieldTypeString},
+				},
+			},
+		},
+	})
+	require.Nil(t, err)
+	return registry
+}
+
+func fieldsOf(err error) []string {
+	var errs ParamErrors
+	if !errors.As(err, &errs) {
+		return nil
+	}
+	fields := make([]string, 0, len(errs))
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	return fields
+}
+
+func TestSchemaRegistry_Validate(t *testing.T) {
+	assert := require.New(t)
+	registry := newTestSchemaRegistry(t)
+
+	param := &InsertSampleParam{
+		Measurement: "fast_tune_anomaly",
+		Tags:        map[string]string{"panel_id": "3"},
+		Fields:      map[string]interface{}{"similarity": 0.5, "count": float64(2), "resolved": true, "title": "qps"},
+	}
+	assert.Nil(registry.Validate(param))
+	assert.Equal(int64(2), param.Fields["count"])
+
+	err := registry.Validate(&InsertSampleParam{Measurement: "fast-tune-anomaly"})
+	assert.EqualError(err, `measurement: measurement "fast-tune-anomaly" is not declared, did you mean "fast_tune_anomaly"?`)
+
+	err = registry.Validate(&InsertSampleParam{
+		Measurement: "fast_tune_anomaly",
+		Tags:        map[string]string{"panelid": "3"},
+		Fields:      map[string]interface{}{"similarty": 0.5, "count": 1.5, "resolved": "yes", "title": 1.0},
+	})
+	assert.Equal([]string{"tags.panel_id", "fields.count", "fields.resolved", "fields.similarty", "fields.title", "fields.similarity"}, fieldsOf(err))
+	assert.Contains(err.Error(), `tag "panel_id" is required by fast_tune_anomaly, got "panelid"`)
+	assert.Contains(err.Error(), `field "similarty" is not declared by fast_tune_anomaly, did you mean "similarity"?`)
+	assert.Contains(err.Error(), "1.5 is not an int")
+
+	err = registry.Validate(&InsertSampleParam{
+		Measurement: "fast_tune_anomaly",
+		Tags:        map[string]string{"panel_id": "3"},
+		Fields:      map[string]interface{}{"similarity": 1.2},
+	})
+	assert.EqualError(err, "fields.similarity: 1.2 is out of range [0, 1]")
+
+	// the empty registry and allow_unknown accept anything
+	empty, err := NewSchemaRegistry(nil)
+	assert.Nil(err)
+	assert.Nil(empty.Validate(&InsertSampleParam{Measurement: "any"}))
+	registry.allowUnknown = true
+	assert.Nil(registry.Validate(&InsertSampleParam{Measurement: "any"}))
+}
+
+func TestNewSchemaRegistry(t *testing.T) {
+	assert := require.New(t)
+	one := 1.0
+	for _, cfg := range []*SchemaConfig{
+		{Measurements: []*MeasurementSchemaConfig{{Name: ""}}},
+		{Measurements: []*MeasurementSchemaConfig{{Name: "m"}, {Name: "m"}}},
+		{Measurements: []*MeasurementSchemaConfig{{Name: "m", Fields: []*FieldSchemaConfig{{Name: "f", Type: "double"}}}}},
+		{Measurements: []*MeasurementSchemaConfig{{Name: "m", Fields: []*FieldSchemaConfig{{Name: "f", Type: FieldTypeBool, Max: &one}}}}},
+		{Measurements: []*MeasurementSchemaConfig{{Name: "m", Fields: []*FieldSchemaConfig{{Name: "f"}, {Name: "f"}}}}},
+	} {
+		_, err := NewSchemaRegistry(cfg)
+		assert.NotNil(err)
+	}
+
+	// the example config is valid
+	cfg, err := InitConfig("config.yaml")
+	assert.Nil(err)
+	registry, err := NewSchemaRegistry(cfg.Schema)
+	assert.Nil(err)
+	assert.NotEmpty(registry.Schemas().Measurements)
+}
+
+func TestInsertSampleSchema(t *testing.T) {
+	assert := require.New(t)
+	reportAPI, err := NewReportAPI("http://127.0.0.1:0", "org", "bucket", "token",
+		WithSessionOption(&SessionConfig{Dir: filepath.Join(t.TempDir(), "sessions")}),
+		WithInfluxDBWriteOption(&InfluxDBWriteConfig{FlushInterval: "1h"}))
+	assert.Nil(err)
+	reportAPI.schemas = newTestSchemaRegistry(t)
+	dataAPI, err := NewDataAPI("http://127.0.0.1:0")
+	assert.Nil(err)
+	router := NewRouter(&ReportEndpoint{}, reportAPI, dataAPI)
+
+	post := func(param *InsertSampleParam) *httptest.ResponseRecorder {
+		bs, err := json.Marshal(param)
+		assert.Nil(err)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/sample", bytes.NewReader(bs)))
+		return w
+	}
+	w := post(&InsertSampleParam{Timestamp: 1, Measurement: "fast_tune_anomly", TiDBClusterID: "clinic"})
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), `did you mean \"fast_tune_anomaly\"?`)
+
+	w = post(&InsertSampleParam{Timestamp: 1, Measurement: "fast_tune_anomaly", TiDBClusterID: "clinic",
+		Tags: map[string]string{"panel_id": "3"}, Fields: map[string]interface{}{"similarity": 0.9}})
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(int64(1), reportAPI.WriteStats().Accepted)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/schemas", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	data := &SchemasData{}
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), data))
+	assert.Len(data.Measurements, 1)
+	assert.Equal("fast_tune_anomaly", data.Measurements[0].Name)
+	assert.Len(data.Measurements[0].Fields, 4)
+}
@@ -4,22 +4,29 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
 	http2 "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/query"
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	lp "github.com/influxdata/line-protocol"
 	"github.com/pingcap/log"
 	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
@@ -32,15 +39,60 @@ type ReportAPI struct {
 	bucket string
 	org    string
 
-	influxCli  influxdb2.Client
-	writeAPI   api.WriteAPI
-	queryAPI   api.QueryAPI
-	writeErrCh <-chan error
+	influxCli influxdb2.Client
+	// blockingCli writes the annotations, its writes are not counted by writes which
+	// tracks the async ones of InsertSample
+	blockingCli influxdb2.Client
+	writeAPI    api.WriteAPI
+	queryAPI    api.QueryAPI
+	writeErrCh  <-chan error
 
 	httpCli http.Client
 
+	// queryGroup coalesce concurrent identical flux and promql queries
+	queryGroup *QueryGroup
+	// formatters render dynamic text values by the `type` label or `format` tag
+	formatters *FormatterRegistry
+	// defaultLoc and clusterLoc are the timezones to render timestamps when
+	// the request has no `tz` param, nil means the server local timezone.
+	defaultLoc *time.Location
+	clusterLoc map[string]*time.Location
+	// annotationMerge and annotationMergeGap are the defaults of annotation merging
+	annotationMerge    bool
+	annotationMergeGap time.Duration
+	// annotationStyles are the configured styles followed by the default ones
+	annotationStyles []*AnnotationStyleConfig
+	// annotationBackend is where the annotations created by the write api are stored
+	annotationBackend string
+	// trees are the builtin and configured diagnosis trees by name
+	trees map[string]*DiagnosisTree
+	// grafana is used to generate the grafana dashboard
+	grafana *GrafanaConfig
+	// reportRenderer renders the diagnosis report documents
+	reportRenderer *ReportRenderer
+	// sessions persists the diagnosis snapshots
+	sessions SessionStore
+	// vmUpstream and influxUpstream retry the queries and fail fast while the backend is down
+	vmUpstream     *Upstream
+	influxUpstream *Upstream
+	// fallback serves the v2 queries with the v1 ones while the vm breaker is open
+	fallback bool
+
+	// schemas validates the samples of /sample and /sample/v2
+	schemas *SchemaRegistry
+	// writes counts the points of the async writes to report the lost ones on shutdown
+	writes writeCounter
+	// writeOpts configures the write api, samples buffers the points until they are flushed
+	writeOpts *writeOptions
+	samples   *sampleBuffer
+
 	// internal variable
-	done chan struct{}
+	flushMu   sync.Mutex
+	stopFlush chan struct{}
+	flushDone chan struct{}
+	closeOnce sync.Once
+	// loopDone is closed by writeErrorLoop after the write api is closed
+	loopDone chan struct{}
 }
 
 func WithVMOption(endpoint string) ReportAPIOption {
@@ -49,6 +101,160 @@ func WithVMOption(endpoint string) ReportAPIOption {
 		return nil
 	}
 }
+
+// WithFormattersOption registers the formatters declared in config
+func WithFormattersOption(cfgs []*FormatterConfig) ReportAPIOption {
+	return func(reportAPI *ReportAPI) error {
+		return reportAPI.formatters.RegisterConfig(cfgs)
+	}
+}
+
+// WithTimezoneOption sets the default timezone and the per cluster ones
+func WithTimezoneOption(defaultTZ string, clusters map[string]*ClusterConfig) ReportAPIOption {
+	return func(reportAPI *ReportAPI) error {
+		if len(defaultTZ) > 0 {
+			loc, err := time.LoadLocation(defaultTZ)
+			if err != nil {
+				return err
+			}
+			reportAPI.defaultLoc = loc
+		}
+		for clusterID, cluster := range clusters {
+			if cluster == nil || len(cluster.Timezone) == 0 {
+				continue
+			}
+			loc, err := time.LoadLocation(cluster.Timezone)
+			if err != nil {
+				return fmt.Errorf("cluster %s: %v", clusterID, err)
+			}
+			reportAPI.clusterLoc[clusterID] = loc
+		}
+		return nil
+	}
+}
+
+// WithAnnotationOption sets how annotations are post processed
+func WithAnnotationOption(cfg *AnnotationConfig) ReportAPIOption {
+	return func(reportAPI *ReportAPI) error {
+		if cfg == nil {
+			return nil
+		}
+		reportAPI.annotationMerge = !cfg.DisableMerge
+		if len(cfg.MergeGap) > 0 {
+			gap, err := time.ParseDuration(cfg.MergeGap)
+			if err != nil {
+				return fmt.Errorf("annotation merge_gap: %v", err)
+			}
+			reportAPI.annotationMergeGap = gap
+		}
+		for _, style := range cfg.Styles {
+			if _, ok := severityRank[style.Severity]; !ok && len(style.Severity) > 0 {
+				return fmt.Errorf("annotation style: unknown severity %q", style.Severity)
+			}
+		}
+		switch cfg.Backend {
+		case "":
+		case AnnotationBackendInfluxDB, AnnotationBackendVM:
+			reportAPI.annotationBackend = cfg.Backend
+		default:
+			return fmt.Errorf("annotation backend: unknown backend %q", cfg.Backend)
+		}
+		styles := make([]*AnnotationStyleConfig, 0, len(cfg.Styles)+len(defaultAnnotationStyles))
+		styles = append(styles, cfg.Styles...)
+		reportAPI.annotationStyles = append(styles, defaultAnnotationStyles...)
+		return nil
+	}
+}
+
+// WithTreesOption registers the diagnosis trees declared in config
+func WithTreesOption(cfgs []*TreeConfig) ReportAPIOption {
+	return func(reportAPI *ReportAPI) error {
+		for _, cfg := range cfgs {
+			tree, err := NewDiagnosisTree(cfg)
+			if err != nil {
+				return err
+			}
+			reportAPI.trees[tree.Name] = tree
+		}
+		return nil
+	}
+}
+
+// WithGrafanaOption sets the datasource and panels of the generated grafana dashboard
+func WithGrafanaOption(cfg *GrafanaConfig) ReportAPIOption {
+	return func(reportAPI *ReportAPI) error {
+		if cfg != nil {
+			reportAPI.grafana = cfg
+		}
+		return nil
+	}
+}
+
+// WithReportOption loads the report templates in config
+func WithReportOption(cfg *ReportConfig) ReportAPIOption {
+	return func(reportAPI *ReportAPI) error {
+		renderer, err := NewReportRenderer(cfg)
+		if err != nil {
+			return err
+		}
+		reportAPI.reportRenderer = renderer
+		return nil
+	}
+}
+
+// WithSessionOption sets where the session snapshots are stored
+func WithSessionOption(cfg *SessionConfig) ReportAPIOption {
+	return func(reportAPI *ReportAPI) error {
+		if cfg == nil {
+			return nil
+		}
+		reportAPI.sessions = NewFileSessionStore(cfg.Dir)
+		return nil
+	}
+}
+
+// WithUpstreamOption sets the timeout, retry and circuit breaker of the queries to vm and influxdb
+func WithUpstreamOption(cfg *UpstreamConfig) ReportAPIOption {
+	return func(reportAPI *ReportAPI) error {
+		if cfg == nil {
+			return nil
+		}
+		var err error
+		if reportAPI.vmUpstream, err = NewUpstream(UpstreamVM, cfg); err != nil {
+			return err
+		}
+		if reportAPI.influxUpstream, err = NewUpstream(UpstreamInfluxDB, cfg); err != nil {
+			return err
+		}
+		reportAPI.fallback = cfg.FallbackToInfluxDB
+		return nil
+	}
+}
+
+// WithSchemaOption declares the measurements accepted by InsertSample and InsertSampleV2
+func WithSchemaOption(cfg *SchemaConfig) ReportAPIOption {
+	return func(reportAPI *ReportAPI) error {
+		registry, err := NewSchemaRegistry(cfg)
+		if err != nil {
+			return err
+		}
+		reportAPI.schemas = registry
+		return nil
+	}
+}
+
+// WithInfluxDBWriteOption configures the batching and the flush scheduler of the /sample writes
+func WithInfluxDBWriteOption(cfg *InfluxDBWriteConfig) ReportAPIOption {
+	return func(reportAPI *ReportAPI) error {
+		opts, err := newWriteOptions(cfg)
+		if err != nil {
+			return err
+		}
+		reportAPI.writeOpts = opts
+		return nil
+	}
+}
+
 func NewReportAPI(influxdbEp string, org string, bucket string, token string, opts ...ReportAPIOption) (*ReportAPI, error) {
 	//influxdbURL := "http://localhost:8086"
 	//tk := "lF9VJ9pvM3xU4piExllnV800kHwGg9ie-08fTnlcZl9EcYllFMo9urMGTQ71AI3UKTJTn5D6LiRmCvDLAG9BPQ=="
@@ -56,9 +262,19 @@ func NewReportAPI(influxdbEp string, org string, bucket string, token string, op
 	//bucket := "clinic"
 
 	rAPI := &ReportAPI{
-		bucket: bucket,
-		org:    org,
-		done:   make(chan struct{}),
+		bucket:     bucket,
+		org:        org,
+		queryGroup: NewQueryGroup(),
+		formatters: NewFormatterRegistry(),
+		clusterLoc: make(map[string]*time.Location),
+		trees:      builtinTrees(),
+		grafana:    &GrafanaConfig{},
+		stopFlush:  make(chan struct{}),
+		flushDone:  make(chan struct{}),
+		loopDone:   make(chan struct{}),
+
+		annotationMerge:  true,
+		annotationStyles: defaultAnnotationStyles,
 	}
 
 	for _, opt := range opts {
@@ -66,56 +282,181 @@ func NewReportAPI(influxdbEp string, org string, bucket string, token string, op
 			return nil, err
 		}
 	}
+	if rAPI.reportRenderer == nil {
+		renderer, err := NewReportRenderer(nil)
+		if err != nil {
+			return nil, err
+		}
+		rAPI.reportRenderer = renderer
+	}
+	if rAPI.sessions == nil {
+		rAPI.sessions = NewFileSessionStore("")
+	}
+	if rAPI.schemas == nil {
+		rAPI.schemas, _ = NewSchemaRegistry(nil)
+	}
+	if rAPI.writeOpts == nil {
+		rAPI.writeOpts, _ = newWriteOptions(nil)
+	}
+	rAPI.samples = newSampleBuffer(rAPI.writeOpts.batchSize)
+	if rAPI.vmUpstream == nil {
+		rAPI.vmUpstream, _ = NewUpstream(UpstreamVM, nil)
+	}
+	if rAPI.influxUpstream == nil {
+		rAPI.influxUpstream, _ = NewUpstream(UpstreamInfluxDB, nil)
+	}
+	if len(rAPI.annotationBackend) == 0 {
+		rAPI.annotationBackend = AnnotationBackendInfluxDB
+		if len(rAPI.vmEndpoint) > 0 {
+			rAPI.annotationBackend = AnnotationBackendVM
+		}
+	}
 
-	rAPI.influxCli = influxdb2.NewClient(influxdbEp, token)
+	influxOpts := influxdb2.DefaultOptions()
+	rAPI.writeOpts.apply(influxOpts)
+	influxHTTPCli := influxOpts.HTTPOptions().HTTPClient()
+	influxHTTPCli.Transport = newTracingTransport(&writeCountingTransport{base: influxHTTPCli.Transport, counter: &rAPI.writes})
+	rAPI.influxCli = influxdb2.NewClientWithOptions(influxdbEp, token, influxOpts)
 	rAPI.writeAPI = rAPI.influxCli.WriteAPI(org, bucket)
 	rAPI.writeAPI.SetWriteFailedCallback(retryCallBack)
 	rAPI.writeErrCh = rAPI.writeAPI.Errors()
 	rAPI.queryAPI = rAPI.influxCli.QueryAPI(org)
+	blockingOpts := influxdb2.DefaultOptions()
+	rAPI.writeOpts.apply(blockingOpts)
+	blockingHTTPCli := blockingOpts.HTTPOptions().HTTPClient()
+	blockingHTTPCli.Transport = newTracingTransport(blockingHTTPCli.Transport)
+	rAPI.blockingCli = influxdb2.NewClientWithOptions(influxdbEp, token, blockingOpts)
 	// TODO(shenjun): use cutomized transport later
 	rAPI.httpCli = http.Client{
-		Transport: http.DefaultTransport,
+		Transport: newTracingTransport(http.DefaultTransport),
 	}
 
 	go rAPI.writeErrorLoop()
+	go rAPI.flushLoop()
 
 	return rAPI, nil
 }
 
-// Close must be called by the caller
+// Tree returns the diagnosis tree by name, the default tree is returned when name is empty
+// ErrTreeNotFound is returned when the diagnosis tree of the request is not configured
+var ErrTreeNotFound = errors.New("tree is not defined")
+
+func (api *ReportAPI) Tree(name string) (*DiagnosisTree, error) {
+	if len(name) == 0 {
+		name = DefaultTreeName
+	}
+	tree, ok := api.trees[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrTreeNotFound, name)
+	}
+	return tree, nil
+}
+
+// timeRender returns the render for the request params and the cluster default timezone
+func (api *ReportAPI) timeRender(clusterID string, param *TimeFormatParam) (*TimeRender, error) {
+	loc, ok := api.clusterLoc[clusterID]
+	if !ok {
+		loc = api.defaultLoc
+	}
+	return param.NewTimeRender(loc)
+}
+
+// postProcessAnnotations filters the annotations, merges the regions unless disabled
+// by the param or config, and styles them by category and severity.
+func (api *ReportAPI) postProcessAnnotations(param *QueryAnnotationsParam, data QueryAnnotationsData) QueryAnnotationsData {
+	data = FilterAnnotations(data, param.Filters)
+	merge, gap := api.annotationMerge, api.annotationMergeGap
+	if param.Merge != nil {
+		merge = *param.Merge
+	}
+	if param.MergeGap != nil {
+		gap = *param.MergeGap
+	}
+	if merge {
+		data = MergeAnnotations(data, gap)
+	}
+	for i := range data {
+		data[i].Annotation = NewStyledAnnotation(api.annotationStyles, data[i].Category, data[i].Severity)
+	}
+	return data
+}
+
+// Close must be called by the caller, it waits until the write buffers are drained
 func (api *ReportAPI) Close() {
+	_ = api.Shutdown(context.Background())
+}
+
+// Shutdown stops the flush scheduler, flushes the buffered points to influxdb and
+// waits for the write errors to be drained. It returns the number of the unwritten points when ctx is done
+// first, the flush goes on in the background until the process exits.
+func (api *ReportAPI) Shutdown(ctx context.Context) error {
 	if api == nil {
-		return
+		return nil
+	}
+	api.closeOnce.Do(func() {
+		go func() {
+			close(api.stopFlush)
+			<-api.flushDone
+			api.flush("")
+			// closing the client flushes the write api and closes its error channel
+			api.influxCli.Close()
+			api.blockingCli.Close()
+		}()
+	})
+	select {
+	case <-api.loopDone:
+		stats := api.writes.Stats()
+		fields := []zap.Field{zap.Int64("accepted", stats.Accepted), zap.Int64("written", stats.Written),
+			zap.Int64("failed_batches", stats.FailedBatches)}
+		if stats.Unwritten() > 0 {
+			log.Warn("write buffers drained, the failed points are lost",
+				append(fields, zap.Int64("lost", stats.Unwritten()))...)
+		} else {
+			log.Info("write buffers drained", fields...)
+		}
+		return nil
+	case <-ctx.Done():
+		stats := api.writes.Stats()
+		log.Error("write buffers are not drained, the unwritten points are lost",
+			zap.Int64("accepted", stats.Accepted), zap.Int64("written", stats.Written),
+			zap.Int64("failed_batches", stats.FailedBatches), zap.Int64("lost", stats.Unwritten()))
+		return fmt.Errorf("drain write buffers: %w, %d of %d points are not written",
+			ctx.Err(), stats.Unwritten(), stats.Accepted)
 	}
-	api.writeAPI.Flush()
-	api.influxCli.Close()
-	close(api.done)
+}
+
+// WriteStats returns the counters of the async writes
+func (api *ReportAPI) WriteStats() WriteStats {
+	return api.writes.Stats()
 }
 
 func (api *ReportAPI) QueryNodeGraph(ctx context.Context, param *QueryNodeGraphParam) (*QueryNodeGraphData, error) {
-	// build the flux query
+	ctx, span := startSpan(ctx, "ReportAPI.QueryNodeGraph")
+	defer span.End()
+	tree, err := api.Tree(param.Tree)
+	if err != nil {
+		return nil, err
+	}
+	// build the flux query, the aggregations other than the selectors drop the title
+	// column which falls back to the title in tree
 	fluxQueryBase := `
 from(bucket: "%s")
 	|> range(start: %v, stop: %v)
-	|> filter(fn:(r) => r._measurement =="fast-tune-similarity" and r.tidb_cluster_id == "%v") |> group(columns: ["id"]) |> first() |> filter(fn:(r) => r._value >= 0.5) |> sort(columns: ["id"])
+	|> filter(fn:(r) => r._measurement =="fast-tune-similarity" and r.tidb_cluster_id == "%v") |> group(columns: ["id"]) |> %s |> filter(fn:(r) => r._value >= 0.5) |> sort(columns: ["id"])
 `
-	fluxQuery := fmt.Sprintf(fluxQueryBase, api.bucket, param.StartTS, param.EndTS, param.TiDBClusterID)
+	fluxQuery := fmt.Sprintf(fluxQueryBase, api.bucket, param.StartTS, param.EndTS, param.TiDBClusterID, RollUpFlux(tree.RollUp(param.Agg)))
 	// fmt.Println(fluxQuery)
-	result, err := api.queryAPI.Query(ctx, fluxQuery)
+	records, err := api.queryFlux(ctx, fluxQuery)
 	if err != nil {
-		log.Error("query influxdb failed", zap.Error(err))
 		return nil, err
 	}
-	defer result.Close()
 
 	data := QueryNodeGraphData{
 		Nodes: make([]*Node, 0),
 		Edges: make([]*Edge, 0),
 	}
 
-	nodesLookup := make(map[int64]struct{})
-	for result.Next() {
-		rd := result.Record()
+	for _, rd := range records {
 		similarity, ok := rd.Value().(float64)
 		if !ok {
 			continue
@@ -126,11 +467,14 @@ from(bucket: "%s")
 		}
 		id, err := strconv.ParseInt(idStr, 0, 64)
 		if err != nil {
-			log.Error("parse int failed", zap.Error(err))
+			Logger(ctx).Error("parse int failed", zap.Error(err))
 			return nil, err
 		}
 		title, ok := rd.ValueByKey("title").(string)
 		if !ok {
+			title = tree.Title(id)
+		}
+		if len(title) == 0 {
 			title = "unknown"
 		}
 		node := DefaultNode()
@@ -142,35 +486,14 @@ from(bucket: "%s")
 		node.ArcNegative = 1 - similarity
 
 		data.Nodes = append(data.Nodes, node)
-		nodesLookup[id] = struct{}{}
-	}
-	// log.Info("", zap.Any("nodesLookuo", nodesLookup))
-	for _, node := range data.Nodes {
-		id, _ := strconv.ParseInt(node.ID, 0, 64)
-		if targets, ok := EdgeMatrixV2[id]; ok {
-			// log.Info("", zap.Any("targets", targets), zap.Any("id", id))
-			for _, target := range targets {
-				if _, ok := nodesLookup[target]; !ok {
-					continue
-				}
-				edge := DefaultEdge()
-				// edge.ID = fmt.Sprintf("%#x", id<<16+target)
-				edge.ID = fmt.Sprintf("%v%v", id, target)
-				edge.Source = node.ID
-				edge.Target = fmt.Sprintf("%v", target)
-				data.Edges = append(data.Edges, edge)
-			}
-		}
-	}
-
-	if result.Err() != nil {
-		log.Error("query parsing failed", zap.Error(result.Err()))
-		return nil, err
 	}
+	data.Edges = tree.Link(data.Nodes)
 	return &data, nil
 }
 
 func (api *ReportAPI) QueryAnnotations(ctx context.Context, param *QueryAnnotationsParam) (QueryAnnotationsData, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.QueryAnnotations")
+	defer span.End()
 	fluxQueryBase := `
 from(bucket: "%s")
 	|> range(start: %v, stop: %v)
@@ -181,27 +504,25 @@ from(bucket: "%s")
 	}
 	fluxQuery := fmt.Sprintf(fluxQueryBase, api.bucket, param.StartTS, param.EndTS, param.Measurement, param.TiDBClusterID)
 
-	result, err := api.queryAPI.Query(ctx, fluxQuery)
+	tr, err := api.timeRender(param.TiDBClusterID, &param.TimeFormatParam)
+	if err != nil {
+		return nil, err
+	}
+	records, err := api.queryFlux(ctx, fluxQuery)
 	if err != nil {
-		log.Error("query influxdb failed", zap.Error(err))
 		return nil, err
 	}
-	defer result.Close()
 
 	data := make(QueryAnnotationsData, 0)
-	for result.Next() {
-		item := QueryAnnotationItem{
-			Annotation: DefaultAnomalyAnnotation(),
-			Title:      "anomaly title",
-			Tags:       "anomaly tags",
-			Text:       "anomaly text",
-		}
-		rd := result.Record()
+	for _, rd := range records {
+		item := QueryAnnotationItem{}
 		// Time should be milliseconds
-		item.Time = rd.Time().UnixNano() / 1e6
+		item.Time = toMillis(rd.Time())
+		item.TimeText = tr.Format(rd.Time())
 		if rd.Field() == "end_time" {
 			if endTs, ok := rd.Value().(float64); ok {
-				item.TimeEnd = int64(endTs) * 1e3
+				item.TimeEnd = secondsToMillis(endTs)
+				item.TimeEndText = tr.FormatUnix(int64(endTs))
 			}
 		}
 		if panelID, ok := rd.ValueByKey("panel_id").(string); ok {
@@ -216,17 +537,23 @@ from(bucket: "%s")
 		if text, ok := rd.ValueByKey("text").(string); ok {
 			item.Text = text
 		}
+		if severity, ok := rd.ValueByKey("severity").(string); ok {
+			item.Severity = severity
+		}
+		if category, ok := rd.ValueByKey("category").(string); ok {
+			item.Category = category
+		}
+		if id, ok := rd.ValueByKey("annotation_id").(string); ok {
+			item.ID = id
+		}
 		data = append(data, item)
 	}
-
-	if result.Err() != nil {
-		log.Error("query parsing failed", zap.Error(result.Err()))
-		return nil, err
-	}
-	return data, nil
+	return api.postProcessAnnotations(param, data), nil
 }
 
 func (api *ReportAPI) QueryDynamicTextValue(ctx context.Context, param *QueryDynamicTextValueParam) (QueryDynamicTextValueData, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.QueryDynamicTextValue")
+	defer span.End()
 	fluxQueryBase := `
 from(bucket: "%s")
 	|> range(start: %v, stop: %v)
@@ -239,53 +566,141 @@ from(bucket: "%s")
 	}
 	fluxQuery := fmt.Sprintf(fluxQueryBase, api.bucket, param.StartTS, param.EndTS, param.Measurement, param.TiDBClusterID)
 
-	result, err := api.queryAPI.Query(ctx, fluxQuery)
+	tr, err := api.timeRender(param.TiDBClusterID, &param.TimeFormatParam)
+	if err != nil {
+		return nil, err
+	}
+	records, err := api.queryFlux(ctx, fluxQuery)
 	if err != nil {
-		log.Error("query influxdb failed", zap.Error(err))
 		return nil, err
 	}
-	defer result.Close()
 
 	data := make(QueryDynamicTextValueData)
-	for result.Next() {
-		rd := result.Record()
+	for _, rd := range records {
 		value, ok := rd.Value().(float64)
 		if !ok {
 			continue
 		}
-		switch rd.ValueByKey("format") {
-		case "float":
-			data[rd.Field()] = value
-		case "int":
-			data[rd.Field()] = int64(value)
-		case "unix_seconds":
-			data[rd.Field()] = int64(value)
-			data[fmt.Sprintf("%s_rfc3339", rd.Field())] = time.Unix(int64(value), 0).Format(time.RFC3339)
-		default:
-			data[rd.Field()] = value
+		format, _ := rd.ValueByKey("format").(string)
+		if formatter, ok := api.formatters.Lookup(format); ok {
+			formatter.Format(value, tr).Fill(rd.Field(), data)
+			continue
 		}
+		data[rd.Field()] = value
 	}
+	return data, nil
+}
 
+// queryFlux run the flux query and collect all records, concurrent identical
+// queries share one upstream call. The returned records must not be modified.
+func (api *ReportAPI) queryFlux(ctx context.Context, fluxQuery string) (_ []*query.FluxRecord, err error) {
+	ctx, span := startSpan(ctx, "queryFlux", attribute.String("db.statement", fluxQuery))
+	defer func() { endSpan(span, err) }()
+	v, shared, err := api.queryGroup.Do(ctx, "flux:"+fluxQuery, func(ctx context.Context) (interface{}, error) {
+		var records []*query.FluxRecord
+		err := api.influxUpstream.Do(ctx, func(ctx context.Context) (err error) {
+			records, err = api.doQueryFlux(ctx, fluxQuery)
+			return err
+		})
+		return records, err
+	})
+	span.SetAttributes(attribute.Bool("shared", shared))
+	if err != nil {
+		return nil, err
+	}
+	return v.([]*query.FluxRecord), nil
+}
+
+func (api *ReportAPI) doQueryFlux(ctx context.Context, fluxQuery string) ([]*query.FluxRecord, error) {
+	start := time.Now()
+	defer func() {
+		Logger(ctx).Debug("query influxdb", zap.String("flux", fluxQuery), zap.Duration("duration", time.Since(start)))
+	}()
+	result, err := api.queryAPI.Query(ctx, fluxQuery)
+	if err != nil {
+		Logger(ctx).Error("query influxdb failed", zap.Error(err))
+		return nil, err
+	}
+	defer result.Close()
+	records := make([]*query.FluxRecord, 0)
+	for result.Next() {
+		records = append(records, result.Record())
+	}
 	if result.Err() != nil {
-		log.Error("query parsing failed", zap.Error(result.Err()))
+		Logger(ctx).Error("query parsing failed", zap.Error(result.Err()))
+		return nil, result.Err()
+	}
+	return records, nil
+}
+
+// queryMetrics use `/api/v1/query` to get raw sample, concurrent identical
+// queries share one upstream call. The returned value must not be modified.
+func (api *ReportAPI) queryMetrics(ctx context.Context, queryExpr string, ts int64) (_ model.Value, err error) {
+	ctx, span := startSpan(ctx, "queryMetrics", attribute.String("db.statement", queryExpr), attribute.Int64("time", ts))
+	defer func() { endSpan(span, err) }()
+	key := fmt.Sprintf("promql:%s@%d", queryExpr, ts)
+	v, shared, err := api.queryGroup.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		var v model.Value
+		err := api.vmUpstream.Do(ctx, func(ctx context.Context) (err error) {
+			v, err = api.doQueryMetrics(ctx, "/api/v1/query", url.Values{
+				"query": {queryExpr},
+				"time":  {strconv.FormatInt(ts, 10)},
+			})
+			return err
+		})
+		return v, err
+	})
+	span.SetAttributes(attribute.Bool("shared", shared))
+	if err != nil {
 		return nil, err
 	}
-	return data, nil
+	return v.(model.Value), nil
 }
 
-// use `/api/v1/query` to get raw sample
-func (api *ReportAPI) queryMetrics(ctx context.Context, queryExpr string, ts int64) (model.Value, error) {
-	u := fmt.Sprintf("%s%s", api.vmEndpoint, "/api/v1/query")
-	payload := url.Values{
-		"query": {queryExpr},
-		"time":  {strconv.FormatInt(ts, 10)},
+// queryMetricsRange use `/api/v1/query_range` to evaluate the query at every step
+// from start to end, concurrent identical queries share one upstream call. The
+// returned value must not be modified.
+func (api *ReportAPI) queryMetricsRange(ctx context.Context, queryExpr string, start, end int64, step time.Duration) (_ model.Value, err error) {
+	ctx, span := startSpan(ctx, "queryMetricsRange", attribute.String("db.statement", queryExpr),
+		attribute.Int64("start", start), attribute.Int64("end", end), attribute.Int64("step", int64(step/time.Second)))
+	defer func() { endSpan(span, err) }()
+	key := fmt.Sprintf("promql:%s@%d:%d:%d", queryExpr, start, end, int64(step/time.Second))
+	v, shared, err := api.queryGroup.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		var v model.Value
+		err := api.vmUpstream.Do(ctx, func(ctx context.Context) (err error) {
+			// nocache keeps vm from aligning start to the step, the points must be the window ends
+			v, err = api.doQueryMetrics(ctx, "/api/v1/query_range", url.Values{
+				"query":   {queryExpr},
+				"start":   {strconv.FormatInt(start, 10)},
+				"end":     {strconv.FormatInt(end, 10)},
+				"step":    {fmt.Sprintf("%ds", int64(step/time.Second))},
+				"nocache": {"1"},
+			})
+			return err
+		})
+		return v, err
+	})
+	span.SetAttributes(attribute.Bool("shared", shared))
+	if err != nil {
+		return nil, err
 	}
+	return v.(model.Value), nil
+}
+
+func (api *ReportAPI) doQueryMetrics(ctx context.Context, path string, payload url.Values) (model.Value, error) {
+	start := time.Now()
+	defer func() {
+		Logger(ctx).Debug("query vm", zap.String("path", path), zap.String("promql", payload.Get("query")),
+			zap.String("time", payload.Get("time")), zap.Duration("duration", time.Since(start)))
+	}()
+	u := fmt.Sprintf("%s%s", api.vmEndpoint, path)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(payload.Encode()))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	setRequestIDHeader(ctx, req)
 	resp, err := api.httpCli.Do(req)
 	if err != nil {
 		return nil, err
@@ -295,11 +710,14 @@ func (api *ReportAPI) queryMetrics(ctx context.Context, queryExpr string, ts int
 		_ = resp.Body.Close()
 	}()
 	if resp.StatusCode != http.StatusOK {
-		return nil, err
+		return nil, &upstreamStatusError{StatusCode: resp.StatusCode}
 	}
 
 	mResp := MetricsResp{}
-	if err := json.NewDecoder(resp.Body).Decode(&mResp); err != nil {
+	_, decodeSpan := startSpan(ctx, "decode MetricsQueryResult")
+	err = json.NewDecoder(resp.Body).Decode(&mResp)
+	endSpan(decodeSpan, err)
+	if err != nil {
 		return nil, err
 	}
 	// matrix, ok := mResp.Data.v.(model.Matrix)
@@ -309,34 +727,58 @@ func (api *ReportAPI) queryMetrics(ctx context.Context, queryExpr string, ts int
 	return mResp.Data.v, nil
 }
 
+// fallbackToInfluxDB reports whether the v2 query failing with err should be served
+// by the v1 one, which is only when the vm breaker is open
+func (api *ReportAPI) fallbackToInfluxDB(ctx context.Context, err error) bool {
+	if !api.fallback || !errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	Logger(ctx).Warn("vm is unavailable, fall back to influxdb", zap.Error(err))
+	return true
+}
+
 func (api *ReportAPI) QueryNodeGraphV2(ctx context.Context, param *QueryNodeGraphParam) (*QueryNodeGraphData, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.QueryNodeGraphV2")
+	defer span.End()
+	tree, err := api.Tree(param.Tree)
+	if err != nil {
+		return nil, err
+	}
 	ts, interval := param.GetRollUpParam()
-	queryExpr := fmt.Sprintf(`first_over_time({__name__=~"fast_tune_similarity.*",tidb_cluster_id="%s"}[%s])`, param.TiDBClusterID, interval)
+	selector := fmt.Sprintf(`{__name__=~"fast_tune_similarity.*",tidb_cluster_id="%s"}`, param.TiDBClusterID)
+	queryExpr := RollUpPromQL(tree.RollUp(param.Agg), selector, interval)
 	v, err := api.queryMetrics(ctx, queryExpr, ts)
+	if api.fallbackToInfluxDB(ctx, err) {
+		return api.QueryNodeGraph(ctx, param)
+	}
 	if err != nil {
 		return nil, err
 	}
 	vector, ok := v.(model.Vector)
 	if !ok {
-		log.Error("convert to vector failed", zap.Any("value", v))
+		Logger(ctx).Error("convert to vector failed", zap.Any("value", v))
 		return nil, fmt.Errorf("")
 	}
 	// log.Info("QueryNodeGraphV2", zap.Int("len", len(vector)))
+	return newNodeGraphV2(ctx, tree, vector), nil
+}
+
+// newNodeGraphV2 builds the nodes of the similarity samples and links them by the tree
+func newNodeGraphV2(ctx context.Context, tree *DiagnosisTree, vector model.Vector) *QueryNodeGraphData {
 	data := QueryNodeGraphData{
 		Nodes: make([]*Node, 0),
 		Edges: make([]*Edge, 0),
 	}
 
-	nodesLookup := make(map[int64]struct{})
 	if len(vector) == 0 {
-		return &data, nil
+		return &data
 	}
 	for _, sample := range vector {
 		similarity := float64(sample.Value)
 		idStr := string(sample.Metric["id"])
 		id, err := strconv.ParseInt(idStr, 0, 64)
 		if err != nil {
-			log.Warn("parse int fail skip the node", zap.String("id", idStr), zap.Error(err))
+			Logger(ctx).Warn("parse int fail skip the node", zap.String("id", idStr), zap.Error(err))
 			continue
 		}
 		node := DefaultNode()
@@ -344,73 +786,73 @@ func (api *ReportAPI) QueryNodeGraphV2(ctx context.Context, param *QueryNodeGrap
 		node.ID = idStr
 		node.Title = idStr
 		node.SubTitle = string(sample.Metric["title"])
+		if len(node.SubTitle) == 0 {
+			node.SubTitle = tree.Title(id)
+		}
 		node.MainStat = fmt.Sprintf("%.3f", similarity)
 		node.ArcPositive = similarity
 		node.ArcNegative = 1 - similarity
 
 		data.Nodes = append(data.Nodes, node)
-		nodesLookup[id] = struct{}{}
-	}
-	for _, node := range data.Nodes {
-		id, _ := strconv.ParseInt(node.ID, 0, 64)
-		if targets, ok := EdgeMatrixV2[id]; ok {
-			for _, target := range targets {
-				if _, ok := nodesLookup[target]; !ok {
-					continue
-				}
-				edge := DefaultEdge()
-				edge.ID = fmt.Sprintf("%v%v", id, target)
-				edge.Source = node.ID
-				edge.Target = fmt.Sprintf("%v", target)
-				data.Edges = append(data.Edges, edge)
-			}
-		}
 	}
+	data.Edges = tree.Link(data.Nodes)
 
-	return &data, nil
+	return &data
 }
 
 func (api *ReportAPI) QueryAnnotationsV2(ctx context.Context, param *QueryAnnotationsParam) (QueryAnnotationsData, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.QueryAnnotationsV2")
+	defer span.End()
 	if len(param.Measurement) == 0 {
 		param.Measurement = "fast_tune_anomaly"
 	}
+	tr, err := api.timeRender(param.TiDBClusterID, &param.TimeFormatParam)
+	if err != nil {
+		return nil, err
+	}
 	ts, interval := param.GetRollUpParam()
 	queryExpr := fmt.Sprintf(`{__name__=~"%s.*",tidb_cluster_id="%s"}[%s]`, param.Measurement, param.TiDBClusterID, interval)
 	v, err := api.queryMetrics(ctx, queryExpr, ts)
+	if api.fallbackToInfluxDB(ctx, err) {
+		return api.QueryAnnotations(ctx, param)
+	}
 	if err != nil {
 		return nil, err
 	}
 	matrix, ok := v.(model.Matrix)
 	if !ok {
-		log.Error("convert to matrix failed", zap.Any("value", v))
+		Logger(ctx).Error("convert to matrix failed", zap.Any("value", v))
 		return nil, fmt.Errorf("")
 	}
 	data := make(QueryAnnotationsData, 0)
 	for _, sample := range matrix {
 		for _, pair := range sample.Values {
-			item := QueryAnnotationItem{
-				Annotation: DefaultAnomalyAnnotation(),
-				Title:      "anomaly title",
-				Tags:       "anomaly tags",
-				Text:       "anomaly text",
-			}
+			item := QueryAnnotationItem{}
 			if panelID, ok := sample.Metric["panel_id"]; ok {
 				item.PanelID, _ = strconv.ParseInt(string(panelID), 0, 64)
 			}
 			item.Title = string(sample.Metric["title"])
 			item.Tags = string(sample.Metric["tags"])
 			item.Text = string(sample.Metric["text"])
-			item.Time = pair.Timestamp.UnixNano() / 1e6
-			item.TimeEnd = int64(pair.Value) * 1e3
+			item.Severity = string(sample.Metric["severity"])
+			item.Category = string(sample.Metric["category"])
+			item.ID = string(sample.Metric["annotation_id"])
+			item.Time = toMillis(pair.Timestamp.Time())
+			item.TimeEnd = secondsToMillis(float64(pair.Value))
+			item.TimeText = tr.Format(pair.Timestamp.Time())
+			if item.TimeEnd > 0 {
+				item.TimeEndText = tr.FormatUnix(int64(pair.Value))
+			}
 			data = append(data, item)
 		}
 	}
 	// log.Info("QueryAnnotationsV2", zap.Int("len", len(data)))
 
-	return data, nil
+	return api.postProcessAnnotations(param, data), nil
 }
 
-func (api *ReportAPI) QueryDynamicTextValueV2(ctx context.Context, param *QueryDynamicTextValueParam) (QueryDynamicTextValueData, error) {
+// queryDynamicTextMatrix returns all raw samples of the measurement in the time range
+func (api *ReportAPI) queryDynamicTextMatrix(ctx context.Context, param *QueryDynamicTextValueParam) (model.Matrix, error) {
 	ts, interval := param.GetRollUpParam()
 	queryExpr := fmt.Sprintf(`{__name__=~"%s.*",tidb_cluster_id="%s"}[%s]`, param.Measurement, param.TiDBClusterID, interval)
 	v, err := api.queryMetrics(ctx, queryExpr, ts)
@@ -419,8 +861,48 @@ func (api *ReportAPI) QueryDynamicTextValueV2(ctx context.Context, param *QueryD
 	}
 	matrix, ok := v.(model.Matrix)
 	if !ok {
-		log.Error("convert to vector failed", zap.Any("value", v))
-		return nil, fmt.Errorf("")
+		Logger(ctx).Error("convert to matrix failed", zap.Any("value", v))
+		return nil, fmt.Errorf("type %T is not model.Matrix", v)
+	}
+	return matrix, nil
+}
+
+// textValuePrefix returns the metrics name prefix of the measurement
+func textValuePrefix(measurement string) string {
+	if !strings.HasSuffix(measurement, "_") {
+		return fmt.Sprintf("%s_", measurement)
+	}
+	return measurement
+}
+
+// textValueTimeIndex maps the start timestamp of each duration_seconds sample to
+// its 1-based occurrence index, other samples are grouped by this index.
+func textValueTimeIndex(matrix model.Matrix) map[int64]int {
+	startTsToTimeIdx := make(map[int64]int)
+	for _, sample := range matrix {
+		if sample.Metric["type"] != TextValueTypeDuration {
+			continue
+		}
+		for idx, pair := range sample.Values {
+			startTsToTimeIdx[pair.Timestamp.Unix()] = idx + 1
+		}
+	}
+	return startTsToTimeIdx
+}
+
+func (api *ReportAPI) QueryDynamicTextValueV2(ctx context.Context, param *QueryDynamicTextValueParam) (QueryDynamicTextValueData, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.QueryDynamicTextValueV2")
+	defer span.End()
+	tr, err := api.timeRender(param.TiDBClusterID, &param.TimeFormatParam)
+	if err != nil {
+		return nil, err
+	}
+	matrix, err := api.queryDynamicTextMatrix(ctx, param)
+	if api.fallbackToInfluxDB(ctx, err) {
+		return api.QueryDynamicTextValue(ctx, param)
+	}
+	if err != nil {
+		return nil, err
 	}
 	data := make(QueryDynamicTextValueData)
 	if len(param.Default1) > 0 {
@@ -432,20 +914,11 @@ func (api *ReportAPI) QueryDynamicTextValueV2(ctx context.Context, param *QueryD
 	if len(matrix) == 0 {
 		return data, nil
 	}
-	perfix := param.Measurement
-	if !strings.HasSuffix(perfix, "_") {
-		perfix = fmt.Sprintf("%s_", perfix)
-	}
+	_, flattenSpan := startSpan(ctx, "flatten", attribute.Int("series", len(matrix)))
+	defer flattenSpan.End()
+	perfix := textValuePrefix(param.Measurement)
 	instanceCnt := make(map[string]int)
-	startTsToTimeIdx := make(map[int64]int)
-	for _, sample := range matrix {
-		if sample.Metric["type"] != "duration_seconds" {
-			continue
-		}
-		for idx, pair := range sample.Values {
-			startTsToTimeIdx[pair.Timestamp.Unix()] = idx + 1
-		}
-	}
+	startTsToTimeIdx := textValueTimeIndex(matrix)
 
 	for _, sample := range matrix {
 		metricsName := string(sample.Metric["__name__"])
@@ -466,13 +939,7 @@ func (api *ReportAPI) QueryDynamicTextValueV2(ctx context.Context, param *QueryD
 				continue
 			}
 			switch sample.Metric["type"] {
-			case "float":
-				key := fmt.Sprintf("%s_time_%d", fieldName, idx)
-				data[key] = float64(value)
-			case "int":
-				key := fmt.Sprintf("%s_time_%d", fieldName, idx)
-				data[key] = int64(value)
-			case "duration_seconds":
+			case TextValueTypeDuration:
 				key := fmt.Sprintf("%s_%d", fieldName, idx)
 				seconds := int64(value)
 				startUnix := pair.Timestamp.Unix()
@@ -480,13 +947,9 @@ func (api *ReportAPI) QueryDynamicTextValueV2(ctx context.Context, param *QueryD
 				data[key] = 1
 				data[fmt.Sprintf("%s_start_unix", key)] = startUnix
 				data[fmt.Sprintf("%s_end_unix", key)] = endUnix
-				data[fmt.Sprintf("%s_start_unix_rfc3339", key)] = time.Unix(startUnix, 0).Format(time.RFC3339)
-				data[fmt.Sprintf("%s_end_unix_rfc3339", key)] = time.Unix(endUnix, 0).Format(time.RFC3339)
-			case "unix_seconds":
-				key := fmt.Sprintf("%s_time_%d", fieldName, idx)
-				data[key] = int64(value)
-				data[fmt.Sprintf("%s_rfc3339", key)] = time.Unix(int64(value), 0).Format(time.RFC3339)
-			case "address":
+				data[fmt.Sprintf("%s_start_unix_rfc3339", key)] = tr.FormatUnix(startUnix)
+				data[fmt.Sprintf("%s_end_unix_rfc3339", key)] = tr.FormatUnix(endUnix)
+			case TextValueTypeAddress:
 				if value == 0 {
 					continue
 				}
@@ -503,6 +966,10 @@ func (api *ReportAPI) QueryDynamicTextValueV2(ctx context.Context, param *QueryD
 				data[instanceKey] = int64(value)
 			default:
 				key := fmt.Sprintf("%s_time_%d", fieldName, idx)
+				if formatter, ok := api.formatters.Lookup(string(sample.Metric["type"])); ok {
+					formatter.Format(float64(value), tr).Fill(key, data)
+					continue
+				}
 				data[key] = value
 			}
 		}
@@ -510,60 +977,635 @@ func (api *ReportAPI) QueryDynamicTextValueV2(ctx context.Context, param *QueryD
 	return data, nil
 }
 
+// QueryDynamicTextValueV3 returns the same samples as QueryDynamicTextValueV2 but
+// grouped into typed fields, occurrences, duration intervals and instance lists
+// instead of synthesized keys.
+func (api *ReportAPI) QueryDynamicTextValueV3(ctx context.Context, param *QueryDynamicTextValueParam) (*QueryDynamicTextValueV3Data, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.QueryDynamicTextValueV3")
+	defer span.End()
+	tr, err := api.timeRender(param.TiDBClusterID, &param.TimeFormatParam)
+	if err != nil {
+		return nil, err
+	}
+	matrix, err := api.queryDynamicTextMatrix(ctx, param)
+	if err != nil {
+		return nil, err
+	}
+	data := NewQueryDynamicTextValueV3Data(param.Measurement)
+	if len(param.Default1) > 0 {
+		for _, field := range strings.Split(param.Default1, ",") {
+			data.Fields[field] = NewTextValueField(TextValueTypeInt, 1)
+		}
+	}
+	if len(matrix) == 0 {
+		return data, nil
+	}
+	prefix := textValuePrefix(param.Measurement)
+	startTsToTimeIdx := textValueTimeIndex(matrix)
+	occurrences := make(map[int]*TextValueOccurrence)
+
+	for _, sample := range matrix {
+		fieldName := strings.TrimPrefix(string(sample.Metric["__name__"]), prefix)
+		if len(sample.Values) == 0 {
+			continue
+		}
+		valueType := string(sample.Metric["type"])
+		if sample.Metric["aggr"] == "first" {
+			data.Fields[fieldName] = api.newTextValueField(valueType, sample.Values[0].Value, tr)
+			continue
+		}
+
+		for _, pair := range sample.Values {
+			startUnix := pair.Timestamp.Unix()
+			idx, ok := startTsToTimeIdx[startUnix]
+			if !ok {
+				continue
+			}
+			occurrence, ok := occurrences[idx]
+			if !ok {
+				occurrence = NewTextValueOccurrence(idx, startUnix)
+				occurrences[idx] = occurrence
+			}
+			switch valueType {
+			case TextValueTypeDuration:
+				occurrence.Durations[fieldName] = NewDurationInterval(startUnix, int64(pair.Value), tr)
+			case TextValueTypeAddress:
+				if pair.Value == 0 {
+					continue
+				}
+				occurrence.Instances[fieldName] = append(occurrence.Instances[fieldName], &InstanceValue{
+					Address: string(sample.Metric["instance"]),
+					Value:   int64(pair.Value),
+				})
+			default:
+				occurrence.Fields[fieldName] = api.newTextValueField(valueType, pair.Value, tr)
+			}
+		}
+	}
+
+	for _, occurrence := range occurrences {
+		data.Occurrences = append(data.Occurrences, occurrence)
+	}
+	sort.Slice(data.Occurrences, func(i, j int) bool {
+		return data.Occurrences[i].Index < data.Occurrences[j].Index
+	})
+	return data, nil
+}
+
+// newTextValueField builds the typed field and renders its text with the formatter of the type
+func (api *ReportAPI) newTextValueField(valueType string, value model.SampleValue, tr *TimeRender) *TextValueField {
+	field := NewTextValueField(valueType, value)
+	if formatter, ok := api.formatters.Lookup(valueType); ok {
+		field.Text = formatter.Format(float64(value), tr).Text
+	}
+	return field
+}
+
+// QueryDynamicTextValueSchema describes the fields of each measurement found in
+// the time range and where they appear in the v3 response.
+func (api *ReportAPI) QueryDynamicTextValueSchema(ctx context.Context, param *QueryDynamicTextValueParam) ([]*TextValueSchema, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.QueryDynamicTextValueSchema")
+	defer span.End()
+	measurements := strings.Split(param.Measurement, ",")
+	schemas := make([]*TextValueSchema, 0, len(measurements))
+	for _, measurement := range measurements {
+		mParam := *param
+		mParam.Measurement = measurement
+		matrix, err := api.queryDynamicTextMatrix(ctx, &mParam)
+		if err != nil {
+			return nil, err
+		}
+		prefix := textValuePrefix(measurement)
+		schema := &TextValueSchema{
+			Measurement: measurement,
+			Fields:      make([]*TextValueFieldSchema, 0),
+		}
+		seen := make(map[string]struct{})
+		for _, sample := range matrix {
+			metricsName := string(sample.Metric["__name__"])
+			if _, ok := seen[metricsName]; ok {
+				continue
+			}
+			seen[metricsName] = struct{}{}
+			schema.Fields = append(schema.Fields, NewTextValueFieldSchema(
+				strings.TrimPrefix(metricsName, prefix), metricsName,
+				string(sample.Metric["type"]), string(sample.Metric["aggr"])))
+		}
+		sort.Slice(schema.Fields, func(i, j int) bool {
+			return schema.Fields[i].Name < schema.Fields[j].Name
+		})
+		schemas = append(schemas, schema)
+	}
+	return schemas, nil
+}
+
+// ValidateSample checks the sample against the declared schema of its measurement,
+// the returned ParamErrors tell every problem
+func (api *ReportAPI) ValidateSample(param *InsertSampleParam) error {
+	return api.schemas.Validate(param)
+}
+
+// Schemas returns the measurements declared for InsertSample and InsertSampleV2
+func (api *ReportAPI) Schemas() *SchemasData {
+	return api.schemas.Schemas()
+}
+
 // TODO(shenjun): how to handle the error with async write?
 // InsertSample insert time series data in to influxdb
 func (api *ReportAPI) InsertSample(ctx context.Context, param *InsertSampleParam) (*InsertSampleData, error) {
-	log.Info("InsertSample", zap.Any("param", param))
+	ctx, span := startSpan(ctx, "ReportAPI.InsertSample")
+	defer span.End()
+	Logger(ctx).Debug("InsertSample", zap.Any("param", param))
 	ts := time.Unix(param.Timestamp, 0)
 	point := influxdb2.NewPoint(param.Measurement, param.GetTags(), param.Fields, ts)
-	api.writeAPI.WritePoint(point)
+	api.samples.add(param.TiDBClusterID, point)
+	atomic.AddInt64(&api.writes.accepted, 1)
 	return &InsertSampleData{}, nil
 }
 
 // InsertSampleV2 insert time series data in to victoria metrics no need to call flush
 // the metrics will be saved as <measurement>_<field_name> and value will be <field_value>
 func (api *ReportAPI) InsertSampleV2(ctx context.Context, param *InsertSampleParam) (*InsertSampleData, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.InsertSampleV2")
+	defer span.End()
 	ts := time.Unix(param.Timestamp, 0)
 	point := influxdb2.NewPoint(param.Measurement, param.GetTags(), param.Fields, ts)
+	if err := api.writeVM(ctx, point); err != nil {
+		return nil, err
+	}
+	return &InsertSampleData{}, nil
+}
+
+// writeVM write the point to victoria metrics through the influx line protocol
+func (api *ReportAPI) writeVM(ctx context.Context, point *write.Point) error {
 	payload, err := encodePoints(point)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	log.Info("InsertSampleV2", zap.String("payload", payload))
+	Logger(ctx).Debug("writeVM", zap.String("payload", payload))
 	u := fmt.Sprintf("%s%s", api.vmEndpoint, "/influx/api/v2/write")
+	return api.doVMRequest(ctx, http.MethodPost, u, strings.NewReader(payload))
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(payload))
+// deleteVMSeries delete all series matching the selector from victoria metrics
+func (api *ReportAPI) deleteVMSeries(ctx context.Context, selector string) error {
+	u := fmt.Sprintf("%s%s?%s", api.vmEndpoint, "/api/v1/admin/tsdb/delete_series",
+		url.Values{"match[]": {selector}}.Encode())
+	return api.doVMRequest(ctx, http.MethodPost, u, nil)
+}
+
+// listVMSeries returns the labels of the series matching the selector in the whole retention
+func (api *ReportAPI) listVMSeries(ctx context.Context, selector string) ([]map[string]string, error) {
+	u := fmt.Sprintf("%s%s", api.vmEndpoint, "/api/v1/series")
+	payload := url.Values{
+		"match[]": {selector},
+		"start":   {"0"},
+	}
+	var series []map[string]string
+	err := api.vmUpstream.Do(ctx, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(payload.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		setRequestIDHeader(ctx, req)
+		resp, err := api.httpCli.Do(req)
+		if err != nil {
+			Logger(ctx).Error("do request failed", zap.Error(err))
+			return err
+		}
+		defer func() {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}()
+		if resp.StatusCode/100 != 2 {
+			Logger(ctx).Error("response is not ok", zap.String("status", resp.Status))
+			return &upstreamStatusError{StatusCode: resp.StatusCode}
+		}
+		result := struct {
+			Data []map[string]string `json:"data"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return err
+		}
+		series = result.Data
+		return nil
+	})
+	return series, err
+}
+
+func (api *ReportAPI) doVMRequest(ctx context.Context, method string, u string, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
 	if err != nil {
-		log.Error("new request failed", zap.Error(err))
-		return nil, err
+		Logger(ctx).Error("new request failed", zap.Error(err))
+		return err
 	}
+	setRequestIDHeader(ctx, req)
 	resp, err := api.httpCli.Do(req)
 	if err != nil {
-		log.Error("do request failed", zap.Error(err))
-		return nil, err
+		Logger(ctx).Error("do request failed", zap.Error(err))
+		return err
 	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
 	if resp.StatusCode/100 != 2 {
-		log.Error("response is not ok", zap.String("status", resp.Status))
-		return nil, fmt.Errorf("response status is %v", resp.StatusCode)
+		Logger(ctx).Error("response is not ok", zap.String("status", resp.Status))
+		return &upstreamStatusError{StatusCode: resp.StatusCode}
 	}
-	return &InsertSampleData{}, nil
+	return nil
 }
 
-func (api *ReportAPI) Flush(ctx context.Context) error {
-	api.writeAPI.Flush()
-	return nil
+// CreateAnnotation stores the annotation in the active backend with a new id
+func (api *ReportAPI) CreateAnnotation(ctx context.Context, param *AnnotationParam) (*AnnotationData, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.CreateAnnotation")
+	defer span.End()
+	id, err := NewAnnotationID()
+	if err != nil {
+		return nil, err
+	}
+	param.ID = id
+	if err := api.writeAnnotation(ctx, param); err != nil {
+		return nil, err
+	}
+	return &AnnotationData{ID: param.ID}, nil
 }
 
-// writeErrorLoop drain all write error for async write
-func (api *ReportAPI) writeErrorLoop() {
-	for {
-		select {
-		case <-api.done:
-			return
-		case err := <-api.writeErrCh:
-			log.Error("write point failed", zap.Error(err))
+// UpdateAnnotation replaces the annotation with the same id, ErrAnnotationNotFound
+// is returned when the id is unknown. The new revision is written before the old
+// ones are deleted, so a failed write keeps the annotation.
+func (api *ReportAPI) UpdateAnnotation(ctx context.Context, param *AnnotationParam) (*AnnotationData, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.UpdateAnnotation")
+	defer span.End()
+	revisions, err := api.annotationRevisions(ctx, param.TiDBClusterID, param.Measurement, param.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := api.writeAnnotation(ctx, param); err != nil {
+		return nil, err
+	}
+	for _, revision := range revisions {
+		if err := api.deleteAnnotation(ctx, param.TiDBClusterID, param.Measurement, param.ID, &revision); err != nil {
+			return nil, err
 		}
 	}
+	return &AnnotationData{ID: param.ID}, nil
+}
+
+// writeAnnotation writes the annotation with a new revision
+func (api *ReportAPI) writeAnnotation(ctx context.Context, param *AnnotationParam) error {
+	revision, err := newRandomID(4)
+	if err != nil {
+		return err
+	}
+	param.Revision = revision
+	point := influxdb2.NewPoint(param.Measurement, param.GetTags(), param.GetFields(), param.GetTime())
+	if api.annotationBackend == AnnotationBackendVM {
+		return api.writeVM(ctx, point)
+	}
+	return api.blockingCli.WriteAPIBlocking(api.org, api.bucket).WritePoint(ctx, point)
+}
+
+// maxInfluxTime is the latest time influxdb stores, the annotations are looked up
+// and deleted up to it as the id does not tell the time
+var maxInfluxTime = time.Unix(0, math.MaxInt64-1)
+
+// DeleteAnnotation removes the annotation with the id from the active backend,
+// ErrAnnotationNotFound is returned when the id is unknown
+func (api *ReportAPI) DeleteAnnotation(ctx context.Context, clusterID string, measurement string, id string) error {
+	ctx, span := startSpan(ctx, "ReportAPI.DeleteAnnotation")
+	defer span.End()
+	if len(measurement) == 0 {
+		measurement = "fast_tune_anomaly"
+	}
+	if _, err := api.annotationRevisions(ctx, clusterID, measurement, id); err != nil {
+		return err
+	}
+	return api.deleteAnnotation(ctx, clusterID, measurement, id, nil)
+}
+
+// annotationRevisions returns the revisions stored for the annotation, the ones
+// written before the revision tag are empty. ErrAnnotationNotFound is returned
+// when there is none.
+func (api *ReportAPI) annotationRevisions(ctx context.Context, clusterID string, measurement string, id string) ([]string, error) {
+	// the values are put into the selector and the predicate as is
+	if err := ValidateAnnotationKey(clusterID, measurement, id); err != nil {
+		return nil, err
+	}
+	if len(id) == 0 {
+		return nil, ErrAnnotationNotFound
+	}
+	seen := make(map[string]struct{})
+	if api.annotationBackend == AnnotationBackendVM {
+		series, err := api.listVMSeries(ctx, annotationSelector(clusterID, measurement, id, nil))
+		if err != nil {
+			return nil, err
+		}
+		for _, labels := range series {
+			seen[labels["revision"]] = struct{}{}
+		}
+	} else {
+		fluxQuery := fmt.Sprintf(`
+from(bucket: "%s")
+	|> range(start: 0, stop: %s)
+	|> filter(fn:(r) => r._measurement == "%s" and r.tidb_cluster_id == "%s" and r.annotation_id == "%s")
+	|> group(columns: ["revision"])
+	|> limit(n: 1)
+`, api.bucket, maxInfluxTime.UTC().Format(time.RFC3339Nano), measurement, clusterID, id)
+		records, err := api.queryFlux(ctx, fluxQuery)
+		if err != nil {
+			return nil, err
+		}
+		for _, rd := range records {
+			revision, _ := rd.ValueByKey("revision").(string)
+			seen[revision] = struct{}{}
+		}
+	}
+	if len(seen) == 0 {
+		return nil, ErrAnnotationNotFound
+	}
+	revisions := make([]string, 0, len(seen))
+	for revision := range seen {
+		if !revisionPattern.MatchString(revision) {
+			return nil, fmt.Errorf("annotation %s has an invalid revision %q", id, revision)
+		}
+		revisions = append(revisions, revision)
+	}
+	sort.Strings(revisions)
+	return revisions, nil
+}
+
+// deleteAnnotation deletes one revision of the annotation, all of them when revision is nil
+func (api *ReportAPI) deleteAnnotation(ctx context.Context, clusterID string, measurement string, id string, revision *string) error {
+	if api.annotationBackend == AnnotationBackendVM {
+		return api.deleteVMSeries(ctx, annotationSelector(clusterID, measurement, id, revision))
+	}
+	predicate := fmt.Sprintf(`_measurement="%s" AND tidb_cluster_id="%s" AND annotation_id="%s"`, measurement, clusterID, id)
+	if revision != nil {
+		predicate += fmt.Sprintf(` AND revision="%s"`, *revision)
+	}
+	return api.influxCli.DeleteAPI().DeleteWithName(ctx, api.org, api.bucket, time.Unix(0, 0), maxInfluxTime, predicate)
+}
+
+// annotationSelector matches the series of the annotation, revision="" matches
+// the series without the revision label
+func annotationSelector(clusterID string, measurement string, id string, revision *string) string {
+	selector := fmt.Sprintf(`{__name__=~"%s.*",tidb_cluster_id="%s",annotation_id="%s"`, measurement, clusterID, id)
+	if revision != nil {
+		selector += fmt.Sprintf(`,revision="%s"`, *revision)
+	}
+	return selector + "}"
+}
+
+// GrafanaDashboard generates the grafana dashboard json of the cluster and diagnosis tree
+func (api *ReportAPI) GrafanaDashboard(ctx context.Context, param *GrafanaDashboardParam) (*GrafanaDashboard, error) {
+	_, span := startSpan(ctx, "ReportAPI.GrafanaDashboard")
+	defer span.End()
+	tree, err := api.Tree(param.Tree)
+	if err != nil {
+		return nil, err
+	}
+	return NewGrafanaDashboard(api.grafana, tree, param), nil
+}
+
+// BuildReport assembles the node graph, the anomaly timeline and the diagnosis
+// overview of the cluster in the time range.
+func (api *ReportAPI) BuildReport(ctx context.Context, param *ReportParam) (*ReportData, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.BuildReport")
+	defer span.End()
+	tr, err := api.timeRender(param.TiDBClusterID, &param.TimeFormatParam)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := api.Tree(param.Tree)
+	if err != nil {
+		return nil, err
+	}
+	graph, err := api.QueryNodeGraphV2(ctx, &QueryNodeGraphParam{
+		TsRange:       param.TsRange,
+		TiDBClusterID: param.TiDBClusterID,
+		Tree:          tree.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	timeline, err := api.QueryAnnotationsV2(ctx, &QueryAnnotationsParam{
+		TsRange:         param.TsRange,
+		TimeFormatParam: param.TimeFormatParam,
+		TiDBClusterID:   param.TiDBClusterID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	overview, err := api.QueryDynamicTextValueV3(ctx, &QueryDynamicTextValueParam{
+		TsRange:         param.TsRange,
+		TimeFormatParam: param.TimeFormatParam,
+		TiDBClusterID:   param.TiDBClusterID,
+		Measurement:     "diagnosis_overview",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ReportData{
+		TiDBClusterID: param.TiDBClusterID,
+		Tree:          tree.Name,
+		Start:         tr.FormatUnix(param.StartTS),
+		End:           tr.FormatUnix(param.EndTS),
+		GeneratedAt:   tr.Format(time.Now()),
+		Path:          RankDiagnosisPath(graph),
+		Timeline:      timeline,
+		Overview:      overview,
+		NodeGraph:     graph,
+		NodeGraphSVG:  string(RenderNodeGraphSVG(graph)),
+	}, nil
+}
+
+// RenderReport renders the report as markdown or html, returns the document and its content type
+func (api *ReportAPI) RenderReport(ctx context.Context, param *ReportParam) ([]byte, string, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.RenderReport")
+	defer span.End()
+	data, err := api.BuildReport(ctx, param)
+	if err != nil {
+		return nil, "", err
+	}
+	return api.reportRenderer.Render(param.Format, data)
+}
+
+// RenderNodeGraph queries the node graph v2 and draws it as svg or png
+func (api *ReportAPI) RenderNodeGraph(ctx context.Context, param *RenderNodeGraphParam) ([]byte, string, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.RenderNodeGraph")
+	defer span.End()
+	data, err := api.QueryNodeGraphV2(ctx, &param.QueryNodeGraphParam)
+	if err != nil {
+		return nil, "", err
+	}
+	return RenderNodeGraph(param.Format, data)
+}
+
+// QueryNodeGraphTimeline evaluates the node graph v2 over every step of the range.
+// The full windows are evaluated by one range query at their ends, a shorter last
+// window is queried on its own.
+func (api *ReportAPI) QueryNodeGraphTimeline(ctx context.Context, param *NodeGraphTimelineParam) (*NodeGraphTimelineData, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.QueryNodeGraphTimeline")
+	defer span.End()
+	tree, err := api.Tree(param.Tree)
+	if err != nil {
+		return nil, err
+	}
+	windows := param.Split()
+	slices := make([]*NodeGraphSlice, 0, len(windows))
+	step := int64(param.Step / time.Second)
+	full := windows
+	if n := len(windows); n > 0 && windows[n-1].EndTS-windows[n-1].StartTS < step {
+		full = windows[:n-1]
+	}
+	if len(full) > 0 {
+		selector := fmt.Sprintf(`{__name__=~"fast_tune_similarity.*",tidb_cluster_id="%s"}`, param.TiDBClusterID)
+		queryExpr := RollUpPromQL(tree.RollUp(param.Agg), selector, fmt.Sprintf("%ds", step))
+		v, err := api.queryMetricsRange(ctx, queryExpr, full[0].EndTS, full[len(full)-1].EndTS, param.Step)
+		if err != nil {
+			return nil, err
+		}
+		matrix, ok := v.(model.Matrix)
+		if !ok {
+			Logger(ctx).Error("convert to matrix failed", zap.Any("value", v))
+			return nil, fmt.Errorf("type %T is not model.Matrix", v)
+		}
+		// the point at the end of a window is the roll-up of that window
+		vectors := make(map[int64]model.Vector, len(full))
+		for _, stream := range matrix {
+			for _, pair := range stream.Values {
+				ts := pair.Timestamp.Unix()
+				vectors[ts] = append(vectors[ts], &model.Sample{Metric: stream.Metric, Value: pair.Value, Timestamp: pair.Timestamp})
+			}
+		}
+		for _, window := range full {
+			slices = append(slices, &NodeGraphSlice{TsRange: window, NodeGraph: newNodeGraphV2(ctx, tree, vectors[window.EndTS])})
+		}
+	}
+	if len(full) < len(windows) {
+		// keep the agg and the other params of the request, only the range differs
+		windowParam := param.QueryNodeGraphParam
+		windowParam.TsRange = windows[len(windows)-1]
+		data, err := api.QueryNodeGraphV2(ctx, &windowParam)
+		if err != nil {
+			return nil, err
+		}
+		slices = append(slices, &NodeGraphSlice{TsRange: windowParam.TsRange, NodeGraph: data})
+	}
+	return NewNodeGraphTimelineData(param.Step, slices), nil
+}
+
+// CompareNodeGraph queries the node graph v2 of both ranges and merges them into one
+func (api *ReportAPI) CompareNodeGraph(ctx context.Context, param *CompareNodeGraphParam) (*CompareNodeGraphData, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.CompareNodeGraph")
+	defer span.End()
+	base, err := api.QueryNodeGraphV2(ctx, &param.Base)
+	if err != nil {
+		return nil, err
+	}
+	compare, err := api.QueryNodeGraphV2(ctx, &param.Compare)
+	if err != nil {
+		return nil, err
+	}
+	return CompareNodeGraphs(base, compare), nil
+}
+
+// CreateSession snapshots the node graph, annotations and text values of the range
+// into the session store, the snapshot can be read back by its id later.
+func (api *ReportAPI) CreateSession(ctx context.Context, param *SessionParam) (*Session, error) {
+	ctx, span := startSpan(ctx, "ReportAPI.CreateSession")
+	defer span.End()
+	tree, err := api.Tree(param.Tree)
+	if err != nil {
+		return nil, err
+	}
+	measurements := param.Measurements
+	if len(measurements) == 0 {
+		measurements = api.grafana.TextMeasurements
+	}
+	if len(measurements) == 0 {
+		measurements = []string{"diagnosis_overview"}
+	}
+	id, err := NewSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		SessionSummary: SessionSummary{
+			ID:            id,
+			Link:          "/sessions/" + id,
+			Title:         param.Title,
+			TiDBClusterID: param.TiDBClusterID,
+			Tree:          tree.Name,
+			StartTS:       param.StartTS,
+			EndTS:         param.EndTS,
+			CreatedAt:     time.Now().Unix(),
+		},
+		TextValues: make(map[string]*QueryDynamicTextValueV3Data, len(measurements)),
+	}
+	session.NodeGraph, err = api.QueryNodeGraphV2(ctx, &QueryNodeGraphParam{
+		TsRange:       param.TsRange,
+		TiDBClusterID: param.TiDBClusterID,
+		Tree:          tree.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	session.Annotations, err = api.QueryAnnotationsV2(ctx, &QueryAnnotationsParam{
+		TsRange:         param.TsRange,
+		TimeFormatParam: param.TimeFormatParam,
+		TiDBClusterID:   param.TiDBClusterID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, measurement := range measurements {
+		data, err := api.QueryDynamicTextValueV3(ctx, &QueryDynamicTextValueParam{
+			TsRange:         param.TsRange,
+			TimeFormatParam: param.TimeFormatParam,
+			TiDBClusterID:   param.TiDBClusterID,
+			Measurement:     measurement,
+		})
+		if err != nil {
+			return nil, err
+		}
+		session.TextValues[measurement] = data
+	}
+	if err := api.sessions.Save(session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// GetSession returns the saved session, ErrSessionNotFound when the id is unknown
+func (api *ReportAPI) GetSession(ctx context.Context, id string) (*Session, error) {
+	_, span := startSpan(ctx, "ReportAPI.GetSession")
+	defer span.End()
+	return api.sessions.Load(id)
+}
+
+func (api *ReportAPI) ListSessions(ctx context.Context, clusterID string) ([]*SessionSummary, error) {
+	_, span := startSpan(ctx, "ReportAPI.ListSessions")
+	defer span.End()
+	return api.sessions.List(clusterID)
+}
+
+// InflightQueries returns the upstream queries currently running and their waiter counts
+func (api *ReportAPI) InflightQueries() []InflightQuery {
+	return api.queryGroup.Inflight()
+}
+
+// writeErrorLoop drain all write error for async write, it returns when the
+// write api is closed
+func (api *ReportAPI) writeErrorLoop() {
+	defer close(api.loopDone)
+	for err := range api.writeErrCh {
+		atomic.AddInt64(&api.writes.failedBatches, 1)
+		log.Error("write point failed", zap.Error(err))
+	}
 }
 
 func retryCallBack(batch string, err http2.Error, retryAttempts uint) bool {
@@ -592,12 +1634,13 @@ func NewDataAPI(endpoint string) (*DataAPI, error) {
 		req.URL.Scheme = "http"
 		req.URL.Host = u.Host
 		req.URL.Path = "/api/v1/query_range"
+		setRequestIDHeader(req.Context(), req)
 	}
 
 	dAPI := &DataAPI{
 		endpoint:     endpoint,
 		host:         u.Host,
-		reserveProxy: &httputil.ReverseProxy{Director: director},
+		reserveProxy: &httputil.ReverseProxy{Director: director, Transport: newTracingTransport(nil)},
 	}
 
 	return dAPI, nil
@@ -4,7 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -90,7 +94,7 @@ func TestReportAPI_InsertSample(t *testing.T) {
 		_, err = rAPI.InsertSample(ctx, sampleParam)
 		assert.Nil(err)
 	}
-	err = rAPI.Flush(ctx)
+	_, err = rAPI.Flush(ctx, "")
 	assert.Nil(err)
 }
 
@@ -120,3 +124,150 @@ func TestReportAPI_QueryNodeGraph(t *testing.T) {
 	assert.Nil(err)
 	t.Log(string(bs))
 }
+
+// newTestTextValueAPI serves the matrix to the dynamic text value queries
+func newTestTextValueAPI(t *testing.T, matrix *model.Matrix) *ReportAPI {
+	vm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		bs, err := json.Marshal(matrix)
+		require.Nil(t, err)
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":%s}}`, bs)
+	}))
+	t.Cleanup(vm.Close)
+	reportAPI, err := NewReportAPI("http://127.0.0.1:0", "org", "bucket", "token", WithVMOption(vm.URL),
+		WithSessionOption(&SessionConfig{Dir: filepath.Join(t.TempDir(), "sessions")}))
+	require.Nil(t, err)
+	t.Cleanup(reportAPI.Close)
+	return reportAPI
+}
+
+func textValueStream(name string, labels model.LabelSet, values ...float64) *model.SampleStream {
+	metric := model.Metric{"__name__": model.LabelValue(name), "tidb_cluster_id": "clinic"}
+	for k, v := range labels {
+		metric[k] = v
+	}
+	stream := &model.SampleStream{Metric: metric}
+	// values are pairs of unix seconds and sample value
+	for i := 0; i+1 < len(values); i += 2 {
+		stream.Values = append(stream.Values, model.SamplePair{
+			Timestamp: model.TimeFromUnix(int64(values[i])), Value: model.SampleValue(values[i+1])})
+	}
+	return stream
+}
+
+func TestReportAPI_QueryDynamicTextValueV3(t *testing.T) {
+	duration := model.LabelSet{"type": TextValueTypeDuration}
+	cases := []struct {
+		name     string
+		matrix   model.Matrix
+		default1 string
+		want     *QueryDynamicTextValueV3Data
+	}{
+		{
+			name:     "empty matrix keeps default_1",
+			default1: "flag",
+			want: &QueryDynamicTextValueV3Data{
+				Measurement: "diag",
+				Fields:      map[string]*TextValueField{"flag": {Type: TextValueTypeInt, Value: 1}},
+				Occurrences: []*TextValueOccurrence{},
+			},
+		},
+		{
+			name: "aggr first goes to fields",
+			matrix: model.Matrix{
+				textValueStream("diag_total", model.LabelSet{"aggr": "first", "type": TextValueTypeInt}, 100, 42.9, 200, 43),
+				textValueStream("diag_ratio", model.LabelSet{"aggr": "first"}, 100, 0.5),
+				textValueStream("diag_empty", model.LabelSet{"aggr": "first"}),
+			},
+			want: &QueryDynamicTextValueV3Data{
+				Measurement: "diag",
+				Fields: map[string]*TextValueField{
+					"total": {Type: TextValueTypeInt, Value: 42},
+					"ratio": {Type: TextValueTypeFloat, Value: 0.5},
+				},
+				Occurrences: []*TextValueOccurrence{},
+			},
+		},
+		{
+			name: "samples are grouped by the duration start",
+			matrix: model.Matrix{
+				textValueStream("diag_qps", nil, 200, 2.5, 100, 1.5, 300, 9),
+				textValueStream("diag_count", model.LabelSet{"type": TextValueTypeInt}, 200, 3.7),
+				textValueStream("diag_instance", model.LabelSet{"type": TextValueTypeAddress, "instance": "tikv-0"}, 100, 0, 200, 4),
+				textValueStream("diag_instance", model.LabelSet{"type": TextValueTypeAddress, "instance": "tikv-1"}, 200, 5),
+				textValueStream("diag_start", duration, 100, 60, 200, 30),
+			},
+			want: &QueryDynamicTextValueV3Data{
+				Measurement: "diag",
+				Fields:      map[string]*TextValueField{},
+				Occurrences: []*TextValueOccurrence{
+					{
+						Index:     1,
+						Timestamp: 100,
+						Fields:    map[string]*TextValueField{"qps": {Type: TextValueTypeFloat, Value: 1.5}},
+						Durations: map[string]*DurationInterval{"start": {Seconds: 60, StartUnix: 100, EndUnix: 160}},
+						Instances: map[string][]*InstanceValue{},
+					},
+					{
+						Index:     2,
+						Timestamp: 200,
+						Fields: map[string]*TextValueField{
+							"qps":   {Type: TextValueTypeFloat, Value: 2.5},
+							"count": {Type: TextValueTypeInt, Value: 3},
+						},
+						Durations: map[string]*DurationInterval{"start": {Seconds: 30, StartUnix: 200, EndUnix: 230}},
+						Instances: map[string][]*InstanceValue{"instance": {{Address: "tikv-0", Value: 4}, {Address: "tikv-1", Value: 5}}},
+					},
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert := require.New(t)
+			reportAPI := newTestTextValueAPI(t, &c.matrix)
+			param := &QueryDynamicTextValueParam{Measurement: "diag", Default1: c.default1}
+			param.TiDBClusterID = "clinic"
+			param.TsRange = TsRange{StartTS: 0, EndTS: 400}
+			data, err := reportAPI.QueryDynamicTextValueV3(context.Background(), param)
+			assert.Nil(err)
+			// the texts depend on the formatters and the timezone, they are covered by their own tests
+			for _, f := range data.Fields {
+				f.Text = ""
+			}
+			for _, o := range data.Occurrences {
+				for _, f := range o.Fields {
+					f.Text = ""
+				}
+				for _, d := range o.Durations {
+					d.Start, d.End = "", ""
+				}
+			}
+			assert.Equal(c.want, data)
+		})
+	}
+}
+
+func TestReportAPI_QueryDynamicTextValueSchema(t *testing.T) {
+	assert := require.New(t)
+	reportAPI := newTestTextValueAPI(t, &model.Matrix{
+		textValueStream("diag_total", model.LabelSet{"aggr": "first", "type": TextValueTypeInt}, 100, 42),
+		textValueStream("diag_qps", nil, 100, 1.5),
+		textValueStream("diag_instance", model.LabelSet{"type": TextValueTypeAddress, "instance": "tikv-0"}, 100, 4),
+		textValueStream("diag_instance", model.LabelSet{"type": TextValueTypeAddress, "instance": "tikv-1"}, 100, 5),
+		textValueStream("diag_start", model.LabelSet{"type": TextValueTypeDuration}, 100, 60),
+	})
+	param := &QueryDynamicTextValueParam{Measurement: "diag"}
+	param.TiDBClusterID = "clinic"
+	param.TsRange = TsRange{StartTS: 0, EndTS: 400}
+	schemas, err := reportAPI.QueryDynamicTextValueSchema(context.Background(), param)
+	assert.Nil(err)
+	assert.Equal([]*TextValueSchema{{
+		Measurement: "diag",
+		Fields: []*TextValueFieldSchema{
+			{Name: "instance", Metric: "diag_instance", Type: TextValueTypeAddress, Section: TextValueSectionInstances},
+			{Name: "qps", Metric: "diag_qps", Type: TextValueTypeFloat, Section: TextValueSectionOccurrence},
+			{Name: "start", Metric: "diag_start", Type: TextValueTypeDuration, Section: TextValueSectionDurations},
+			{Name: "total", Metric: "diag_total", Type: TextValueTypeInt, Aggr: "first", Section: TextValueSectionFields},
+		},
+	}}, schemas)
+}
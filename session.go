@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const defaultSessionDir = "./sessions"
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExists   = errors.New("session already exists")
+)
+
+type SessionParam struct {
+	TsRange
+	TimeFormatParam
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Tree          string `json:"tree,omitempty"`
+	Title         string `json:"title,omitempty"`
+	// Measurements are the dynamic text values to snapshot, default is the ones in grafana config
+	Measurements []string `json:"measurements,omitempty"`
+}
+
+func (param *SessionParam) Validate() error {
+	if param.StartTS == 0 {
+		return errors.New("start_ts is zero")
+	}
+	if param.EndTS == 0 {
+		return errors.New("end_ts is zero")
+	}
+	if len(param.TiDBClusterID) == 0 {
+		return errors.New("tidb_cluster_id is zero")
+	}
+	return param.validateTimeFormat()
+}
+
+// SessionSummary is the part of a session listed by /sessions
+type SessionSummary struct {
+	ID            string `json:"id"`
+	Link          string `json:"link"`
+	Title         string `json:"title,omitempty"`
+	TiDBClusterID string `json:"tidb_cluster_id"`
+	Tree          string `json:"tree"`
+	StartTS       int64  `json:"start_ts"`
+	EndTS         int64  `json:"end_ts"`
+	// CreatedAt is in unix seconds
+	CreatedAt int64 `json:"created_at"`
+}
+
+// Session is the snapshot of a diagnosis, it never changes once saved
+type Session struct {
+	SessionSummary
+	NodeGraph   *QueryNodeGraphData                     `json:"node_graph"`
+	Annotations QueryAnnotationsData                    `json:"annotations"`
+	TextValues  map[string]*QueryDynamicTextValueV3Data `json:"text_values"`
+}
+
+// SessionStore persists the sessions, saving a session with an existing id fails
+type SessionStore interface {
+	Save(session *Session) error
+	Load(id string) (*Session, error)
+	// List returns the sessions of the cluster, or all when clusterID is empty, newest first
+	List(clusterID string) ([]*SessionSummary, error)
+}
+
+// FileSessionStore keeps every session as a json file named by its id, with its
+// summary in a small file next to it so listing does not read the snapshots
+type FileSessionStore struct {
+	dir string
+}
+
+// NewSessionID returns a random id of the session
+func NewSessionID() (string, error) {
+	return newRandomID(8)
+}
+
+func NewFileSessionStore(dir string) *FileSessionStore {
+	if len(dir) == 0 {
+		dir = defaultSessionDir
+	}
+	return &FileSessionStore{dir: dir}
+}
+
+// path returns the file of the session, ids are hex so they can not escape the dir
+func (s *FileSessionStore) path(id string) (string, error) {
+	if len(id) == 0 {
+		return "", ErrSessionNotFound
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", ErrSessionNotFound
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+const sessionSummarySuffix = ".summary.json"
+
+func (s *FileSessionStore) summaryPath(id string) string {
+	return filepath.Join(s.dir, id+sessionSummarySuffix)
+}
+
+func (s *FileSessionStore) Save(session *Session) error {
+	path, err := s.path(session.ID)
+	if err != nil {
+		return fmt.Errorf("session id %q is invalid", session.ID)
+	}
+	bs, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	// write to a temp file then link it, so readers never see a partial session
+	// and an existing one is never replaced
+	tmp, err := s.writeTemp(bs)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := os.Link(tmp, path); err != nil {
+		if os.IsExist(err) {
+			return ErrSessionExists
+		}
+		return err
+	}
+	// the session is saved, List falls back to the snapshot when the summary is missing
+	if err := s.saveSummary(&session.SessionSummary); err != nil {
+		log.Warn("save session summary failed", zap.String("id", session.ID), zap.Error(err))
+	}
+	return nil
+}
+
+func (s *FileSessionStore) saveSummary(summary *SessionSummary) error {
+	bs, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	tmp, err := s.writeTemp(bs)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Rename(tmp, s.summaryPath(summary.ID))
+}
+
+// writeTemp writes bs to a synced temp file in the dir and returns its path
+func (s *FileSessionStore) writeTemp(bs []byte) (string, error) {
+	tmp, err := os.CreateTemp(s.dir, ".session-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+func (s *FileSessionStore) Load(id string) (*Session, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	if err := json.Unmarshal(bs, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *FileSessionStore) List(clusterID string) ([]*SessionSummary, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return []*SessionSummary{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]*SessionSummary, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") ||
+			strings.HasSuffix(name, sessionSummarySuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(name, ".json")
+		summary, err := s.loadSummary(id)
+		if err != nil {
+			// one broken session does not hide the others
+			log.Warn("load session summary failed", zap.String("id", id), zap.Error(err))
+			continue
+		}
+		if len(clusterID) > 0 && summary.TiDBClusterID != clusterID {
+			continue
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		if summaries[i].CreatedAt != summaries[j].CreatedAt {
+			return summaries[i].CreatedAt > summaries[j].CreatedAt
+		}
+		return summaries[i].ID < summaries[j].ID
+	})
+	return summaries, nil
+}
+
+// loadSummary reads the summary file of the session, the sessions saved without
+// one are read from the snapshot and get their summary written
+func (s *FileSessionStore) loadSummary(id string) (*SessionSummary, error) {
+	summary := &SessionSummary{}
+	bs, err := os.ReadFile(s.summaryPath(id))
+	if err == nil {
+		if err = json.Unmarshal(bs, summary); err == nil {
+			return summary, nil
+		}
+	}
+	if !os.IsNotExist(err) {
+		log.Warn("read session summary failed, fall back to the snapshot", zap.String("id", id), zap.Error(err))
+	}
+	session, err := s.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.saveSummary(&session.SessionSummary); err != nil {
+		log.Warn("save session summary failed", zap.String("id", id), zap.Error(err))
+	}
+	return &session.SessionSummary, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	assert := require.New(t)
+	store := NewFileSessionStore(filepath.Join(t.TempDir(), "sessions"))
+
+	// listing before the first save does not fail
+	summaries, err := store.List("")
+	assert.Nil(err)
+	assert.Len(summaries, 0)
+
+	newSession := func(id string, clusterID string, createdAt int64) *Session {
+		return &Session{
+			SessionSummary: SessionSummary{ID: id, Link: "/sessions/" + id, TiDBClusterID: clusterID, CreatedAt: createdAt},
+			NodeGraph:      testNodeGraph(),
+			Annotations:    QueryAnnotationsData{{Title: "write stall", Severity: SeverityCritical}},
+			TextValues:     map[string]*QueryDynamicTextValueV3Data{},
+		}
+	}
+	assert.Nil(store.Save(newSession("0a", "c1", 100)))
+	assert.Nil(store.Save(newSession("0b", "c1", 200)))
+	assert.Nil(store.Save(newSession("0c", "c2", 150)))
+	// sessions are immutable
+	assert.Equal(ErrSessionExists, store.Save(newSession("0a", "c2", 300)))
+	assert.NotNil(store.Save(newSession("../0d", "c1", 100)))
+
+	session, err := store.Load("0a")
+	assert.Nil(err)
+	assert.Equal("c1", session.TiDBClusterID)
+	assert.Len(session.NodeGraph.Nodes, len(testNodeGraph().Nodes))
+	assert.Equal(SeverityCritical, session.Annotations[0].Severity)
+
+	for _, id := range []string{"0d", "", "../sessions/0a", "zz"} {
+		_, err = store.Load(id)
+		assert.Equal(ErrSessionNotFound, err, id)
+	}
+
+	summaries, err = store.List("c1")
+	assert.Nil(err)
+	assert.Len(summaries, 2)
+	assert.Equal("0b", summaries[0].ID)
+	summaries, err = store.List("")
+	assert.Nil(err)
+	assert.Len(summaries, 3)
+
+	// no temp file is left behind, every session has its summary
+	entries, err := os.ReadDir(store.dir)
+	assert.Nil(err)
+	assert.Len(entries, 6)
+
+	// the summary is listed without the snapshot
+	assert.Nil(os.WriteFile(filepath.Join(store.dir, "0b.json"), []byte("{broken"), 0644))
+	summaries, err = store.List("c1")
+	assert.Nil(err)
+	assert.Len(summaries, 2)
+	// the session without a summary is read from the snapshot and gets one
+	assert.Nil(os.Remove(filepath.Join(store.dir, "0c.summary.json")))
+	summaries, err = store.List("c2")
+	assert.Nil(err)
+	assert.Len(summaries, 1)
+	assert.FileExists(filepath.Join(store.dir, "0c.summary.json"))
+	// the broken session is skipped instead of failing the listing
+	assert.Nil(os.Remove(filepath.Join(store.dir, "0b.summary.json")))
+	summaries, err = store.List("")
+	assert.Nil(err)
+	assert.Len(summaries, 2)
+
+	// the generated ids are accepted by the store
+	id, err := NewSessionID()
+	assert.Nil(err)
+	assert.Len(id, 16)
+	assert.Nil(store.Save(newSession(id, "c3", 400)))
+	_, err = store.Load(id)
+	assert.Nil(err)
+}
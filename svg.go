@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// node graph drawing sizes in pixels
+const (
+	svgNodeRadius   = 28
+	svgArcWidth     = 6
+	svgLayerSpacing = 140
+	svgNodeSpacing  = 200
+	svgMargin       = 60
+	// number of barycenter sweeps to reduce the edge crossings
+	layoutSweeps = 8
+)
+
+// node graph render formats and their content types
+const (
+	NodeGraphFormatSVG = "svg"
+	NodeGraphFormatPNG = "png"
+)
+
+var nodeGraphContentTypes = map[string]string{
+	NodeGraphFormatSVG: "image/svg+xml",
+	NodeGraphFormatPNG: "image/png",
+}
+
+type RenderNodeGraphParam struct {
+	QueryNodeGraphParam
+	// Format is svg or png, default is svg
+	Format string `json:"format,omitempty"`
+}
+
+func (param *RenderNodeGraphParam) Validate() error {
+	if err := param.QueryNodeGraphParam.Validate(); err != nil {
+		return err
+	}
+	if len(param.Format) == 0 {
+		param.Format = NodeGraphFormatSVG
+	}
+	if _, ok := nodeGraphContentTypes[param.Format]; !ok {
+		return fmt.Errorf("format %q is not supported", param.Format)
+	}
+	return nil
+}
+
+// RenderNodeGraph draws the node graph in the format, returns the image and its content type
+func RenderNodeGraph(format string, data *QueryNodeGraphData) ([]byte, string, error) {
+	switch format {
+	case NodeGraphFormatSVG:
+		return RenderNodeGraphSVG(data), nodeGraphContentTypes[format], nil
+	case NodeGraphFormatPNG:
+		bs, err := RenderNodeGraphPNG(data)
+		if err != nil {
+			return nil, "", err
+		}
+		return bs, nodeGraphContentTypes[format], nil
+	default:
+		return nil, "", errors.New("format is not supported")
+	}
+}
+
+type svgPoint struct {
+	X float64
+	Y float64
+}
+
+// nodeGraphLayout is the position of every node shared by the svg and png renderer
+type nodeGraphLayout struct {
+	Layers [][]*Node
+	Pos    map[string]svgPoint
+	Width  float64
+	Height float64
+}
+
+// layerNodeGraph assigns each node to a layer by the longest path from the roots,
+// so every edge points downward. Nodes in a layer are ordered by id.
+func layerNodeGraph(data *QueryNodeGraphData) [][]*Node {
+	children := make(map[string][]string)
+	indegree := make(map[string]int)
+	nodesLookup := make(map[string]*Node)
+	for _, node := range data.Nodes {
+		nodesLookup[node.ID] = node
+		indegree[node.ID] = 0
+	}
+	for _, edge := range data.Edges {
+		if _, ok := nodesLookup[edge.Source]; !ok {
+			continue
+		}
+		if _, ok := nodesLookup[edge.Target]; !ok {
+			continue
+		}
+		children[edge.Source] = append(children[edge.Source], edge.Target)
+		indegree[edge.Target]++
+	}
+	// kahn's algorithm, the tree is validated to be acyclic
+	depth := make(map[string]int)
+	queue := make([]string, 0)
+	for _, node := range data.Nodes {
+		if indegree[node.ID] == 0 {
+			queue = append(queue, node.ID)
+		}
+	}
+	maxDepth := 0
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, child := range children[id] {
+			if depth[id]+1 > depth[child] {
+				depth[child] = depth[id] + 1
+			}
+			if depth[child] > maxDepth {
+				maxDepth = depth[child]
+			}
+			indegree[child]--
+			if indegree[child] == 0 {
+				queue = append(queue, child)
+			}
+		}
+	}
+	layers := make([][]*Node, maxDepth+1)
+	for _, node := range data.Nodes {
+		d := depth[node.ID]
+		layers[d] = append(layers[d], node)
+	}
+	for _, layer := range layers {
+		sort.Slice(layer, func(i, j int) bool {
+			return layer[i].ID < layer[j].ID
+		})
+	}
+	return layers
+}
+
+// layoutNodeGraph layers the graph and orders every layer by the barycenter of the
+// neighbours, sweeping down and up alternately and keeping the order with the least
+// edge crossings.
+func layoutNodeGraph(data *QueryNodeGraphData) *nodeGraphLayout {
+	layers := layerNodeGraph(data)
+	widest := 1
+	for _, layer := range layers {
+		if len(layer) > widest {
+			widest = len(layer)
+		}
+	}
+	layout := &nodeGraphLayout{
+		Layers: layers,
+		Width:  float64(widest*svgNodeSpacing + 2*svgMargin),
+		Height: float64(len(layers)*svgLayerSpacing + 2*svgMargin),
+	}
+	layout.place()
+
+	parents := make(map[string][]string)
+	children := make(map[string][]string)
+	for _, edge := range data.Edges {
+		if _, ok := layout.Pos[edge.Source]; !ok {
+			continue
+		}
+		if _, ok := layout.Pos[edge.Target]; !ok {
+			continue
+		}
+		parents[edge.Target] = append(parents[edge.Target], edge.Source)
+		children[edge.Source] = append(children[edge.Source], edge.Target)
+	}
+
+	best := layout.snapshot()
+	bestCrossings := layout.crossings(data.Edges)
+	for sweep := 0; sweep < layoutSweeps && bestCrossings > 0; sweep++ {
+		neighbours := parents
+		order := make([]int, 0, len(layers))
+		for i := range layers {
+			order = append(order, i)
+		}
+		if sweep%2 == 1 {
+			neighbours = children
+			for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+				order[i], order[j] = order[j], order[i]
+			}
+		}
+		for _, d := range order {
+			layer := layers[d]
+			barycenter := make(map[string]float64, len(layer))
+			for _, node := range layer {
+				ids := neighbours[node.ID]
+				if len(ids) == 0 {
+					barycenter[node.ID] = layout.Pos[node.ID].X
+					continue
+				}
+				sum := 0.0
+				for _, id := range ids {
+					sum += layout.Pos[id].X
+				}
+				barycenter[node.ID] = sum / float64(len(ids))
+			}
+			sort.SliceStable(layer, func(i, j int) bool {
+				return barycenter[layer[i].ID] < barycenter[layer[j].ID]
+			})
+			layout.placeLayer(d)
+		}
+		if c := layout.crossings(data.Edges); c < bestCrossings {
+			best, bestCrossings = layout.snapshot(), c
+		}
+	}
+	layout.Layers = best
+	layout.place()
+	return layout
+}
+
+func (l *nodeGraphLayout) snapshot() [][]*Node {
+	layers := make([][]*Node, len(l.Layers))
+	for i, layer := range l.Layers {
+		layers[i] = append([]*Node(nil), layer...)
+	}
+	return layers
+}
+
+func (l *nodeGraphLayout) place() {
+	l.Pos = make(map[string]svgPoint)
+	for d := range l.Layers {
+		l.placeLayer(d)
+	}
+}
+
+// placeLayer centers the layer horizontally
+func (l *nodeGraphLayout) placeLayer(d int) {
+	layer := l.Layers[d]
+	offset := (l.Width - float64(len(layer)*svgNodeSpacing)) / 2
+	for i, node := range layer {
+		l.Pos[node.ID] = svgPoint{
+			X: offset + float64(i*svgNodeSpacing) + svgNodeSpacing/2,
+			Y: float64(svgMargin + d*svgLayerSpacing + svgLayerSpacing/2),
+		}
+	}
+}
+
+// crossings counts the pairs of edges intersecting with each other
+func (l *nodeGraphLayout) crossings(edges []*Edge) int {
+	type segment struct{ from, to svgPoint }
+	segments := make([]segment, 0, len(edges))
+	for _, edge := range edges {
+		from, ok := l.Pos[edge.Source]
+		if !ok {
+			continue
+		}
+		to, ok := l.Pos[edge.Target]
+		if !ok {
+			continue
+		}
+		segments = append(segments, segment{from, to})
+	}
+	cross := func(o, a, b svgPoint) float64 {
+		return (a.X-o.X)*(b.Y-o.Y) - (a.Y-o.Y)*(b.X-o.X)
+	}
+	cnt := 0
+	for i := range segments {
+		for j := i + 1; j < len(segments); j++ {
+			s, t := segments[i], segments[j]
+			d1, d2 := cross(s.from, s.to, t.from), cross(s.from, s.to, t.to)
+			d3, d4 := cross(t.from, t.to, s.from), cross(t.from, t.to, s.to)
+			// edges sharing an endpoint do not count
+			if d1*d2 < 0 && d3*d4 < 0 {
+				cnt++
+			}
+		}
+	}
+	return cnt
+}
+
+// arcFraction returns the share of ArcPositive in the ring, -1 when both are zero
+func arcFraction(node *Node) float64 {
+	total := node.ArcPositive + node.ArcNegative
+	if total <= 0 {
+		return -1
+	}
+	return math.Max(0, math.Min(1, node.ArcPositive/total))
+}
+
+// svgArc returns the path of the arc clockwise from angle a0 to a1, 0 is the top
+func svgArc(p svgPoint, r float64, a0 float64, a1 float64) string {
+	x0, y0 := p.X+r*math.Sin(a0), p.Y-r*math.Cos(a0)
+	x1, y1 := p.X+r*math.Sin(a1), p.Y-r*math.Cos(a1)
+	large := 0
+	if a1-a0 > math.Pi {
+		large = 1
+	}
+	return fmt.Sprintf("M %.2f %.2f A %.2f %.2f 0 %d 1 %.2f %.2f", x0, y0, r, r, large, x1, y1)
+}
+
+// RenderNodeGraphSVG draws the node graph top down as a standalone svg document. The
+// ring of a node is split into the ArcPositive and ArcNegative shares like the grafana
+// node graph panel.
+func RenderNodeGraphSVG(data *QueryNodeGraphData) []byte {
+	layout := layoutNodeGraph(data)
+	width, height := layout.Width, layout.Height
+	pos := layout.Pos
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f" font-family="sans-serif">`, width, height, width, height)
+	buf.WriteString(`<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto-start-reverse"><path d="M 0 0 L 10 5 L 0 10 z" fill="#888"/></marker></defs>`)
+	fmt.Fprintf(&buf, `<rect width="100%%" height="100%%" fill="white"/>`)
+	for _, edge := range data.Edges {
+		from, ok := pos[edge.Source]
+		if !ok {
+			continue
+		}
+		to, ok := pos[edge.Target]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&buf, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#888" stroke-width="1.5" marker-end="url(#arrow)"/>`,
+			from.X, from.Y+svgNodeRadius, to.X, to.Y-svgNodeRadius)
+	}
+	ringRadius := float64(svgNodeRadius) - svgArcWidth/2
+	for _, layer := range layout.Layers {
+		for _, node := range layer {
+			p := pos[node.ID]
+			fmt.Fprintf(&buf, `<g><circle cx="%.1f" cy="%.1f" r="%d" fill="white"/>`, p.X, p.Y, svgNodeRadius)
+			switch fraction := arcFraction(node); {
+			case fraction < 0:
+				fmt.Fprintf(&buf, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="none" stroke="#ccc" stroke-width="%d"/>`,
+					p.X, p.Y, ringRadius, svgArcWidth)
+			case fraction == 0 || fraction == 1:
+				color := node.ArcPositiveColor
+				if fraction == 0 {
+					color = node.ArcNegativeColor
+				}
+				fmt.Fprintf(&buf, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="none" stroke="%s" stroke-width="%d"/>`,
+					p.X, p.Y, ringRadius, svgEscape(color), svgArcWidth)
+			default:
+				split := 2 * math.Pi * fraction
+				fmt.Fprintf(&buf, `<path d="%s" fill="none" stroke="%s" stroke-width="%d"/>`,
+					svgArc(p, ringRadius, 0, split), svgEscape(node.ArcPositiveColor), svgArcWidth)
+				fmt.Fprintf(&buf, `<path d="%s" fill="none" stroke="%s" stroke-width="%d"/>`,
+					svgArc(p, ringRadius, split, 2*math.Pi), svgEscape(node.ArcNegativeColor), svgArcWidth)
+			}
+			fmt.Fprintf(&buf, `<text x="%.1f" y="%.1f" text-anchor="middle" font-size="12">%s</text>`,
+				p.X, p.Y+4, svgEscape(node.MainStat))
+			fmt.Fprintf(&buf, `<text x="%.1f" y="%.1f" text-anchor="middle" font-size="11" font-weight="bold">%s</text>`,
+				p.X, p.Y+svgNodeRadius+16, svgEscape(node.Title))
+			fmt.Fprintf(&buf, `<text x="%.1f" y="%.1f" text-anchor="middle" font-size="10" fill="#555">%s</text></g>`,
+				p.X, p.Y+svgNodeRadius+30, svgEscape(node.SubTitle))
+		}
+	}
+	buf.WriteString(`</svg>`)
+	return buf.Bytes()
+}
+
+func svgEscape(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayoutNodeGraph(t *testing.T) {
+	assert := require.New(t)
+	// ordered by id the second layer is b1 b2, which crosses the edges of a1 and a2
+	data := &QueryNodeGraphData{}
+	for _, id := range []string{"a1", "a2", "b1", "b2", "c"} {
+		node := DefaultNode()
+		node.ID = id
+		data.Nodes = append(data.Nodes, node)
+	}
+	data.Edges = []*Edge{
+		{ID: "1", Source: "a1", Target: "b2"},
+		{ID: "2", Source: "a2", Target: "b1"},
+		{ID: "3", Source: "b1", Target: "c"},
+		{ID: "4", Source: "b2", Target: "c"},
+	}
+	layout := layoutNodeGraph(data)
+	assert.Len(layout.Layers, 3)
+	assert.Equal(0, layout.crossings(data.Edges))
+	for _, edge := range data.Edges {
+		assert.Less(layout.Pos[edge.Source].Y, layout.Pos[edge.Target].Y)
+	}
+	assert.Equal(float64(2*svgNodeSpacing+2*svgMargin), layout.Width)
+}
+
+func TestRenderNodeGraphSVG(t *testing.T) {
+	assert := require.New(t)
+	data := testNodeGraph()
+	full := DefaultNode()
+	full.ID = "1"
+	full.ArcPositive = 1
+	data.Nodes = append(data.Nodes, full)
+
+	svg := string(RenderNodeGraphSVG(data))
+	assert.True(strings.HasPrefix(svg, "<svg "))
+	assert.True(strings.HasSuffix(svg, "</svg>"))
+	// split rings have a path per share, the full ring is a circle
+	assert.Equal(len(data.Nodes)-1, strings.Count(svg, `stroke="green"`))
+	assert.Equal(len(data.Nodes), strings.Count(svg, `stroke="red"`))
+	assert.Contains(svg, "title &lt;8637&gt;")
+	assert.Equal(len(data.Edges), strings.Count(svg, "<line "))
+}
+
+func TestRenderNodeGraphPNG(t *testing.T) {
+	assert := require.New(t)
+	data := testNodeGraph()
+	bs, contentType, err := RenderNodeGraph(NodeGraphFormatPNG, data)
+	assert.Nil(err)
+	assert.Equal("image/png", contentType)
+	img, err := png.Decode(bytes.NewReader(bs))
+	assert.Nil(err)
+	layout := layoutNodeGraph(data)
+	assert.Equal(int(layout.Width), img.Bounds().Dx())
+	assert.Equal(int(layout.Height), img.Bounds().Dy())
+
+	// the top of the ring is the positive share, the left of a mostly positive ring too
+	p := layout.Pos["8637"]
+	r, g, b, _ := img.At(int(p.X), int(p.Y-svgNodeRadius+svgArcWidth/2)).RGBA()
+	assert.Equal([3]uint32{0xffff, 0, 0}, [3]uint32{r, g, b})
+	r, g, b, _ = img.At(int(p.X), int(p.Y)+svgNodeRadius+20).RGBA()
+	assert.NotEqual([3]uint32{0xffff, 0xffff, 0xffff}, [3]uint32{r, g, b})
+
+	_, _, err = RenderNodeGraph("gif", data)
+	assert.NotNil(err)
+}
+
+func TestParseColor(t *testing.T) {
+	assert := require.New(t)
+	for s, expect := range map[string]color.RGBA{
+		"red":                     {R: 255, A: 255},
+		" Green ":                 {G: 128, A: 255},
+		"#f80":                    {R: 255, G: 136, A: 255},
+		"#3274d9":                 {R: 50, G: 116, B: 217, A: 255},
+		"rgb(1, 2, 3)":            {R: 1, G: 2, B: 3, A: 255},
+		"rgba(255, 96, 96, 0.5)":  {R: 255, G: 96, B: 96, A: 128},
+		"rgba(50, 116, 217, 1.0)": {R: 50, G: 116, B: 217, A: 255},
+	} {
+		c, err := parseColor(s)
+		assert.Nil(err, s)
+		assert.Equal(expect, c, s)
+	}
+	for _, s := range []string{"", "#12", "#zzzzzz", "rgb(1,2)", "hsl(1,2,3)", "teal"} {
+		_, err := parseColor(s)
+		assert.NotNil(err, s)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// named layouts accepted by the `time_format` param, other values are used as go layout directly
+var namedTimeLayouts = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+	"rfc1123":     time.RFC1123,
+	"rfc1123z":    time.RFC1123Z,
+	"rfc822":      time.RFC822,
+	"kitchen":     time.Kitchen,
+	"datetime":    "2006-01-02 15:04:05",
+	"date":        "2006-01-02",
+	"time":        "15:04:05",
+}
+
+// TimeRender renders the timestamps in dynamic text values and annotations
+type TimeRender struct {
+	Location *time.Location
+	Layout   string
+	// OverrideLocation and OverrideLayout are true when given by the request,
+	// they take precedence over the formatter config.
+	OverrideLocation bool
+	OverrideLayout   bool
+}
+
+// DefaultTimeRender renders RFC3339 in the server local timezone
+func DefaultTimeRender() *TimeRender {
+	return &TimeRender{
+		Location: time.Local,
+		Layout:   time.RFC3339,
+	}
+}
+
+func (tr *TimeRender) Format(t time.Time) string {
+	return t.In(tr.Location).Format(tr.Layout)
+}
+
+// FormatUnix renders the unix timestamp in seconds
+func (tr *TimeRender) FormatUnix(sec int64) string {
+	return tr.Format(time.Unix(sec, 0))
+}
+
+// ParseTimeLayout resolves a named layout or validates a go layout
+func ParseTimeLayout(format string) (string, error) {
+	if layout, ok := namedTimeLayouts[strings.ToLower(format)]; ok {
+		return layout, nil
+	}
+	// a layout without any reference component renders the same constant string
+	if time.Unix(0, 0).UTC().Format(format) == format {
+		return "", fmt.Errorf("time_format %q is neither a named layout nor a go layout", format)
+	}
+	return format, nil
+}
+
+// TimeFormatParam holds the `tz` and `time_format` request params
+type TimeFormatParam struct {
+	TZ         string `json:"tz,omitempty"`
+	TimeFormat string `json:"time_format,omitempty"`
+}
+
+func (param *TimeFormatParam) validateTimeFormat() error {
+	if len(param.TZ) > 0 {
+		if _, err := time.LoadLocation(param.TZ); err != nil {
+			return fmt.Errorf("tz is invalid: %v", err)
+		}
+	}
+	if len(param.TimeFormat) > 0 {
+		if _, err := ParseTimeLayout(param.TimeFormat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewTimeRender builds the render from the request params, falling back to defaultLoc
+func (param *TimeFormatParam) NewTimeRender(defaultLoc *time.Location) (*TimeRender, error) {
+	tr := DefaultTimeRender()
+	if defaultLoc != nil {
+		tr.Location = defaultLoc
+	}
+	if len(param.TZ) > 0 {
+		loc, err := time.LoadLocation(param.TZ)
+		if err != nil {
+			return nil, err
+		}
+		tr.Location = loc
+		tr.OverrideLocation = true
+	}
+	if len(param.TimeFormat) > 0 {
+		layout, err := ParseTimeLayout(param.TimeFormat)
+		if err != nil {
+			return nil, err
+		}
+		tr.Layout = layout
+		tr.OverrideLayout = true
+	}
+	return tr, nil
+}
+
+// toMillis returns the unix timestamp in milliseconds used by grafana
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// secondsToMillis converts a unix timestamp in seconds to milliseconds
+func secondsToMillis(sec float64) int64 {
+	return int64(sec * 1e3)
+}
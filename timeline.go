@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxNodeGraphSlices bounds the windows of one node graph timeline
+const maxNodeGraphSlices = 240
+
+type NodeGraphTimelineParam struct {
+	QueryNodeGraphParam
+	Step time.Duration `json:"step"`
+}
+
+func (param *NodeGraphTimelineParam) Validate() error {
+	if err := param.QueryNodeGraphParam.Validate(); err != nil {
+		return err
+	}
+	if param.EndTS <= param.StartTS {
+		return errors.New("end_ts is not after start_ts")
+	}
+	if param.Step < time.Second {
+		return errors.New("step is less than 1s")
+	}
+	// the windows are counted rather than split, a small step could make millions
+	if n := param.Slices(); n > maxNodeGraphSlices {
+		return fmt.Errorf("step is too small, %d slices exceed the limit %d", n, maxNodeGraphSlices)
+	}
+	return nil
+}
+
+// Slices returns the number of windows of Split
+func (param *NodeGraphTimelineParam) Slices() int64 {
+	step := int64(param.Step / time.Second)
+	if step <= 0 || param.EndTS <= param.StartTS {
+		return 0
+	}
+	return (param.EndTS - param.StartTS + step - 1) / step
+}
+
+// Split cuts the range into consecutive windows of step, the last one ends at EndTS
+// and may be shorter.
+func (param *NodeGraphTimelineParam) Split() []TsRange {
+	step := int64(param.Step / time.Second)
+	if step <= 0 {
+		return nil
+	}
+	ranges := make([]TsRange, 0, (param.EndTS-param.StartTS)/step+1)
+	for start := param.StartTS; start < param.EndTS; start += step {
+		end := start + step
+		if end > param.EndTS {
+			end = param.EndTS
+		}
+		ranges = append(ranges, TsRange{StartTS: start, EndTS: end})
+	}
+	return ranges
+}
+
+// ParseStep parses a duration like 5m or a plain number of seconds
+func ParseStep(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// NodeGraphSlice is the node graph of one window
+type NodeGraphSlice struct {
+	TsRange
+	NodeGraph *QueryNodeGraphData `json:"node_graph"`
+}
+
+type SimilarityPoint struct {
+	// Time is the end of the window in unix milliseconds
+	Time       int64   `json:"time"`
+	Similarity float64 `json:"similarity"`
+}
+
+// NodeSimilaritySeries is the similarity of one node along the windows it shows up in
+type NodeSimilaritySeries struct {
+	ID       string             `json:"id"`
+	Title    string             `json:"title"`
+	SubTitle string             `json:"subTitle"`
+	Points   []*SimilarityPoint `json:"points"`
+}
+
+type NodeGraphTimelineData struct {
+	// Step is in seconds
+	Step   int64                   `json:"step"`
+	Slices []*NodeGraphSlice       `json:"slices"`
+	Series []*NodeSimilaritySeries `json:"series"`
+}
+
+// NewNodeGraphTimelineData collects the per node similarity series from the slices
+func NewNodeGraphTimelineData(step time.Duration, slices []*NodeGraphSlice) *NodeGraphTimelineData {
+	data := &NodeGraphTimelineData{
+		Step:   int64(step / time.Second),
+		Slices: slices,
+		Series: make([]*NodeSimilaritySeries, 0),
+	}
+	lookup := make(map[string]*NodeSimilaritySeries)
+	for _, slice := range slices {
+		for _, node := range slice.NodeGraph.Nodes {
+			series, ok := lookup[node.ID]
+			if !ok {
+				series = &NodeSimilaritySeries{ID: node.ID, Title: node.Title, Points: make([]*SimilarityPoint, 0)}
+				lookup[node.ID] = series
+				data.Series = append(data.Series, series)
+			}
+			if len(series.SubTitle) == 0 {
+				series.SubTitle = node.SubTitle
+			}
+			series.Points = append(series.Points, &SimilarityPoint{
+				Time:       secondsToMillis(float64(slice.EndTS)),
+				Similarity: node.ArcPositive,
+			})
+		}
+	}
+	sort.Slice(data.Series, func(i, j int) bool {
+		return data.Series[i].ID < data.Series[j].ID
+	})
+	return data
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeGraphTimelineParam(t *testing.T) {
+	assert := require.New(t)
+	param := &NodeGraphTimelineParam{Step: 5 * time.Minute}
+	param.TiDBClusterID = "clinic"
+	param.TsRange = TsRange{StartTS: 1000, EndTS: 1000 + 1000}
+	assert.Nil(param.Validate())
+	ranges := param.Split()
+	assert.Len(ranges, 4)
+	assert.Equal(int64(4), param.Slices())
+	assert.Equal(TsRange{StartTS: 1000, EndTS: 1300}, ranges[0])
+	assert.Equal(TsRange{StartTS: 1900, EndTS: 2000}, ranges[3])
+
+	param.Step = 0
+	assert.NotNil(param.Validate())
+	param.Step = time.Second
+	param.EndTS = param.StartTS + maxNodeGraphSlices
+	assert.Nil(param.Validate())
+	param.EndTS++
+	assert.NotNil(param.Validate())
+	param.EndTS = param.StartTS + 31*24*3600
+	assert.EqualError(param.Validate(), "step is too small, 2678400 slices exceed the limit 240")
+
+	for s, expect := range map[string]time.Duration{"300": 5 * time.Minute, "1m30s": 90 * time.Second} {
+		step, err := ParseStep(s)
+		assert.Nil(err)
+		assert.Equal(expect, step)
+	}
+	_, err := ParseStep("5x")
+	assert.NotNil(err)
+}
+
+func TestNewNodeGraphTimelineData(t *testing.T) {
+	assert := require.New(t)
+	newGraph := func(similarities map[string]float64) *QueryNodeGraphData {
+		data := &QueryNodeGraphData{}
+		for id, similarity := range similarities {
+			node := DefaultNode()
+			node.ID = id
+			node.Title = id
+			node.ArcPositive = similarity
+			data.Nodes = append(data.Nodes, node)
+		}
+		return data
+	}
+	data := NewNodeGraphTimelineData(time.Minute, []*NodeGraphSlice{
+		{TsRange: TsRange{StartTS: 0, EndTS: 60}, NodeGraph: newGraph(map[string]float64{"8637": 0.6})},
+		{TsRange: TsRange{StartTS: 60, EndTS: 120}, NodeGraph: newGraph(map[string]float64{})},
+		{TsRange: TsRange{StartTS: 120, EndTS: 180}, NodeGraph: newGraph(map[string]float64{"8637": 0.9, "11271": 0.8})},
+	})
+	assert.Equal(int64(60), data.Step)
+	assert.Len(data.Slices, 3)
+	assert.Len(data.Series, 2)
+	assert.Equal("11271", data.Series[0].ID)
+	assert.Equal([]*SimilarityPoint{{Time: 60000, Similarity: 0.6}, {Time: 180000, Similarity: 0.9}}, data.Series[1].Points)
+}
+
+func TestQueryNodeGraphTimeline(t *testing.T) {
+	assert := require.New(t)
+	var mu sync.Mutex
+	requests := make([]url.Values, 0)
+	vm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+		mu.Lock()
+		requests = append(requests, req.Form)
+		mu.Unlock()
+		if req.URL.Path == "/api/v1/query_range" {
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[`+
+				`{"metric":{"id":"8637"},"values":[[1300,"0.6"],[1600,"0.9"]]},`+
+				`{"metric":{"id":"11271"},"values":[[1600,"0.8"]]}]}}`)
+			return
+		}
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[`+
+			`{"metric":{"id":"8637"},"value":[1700,"0.7"]}]}}`)
+	}))
+	defer vm.Close()
+	reportAPI, err := NewReportAPI("http://127.0.0.1:0", "org", "bucket", "token", WithVMOption(vm.URL),
+		WithSessionOption(&SessionConfig{Dir: filepath.Join(t.TempDir(), "sessions")}))
+	assert.Nil(err)
+	defer reportAPI.Close()
+
+	param := &NodeGraphTimelineParam{Step: 5 * time.Minute}
+	param.TiDBClusterID = "clinic"
+	param.Agg = RollUpMax
+	param.TsRange = TsRange{StartTS: 1000, EndTS: 1700}
+	assert.Nil(param.Validate())
+	data, err := reportAPI.QueryNodeGraphTimeline(context.Background(), param)
+	assert.Nil(err)
+
+	// the full windows share one range query, the short last window is queried alone
+	assert.Len(requests, 2)
+	assert.Equal(`max_over_time({__name__=~"fast_tune_similarity.*",tidb_cluster_id="clinic"}[300s])`, requests[0].Get("query"))
+	assert.Equal([]string{"1300", "1600", "300s"}, []string{requests[0].Get("start"), requests[0].Get("end"), requests[0].Get("step")})
+	assert.Equal(`max_over_time({__name__=~"fast_tune_similarity.*",tidb_cluster_id="clinic"}[100s])`, requests[1].Get("query"))
+	assert.Equal("1700", requests[1].Get("time"))
+
+	assert.Len(data.Slices, 3)
+	assert.Len(data.Slices[0].NodeGraph.Nodes, 1)
+	assert.Len(data.Slices[1].NodeGraph.Nodes, 2)
+	assert.Equal(TsRange{StartTS: 1600, EndTS: 1700}, data.Slices[2].TsRange)
+	assert.Equal([]*SimilarityPoint{{Time: 1300000, Similarity: 0.6}, {Time: 1600000, Similarity: 0.9}, {Time: 1700000, Similarity: 0.7}},
+		data.Series[1].Points)
+}
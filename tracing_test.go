@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	assert := require.New(t)
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(prev)
+	_, err := InitTracer(context.Background(), nil)
+	assert.Nil(err)
+
+	var traceparent string
+	vm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("traceparent")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[`+
+			`{"metric":{"__name__":"overview_qps"},"values":[[100,"12"]]}]}}`)
+	}))
+	defer vm.Close()
+	reportAPI, err := NewReportAPI("http://127.0.0.1:0", "org", "bucket", "token", WithVMOption(vm.URL),
+		WithSessionOption(&SessionConfig{Dir: filepath.Join(t.TempDir(), "sessions")}))
+	assert.Nil(err)
+	defer reportAPI.Close()
+	dataAPI, err := NewDataAPI(vm.URL)
+	assert.Nil(err)
+	router := NewRouter(&ReportEndpoint{}, reportAPI, dataAPI)
+
+	req := httptest.NewRequest(http.MethodGet, "/dynamic_text_value/v2?tidb_cluster_id=clinic&measurement=overview&start_ts=40&end_ts=100", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		// the whole request continues the trace of the caller
+		assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String(), span.Name())
+	}
+	for _, name := range []string{"GET /dynamic_text_value/v2", "ReportAPI.QueryDynamicTextValueV2",
+		"queryMetrics", "upstream vm", "HTTP POST", "decode MetricsQueryResult", "flatten"} {
+		assert.Contains(spans, name)
+	}
+	server := spans["GET /dynamic_text_value/v2"]
+	assert.Equal("00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Equal(server.SpanContext().SpanID(), spans["ReportAPI.QueryDynamicTextValueV2"].Parent().SpanID())
+	assert.Equal(spans["queryMetrics"].SpanContext().SpanID(), spans["upstream vm"].Parent().SpanID())
+	assert.Equal(spans["upstream vm"].SpanContext().SpanID(), spans["HTTP POST"].Parent().SpanID())
+	// the upstream sees the client span as the parent
+	assert.Equal(fmt.Sprintf("00-%s-%s-01", server.SpanContext().TraceID(), spans["HTTP POST"].SpanContext().SpanID()), traceparent)
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	assert := require.New(t)
+	buf := &bytes.Buffer{}
+	tp, err := newTracerProvider(context.Background(), &TracingConfig{Exporter: TracingExporterStdout}, buf)
+	assert.Nil(err)
+	_, span := tp.Tracer(tracerName).Start(context.Background(), "queryMetrics")
+	span.End()
+	assert.Nil(tp.Shutdown(context.Background()))
+	assert.Contains(buf.String(), `"Name":"queryMetrics"`)
+	assert.Contains(buf.String(), defaultServiceName)
+
+	_, err = newTracerProvider(context.Background(), &TracingConfig{Exporter: "jaeger"}, buf)
+	assert.NotNil(err)
+	ratio := 2.0
+	_, err = newTracerProvider(context.Background(), &TracingConfig{Exporter: TracingExporterStdout, SampleRatio: &ratio}, buf)
+	assert.NotNil(err)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// names of the builtin diagnosis trees
+const (
+	DefaultTreeName = "fast_tune"
+	LegacyTreeName  = "fast_tune_legacy"
+)
+
+// DiagnosisTree is the definition of a fast tune tree, the node ids are the ids
+// reported by the diagnosis job and Edges points from a node to its children.
+type DiagnosisTree struct {
+	Name   string
+	Edges  map[int64][]int64
+	Titles map[int64]string
+	// Agg is the roll-up used when the request has no `agg` param
+	Agg string
+}
+
+func builtinTrees() map[string]*DiagnosisTree {
+	return map[string]*DiagnosisTree{
+		DefaultTreeName: {Name: DefaultTreeName, Edges: EdgeMatrixV2, Titles: NodeTitlesV2, Agg: DefaultRollUp},
+		LegacyTreeName:  {Name: LegacyTreeName, Edges: EdgeMatrix, Titles: map[int64]string{}, Agg: DefaultRollUp},
+	}
+}
+
+// NewDiagnosisTree builds and validates the tree declared in config
+func NewDiagnosisTree(cfg *TreeConfig) (*DiagnosisTree, error) {
+	tree := &DiagnosisTree{
+		Name:   cfg.Name,
+		Edges:  cfg.Edges,
+		Titles: cfg.Titles,
+		Agg:    cfg.Agg,
+	}
+	if len(tree.Agg) == 0 {
+		tree.Agg = DefaultRollUp
+	}
+	if tree.Edges == nil {
+		tree.Edges = make(map[int64][]int64)
+	}
+	if tree.Titles == nil {
+		tree.Titles = make(map[int64]string)
+	}
+	if err := tree.Validate(); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// Validate checks the tree has a name, a supported roll-up, no self loop and no cycle
+func (tree *DiagnosisTree) Validate() error {
+	if len(tree.Name) == 0 {
+		return errors.New("tree name is empty")
+	}
+	if err := ValidateRollUp(tree.Agg); err != nil {
+		return fmt.Errorf("tree %s: %v", tree.Name, err)
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[int64]int)
+	var visit func(id int64) error
+	visit = func(id int64) error {
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("tree %s: cycle found at node %d", tree.Name, id)
+		case visited:
+			return nil
+		}
+		state[id] = visiting
+		for _, target := range tree.Edges[id] {
+			if target == id {
+				return fmt.Errorf("tree %s: node %d points to itself", tree.Name, id)
+			}
+			if err := visit(target); err != nil {
+				return err
+			}
+		}
+		state[id] = visited
+		return nil
+	}
+	for _, id := range tree.NodeIDs() {
+		if err := visit(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NodeIDs returns all node ids referred by the tree in ascending order
+func (tree *DiagnosisTree) NodeIDs() []int64 {
+	lookup := make(map[int64]struct{})
+	for source, targets := range tree.Edges {
+		lookup[source] = struct{}{}
+		for _, target := range targets {
+			lookup[target] = struct{}{}
+		}
+	}
+	ids := make([]int64, 0, len(lookup))
+	for id := range lookup {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// RollUp returns the aggregation of the request, or the tree default when not set
+func (tree *DiagnosisTree) RollUp(agg string) string {
+	if len(agg) > 0 {
+		return agg
+	}
+	if len(tree.Agg) > 0 {
+		return tree.Agg
+	}
+	return DefaultRollUp
+}
+
+// Title returns the title of the node, or empty when not defined
+func (tree *DiagnosisTree) Title(id int64) string {
+	return tree.Titles[id]
+}
+
+// Link returns the edges of the tree between the given nodes
+func (tree *DiagnosisTree) Link(nodes []*Node) []*Edge {
+	edges := make([]*Edge, 0)
+	nodesLookup := make(map[int64]struct{})
+	for _, node := range nodes {
+		id, err := strconv.ParseInt(node.ID, 0, 64)
+		if err != nil {
+			continue
+		}
+		nodesLookup[id] = struct{}{}
+	}
+	for _, node := range nodes {
+		id, _ := strconv.ParseInt(node.ID, 0, 64)
+		targets, ok := tree.Edges[id]
+		if !ok {
+			continue
+		}
+		for _, target := range targets {
+			if _, ok := nodesLookup[target]; !ok {
+				continue
+			}
+			edge := DefaultEdge()
+			edge.ID = fmt.Sprintf("%v%v", id, target)
+			edge.Source = node.ID
+			edge.Target = fmt.Sprintf("%v", target)
+			edges = append(edges, edge)
+		}
+	}
+	return edges
+}
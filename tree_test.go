@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnosisTree_Validate(t *testing.T) {
+	assert := require.New(t)
+	for _, tree := range builtinTrees() {
+		assert.Nil(tree.Validate(), tree.Name)
+	}
+	_, err := NewDiagnosisTree(&TreeConfig{Name: "cycle", Edges: map[int64][]int64{1: {2}, 2: {3}, 3: {1}}})
+	assert.NotNil(err)
+	_, err = NewDiagnosisTree(&TreeConfig{Name: "self", Edges: map[int64][]int64{1: {1}}})
+	assert.NotNil(err)
+	_, err = NewDiagnosisTree(&TreeConfig{Edges: map[int64][]int64{1: {2}}})
+	assert.NotNil(err)
+	tree, err := NewDiagnosisTree(&TreeConfig{Name: "dag", Edges: map[int64][]int64{1: {2, 3}, 2: {3}}})
+	assert.Nil(err)
+	assert.Equal([]int64{1, 2, 3}, tree.NodeIDs())
+}
+
+func TestDiagnosisTree_Link(t *testing.T) {
+	assert := require.New(t)
+	tree, err := NewDiagnosisTree(&TreeConfig{Name: "dag", Edges: map[int64][]int64{1: {2, 3}, 2: {3}}})
+	assert.Nil(err)
+	nodes := []*Node{{ID: "1"}, {ID: "3"}, {ID: "bad"}}
+	edges := tree.Link(nodes)
+	assert.Len(edges, 1)
+	assert.Equal("1", edges[0].Source)
+	assert.Equal("3", edges[0].Target)
+}
+
+func TestDiagnosisTree_RollUp(t *testing.T) {
+	assert := require.New(t)
+	tree, err := NewDiagnosisTree(&TreeConfig{Name: "dag", Edges: map[int64][]int64{1: {2}}})
+	assert.Nil(err)
+	assert.Equal(DefaultRollUp, tree.RollUp(""))
+	tree, err = NewDiagnosisTree(&TreeConfig{Name: "dag", Edges: map[int64][]int64{1: {2}}, Agg: RollUpMax})
+	assert.Nil(err)
+	assert.Equal(RollUpMax, tree.RollUp(""))
+	assert.Equal(RollUpP95, tree.RollUp(RollUpP95))
+	_, err = NewDiagnosisTree(&TreeConfig{Name: "dag", Agg: "median"})
+	assert.NotNil(err)
+
+	assert.Equal(`quantile_over_time(0.95, {id="1"}[60s])`, RollUpPromQL(RollUpP95, `{id="1"}`, "60s"))
+	assert.Equal(`avg_over_time({id="1"}[60s])`, RollUpPromQL(RollUpAvg, `{id="1"}`, "60s"))
+	assert.Equal(`mean()`, RollUpFlux(RollUpAvg))
+	for _, agg := range []string{RollUpFirst, RollUpLast, RollUpMax, RollUpAvg, RollUpP95} {
+		assert.Nil(ValidateRollUp(agg))
+		assert.NotEmpty(RollUpFlux(agg))
+	}
+	param := &QueryNodeGraphParam{TsRange: TsRange{StartTS: 1, EndTS: 2}, TiDBClusterID: "clinic", Agg: "sum"}
+	assert.NotNil(param.Validate())
+}
+
+func TestNewGrafanaDashboard(t *testing.T) {
+	assert := require.New(t)
+	tree := builtinTrees()[DefaultTreeName]
+	dashboard := NewGrafanaDashboard(&GrafanaConfig{}, tree, &GrafanaDashboardParam{
+		TiDBClusterID: "clinic",
+		Measurements:  []string{"diagnosis_overview", "write_stall"},
+	})
+	assert.Len(dashboard.Panels, 3)
+	assert.Equal("nodeGraph", dashboard.Panels[0].Type)
+	assert.Contains(dashboard.Panels[0].Targets[0].Params, [2]string{"tree", DefaultTreeName})
+	assert.Equal(int64(3), dashboard.Panels[2].ID)
+	assert.Contains(dashboard.Panels[2].Targets[0].Params, [2]string{"measurement", "write_stall"})
+	assert.Len(dashboard.Annotations.List, 1)
+	assert.Equal("/annotations/v2", dashboard.Annotations.List[0].Target.URLPath)
+	assert.Equal(defaultGrafanaDatasourceUID, dashboard.Annotations.List[0].Datasource.UID)
+}
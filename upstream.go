@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	http2 "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/pingcap/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+const (
+	UpstreamVM       = "vm"
+	UpstreamInfluxDB = "influxdb"
+)
+
+const (
+	defaultUpstreamTimeout  = 30 * time.Second
+	defaultMaxAttempts      = 3
+	defaultInitialBackoff   = 100 * time.Millisecond
+	defaultMaxBackoff       = 2 * time.Second
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned without calling the upstream while its breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// upstreamStatusError is the non 2xx response of the upstream
+type upstreamStatusError struct {
+	StatusCode int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("response status is %v", e.StatusCode)
+}
+
+// isRetryable reports whether err means the upstream is unavailable, such an
+// error is retried and counted by the breaker. The other errors, e.g. a bad
+// query, are returned at once.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	retryableStatus := func(code int) bool {
+		return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+	}
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		return retryableStatus(statusErr.StatusCode)
+	}
+	// the influxdb client reports the transport errors with status 0
+	var influxErr *http2.Error
+	if errors.As(err, &influxErr) {
+		return influxErr.StatusCode == 0 || retryableStatus(influxErr.StatusCode)
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker fails fast after consecutive failures, one probe is let through
+// after the open timeout and its result closes or reopens the breaker.
+type CircuitBreaker struct {
+	name        string
+	threshold   int
+	openTimeout time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func NewCircuitBreaker(name string, threshold int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:        name,
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		now:         time.Now,
+	}
+}
+
+// Allow returns ErrCircuitOpen when the call must not reach the upstream
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.openTimeout {
+			return ErrCircuitOpen
+		}
+		b.setState(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		// the probe is running
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// Record counts the result of an allowed call
+func (b *CircuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isRetryable(err) {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		if b.state != breakerOpen {
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+func (b *CircuitBreaker) setState(state breakerState) {
+	log.Warn("circuit breaker state changed", zap.String("upstream", b.name),
+		zap.Stringer("from", b.state), zap.Stringer("to", state))
+	b.state = state
+}
+
+// Open reports whether the calls are failing fast
+func (b *CircuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
+
+// Upstream runs the idempotent queries to one backend with a timeout per attempt,
+// retries with jittered backoff and a circuit breaker.
+type Upstream struct {
+	name           string
+	timeout        time.Duration
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	breaker        *CircuitBreaker
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func NewUpstream(name string, cfg *UpstreamConfig) (*Upstream, error) {
+	u := &Upstream{
+		name:           name,
+		timeout:        defaultUpstreamTimeout,
+		maxAttempts:    defaultMaxAttempts,
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     defaultMaxBackoff,
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	threshold, openTimeout := defaultFailureThreshold, defaultOpenTimeout
+	if cfg == nil {
+		cfg = &UpstreamConfig{}
+	}
+	parse := func(s string, d *time.Duration) error {
+		if len(s) == 0 {
+			return nil
+		}
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		if v <= 0 {
+			return fmt.Errorf("duration %q is not positive", s)
+		}
+		*d = v
+		return nil
+	}
+	if err := parse(cfg.Timeout, &u.timeout); err != nil {
+		return nil, err
+	}
+	if cfg.Retry != nil {
+		if cfg.Retry.MaxAttempts < 0 {
+			return nil, fmt.Errorf("retry max_attempts %d is negative", cfg.Retry.MaxAttempts)
+		}
+		if cfg.Retry.MaxAttempts > 0 {
+			u.maxAttempts = cfg.Retry.MaxAttempts
+		}
+		if err := parse(cfg.Retry.InitialBackoff, &u.initialBackoff); err != nil {
+			return nil, err
+		}
+		if err := parse(cfg.Retry.MaxBackoff, &u.maxBackoff); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Breaker != nil {
+		if cfg.Breaker.FailureThreshold < 0 {
+			return nil, fmt.Errorf("breaker failure_threshold %d is negative", cfg.Breaker.FailureThreshold)
+		}
+		if cfg.Breaker.FailureThreshold > 0 {
+			threshold = cfg.Breaker.FailureThreshold
+		}
+		if err := parse(cfg.Breaker.OpenTimeout, &openTimeout); err != nil {
+			return nil, err
+		}
+	}
+	u.breaker = NewCircuitBreaker(name, threshold, openTimeout)
+	return u, nil
+}
+
+// backoff returns the full jitter wait before the attempt-th retry
+func (u *Upstream) backoff(attempt int) time.Duration {
+	ceil := u.initialBackoff << uint(attempt)
+	if ceil > u.maxBackoff || ceil <= 0 {
+		ceil = u.maxBackoff
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Duration(u.rand.Int63n(int64(ceil) + 1))
+}
+
+// Do calls fn until it succeeds, returns an error which is not retryable or runs
+// out of attempts. fn must be idempotent.
+func (u *Upstream) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; attempt < u.maxAttempts; attempt++ {
+		if attempt > 0 {
+			wait := u.backoff(attempt - 1)
+			Logger(ctx).Warn("retry upstream", zap.String("upstream", u.name),
+				zap.Int("attempt", attempt+1), zap.Duration("backoff", wait), zap.Error(err))
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		if err = u.breaker.Allow(); err != nil {
+			return fmt.Errorf("%s: %w", u.name, err)
+		}
+		err = u.attempt(ctx, attempt, fn)
+		u.breaker.Record(err)
+		if !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (u *Upstream) attempt(ctx context.Context, attempt int, fn func(ctx context.Context) error) (err error) {
+	ctx, span := startSpan(ctx, "upstream "+u.name, attribute.Int("attempt", attempt+1))
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+	return fn(ctx)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	http2 "github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetryable(t *testing.T) {
+	assert := require.New(t)
+	for _, c := range []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{errors.New("bad promql"), false},
+		{context.Canceled, false},
+		{fmt.Errorf("vm: %w", ErrCircuitOpen), false},
+		{context.DeadlineExceeded, true},
+		{&upstreamStatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&upstreamStatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{&upstreamStatusError{StatusCode: http.StatusBadRequest}, false},
+		{http2.NewError(errors.New("connection refused")), true},
+		{&http2.Error{StatusCode: http.StatusBadRequest, Code: "invalid"}, false},
+		{&http2.Error{StatusCode: http.StatusBadGateway}, true},
+	} {
+		assert.Equal(c.retryable, isRetryable(c.err), "%v", c.err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := require.New(t)
+	b := NewCircuitBreaker(UpstreamVM, 2, time.Minute)
+	now := time.Unix(1000, 0)
+	b.now = func() time.Time { return now }
+	down := &upstreamStatusError{StatusCode: http.StatusServiceUnavailable}
+
+	assert.Nil(b.Allow())
+	b.Record(down)
+	// a bad query means the upstream is up
+	b.Record(errors.New("bad promql"))
+	b.Record(down)
+	assert.False(b.Open())
+	b.Record(down)
+	assert.True(b.Open())
+	assert.Equal(ErrCircuitOpen, b.Allow())
+
+	// one probe after the open timeout, the failed probe reopens the breaker at once
+	now = now.Add(time.Minute)
+	assert.Nil(b.Allow())
+	assert.Equal(ErrCircuitOpen, b.Allow())
+	b.Record(down)
+	assert.Equal(ErrCircuitOpen, b.Allow())
+
+	now = now.Add(time.Minute)
+	assert.Nil(b.Allow())
+	b.Record(nil)
+	assert.False(b.Open())
+	assert.Nil(b.Allow())
+}
+
+func TestUpstream_Do(t *testing.T) {
+	assert := require.New(t)
+	_, err := NewUpstream(UpstreamVM, &UpstreamConfig{Timeout: "-1s"})
+	assert.NotNil(err)
+	_, err = NewUpstream(UpstreamVM, &UpstreamConfig{Retry: &RetryConfig{MaxBackoff: "soon"}})
+	assert.NotNil(err)
+
+	u, err := NewUpstream(UpstreamVM, &UpstreamConfig{
+		Timeout: "50ms",
+		Retry:   &RetryConfig{MaxAttempts: 3, InitialBackoff: "1ms", MaxBackoff: "2ms"},
+		Breaker: &BreakerConfig{FailureThreshold: 4, OpenTimeout: "1h"},
+	})
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		assert.LessOrEqual(u.backoff(i), 2*time.Millisecond)
+	}
+
+	// the transient failures are retried
+	attempts := 0
+	err = u.Do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return &upstreamStatusError{StatusCode: http.StatusBadGateway}
+		}
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal(3, attempts)
+
+	// the bad query is not
+	attempts = 0
+	err = u.Do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return &upstreamStatusError{StatusCode: http.StatusBadRequest}
+	})
+	assert.NotNil(err)
+	assert.Equal(1, attempts)
+
+	// every attempt has its own timeout, the breaker opens after 4 consecutive failures
+	attempts = 0
+	err = u.Do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	assert.Equal(3, attempts)
+	err = u.Do(context.Background(), func(ctx context.Context) error {
+		attempts++
+		return &upstreamStatusError{StatusCode: http.StatusBadGateway}
+	})
+	assert.ErrorIs(err, ErrCircuitOpen)
+	assert.Equal(4, attempts)
+}
+
+func TestUpstreamFallback(t *testing.T) {
+	assert := require.New(t)
+	var vmCalls int32
+	vm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&vmCalls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer vm.Close()
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		fmt.Fprint(w, "#datatype,string,long,double,string\n"+
+			"#group,false,false,false,true\n"+
+			"#default,_result,,,\n"+
+			",result,table,_value,id\n"+
+			",,0,0.9,8637\n\n")
+	}))
+	defer influx.Close()
+
+	reportAPI, err := NewReportAPI(influx.URL, "org", "bucket", "token", WithVMOption(vm.URL),
+		WithSessionOption(&SessionConfig{Dir: filepath.Join(t.TempDir(), "sessions")}),
+		WithUpstreamOption(&UpstreamConfig{
+			Retry:              &RetryConfig{MaxAttempts: 1},
+			Breaker:            &BreakerConfig{FailureThreshold: 1, OpenTimeout: "1h"},
+			FallbackToInfluxDB: true,
+		}))
+	assert.Nil(err)
+	defer reportAPI.Close()
+
+	param := &QueryNodeGraphParam{TsRange: TsRange{StartTS: 1, EndTS: 61}, TiDBClusterID: "clinic"}
+	_, err = reportAPI.QueryNodeGraphV2(context.Background(), param)
+	var statusErr *upstreamStatusError
+	assert.ErrorAs(err, &statusErr)
+
+	// vm is not called while the breaker is open
+	data, err := reportAPI.QueryNodeGraphV2(context.Background(), param)
+	assert.Nil(err)
+	assert.Len(data.Nodes, 1)
+	assert.Equal("8637", data.Nodes[0].ID)
+	assert.Equal(int32(1), atomic.LoadInt32(&vmCalls))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/pingcap/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWriteBatchSize        = 5000
+	defaultWriteFlushInterval    = time.Second
+	defaultWriteRetryBufferLimit = 50000
+)
+
+var writePrecisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// writeOptions are the parsed InfluxDBWriteConfig
+type writeOptions struct {
+	batchSize        uint
+	flushInterval    time.Duration
+	retryBufferLimit uint
+	precision        time.Duration
+	useGzip          bool
+}
+
+func newWriteOptions(cfg *InfluxDBWriteConfig) (*writeOptions, error) {
+	opts := &writeOptions{
+		batchSize:        defaultWriteBatchSize,
+		flushInterval:    defaultWriteFlushInterval,
+		retryBufferLimit: defaultWriteRetryBufferLimit,
+		precision:        time.Nanosecond,
+	}
+	if cfg == nil {
+		return opts, nil
+	}
+	if cfg.BatchSize > 0 {
+		opts.batchSize = cfg.BatchSize
+	}
+	if len(cfg.FlushInterval) > 0 {
+		d, err := time.ParseDuration(cfg.FlushInterval)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("flush_interval %q is not positive", cfg.FlushInterval)
+		}
+		opts.flushInterval = d
+	}
+	if cfg.RetryBufferLimit > 0 {
+		opts.retryBufferLimit = cfg.RetryBufferLimit
+	}
+	if len(cfg.Precision) > 0 {
+		precision, ok := writePrecisions[cfg.Precision]
+		if !ok {
+			return nil, fmt.Errorf("precision %q is not one of ns, us, ms and s", cfg.Precision)
+		}
+		opts.precision = precision
+	}
+	opts.useGzip = cfg.UseGzip
+	return opts, nil
+}
+
+// apply sets the options of the influxdb write api, the flush interval of the
+// client is left as is since the points reach it only when they are flushed
+func (o *writeOptions) apply(opts *influxdb2.Options) {
+	opts.SetBatchSize(o.batchSize).
+		SetRetryBufferLimit(o.retryBufferLimit).
+		SetPrecision(o.precision).
+		SetUseGZip(o.useGzip)
+}
+
+// sampleBuffer keeps the /sample points by tidb_cluster_id until they are flushed
+type sampleBuffer struct {
+	batchSize int
+	// full is signaled when a cluster has batchSize points
+	full chan struct{}
+
+	mu     sync.Mutex
+	points map[string][]*write.Point
+}
+
+func newSampleBuffer(batchSize uint) *sampleBuffer {
+	return &sampleBuffer{
+		batchSize: int(batchSize),
+		full:      make(chan struct{}, 1),
+		points:    make(map[string][]*write.Point),
+	}
+}
+
+func (b *sampleBuffer) add(clusterID string, point *write.Point) {
+	b.mu.Lock()
+	b.points[clusterID] = append(b.points[clusterID], point)
+	n := len(b.points[clusterID])
+	b.mu.Unlock()
+	if n >= b.batchSize {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// take removes the points of the cluster, or of all clusters when clusterID is empty
+func (b *sampleBuffer) take(clusterID string) map[string][]*write.Point {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(clusterID) == 0 {
+		points := b.points
+		b.points = make(map[string][]*write.Point)
+		return points
+	}
+	points, ok := b.points[clusterID]
+	if !ok {
+		return nil
+	}
+	delete(b.points, clusterID)
+	return map[string][]*write.Point{clusterID: points}
+}
+
+// Flush hands the buffered points of the cluster, or of all clusters when clusterID
+// is empty, to the write api and waits until they are sent to influxdb
+func (api *ReportAPI) Flush(ctx context.Context, clusterID string) (*FlushData, error) {
+	_, span := startSpan(ctx, "ReportAPI.Flush", attribute.String("tidb_cluster_id", clusterID))
+	defer span.End()
+	data := api.flush(clusterID)
+	span.SetAttributes(attribute.Int("points", data.Points))
+	return data, nil
+}
+
+// flush is Flush without the span, the scheduler calls it every flush interval
+func (api *ReportAPI) flush(clusterID string) *FlushData {
+	api.flushMu.Lock()
+	defer api.flushMu.Unlock()
+	data := &FlushData{Clusters: make([]*ClusterFlushData, 0)}
+	for id, points := range api.samples.take(clusterID) {
+		for _, point := range points {
+			api.writeAPI.WritePoint(point)
+		}
+		data.Points += len(points)
+		data.Clusters = append(data.Clusters, &ClusterFlushData{TiDBClusterID: id, Points: len(points)})
+	}
+	sort.Slice(data.Clusters, func(i, j int) bool {
+		return data.Clusters[i].TiDBClusterID < data.Clusters[j].TiDBClusterID
+	})
+	api.writeAPI.Flush()
+	return data
+}
+
+// flushLoop flushes all clusters every flush interval, and at once when a cluster
+// has a full batch
+func (api *ReportAPI) flushLoop() {
+	defer close(api.flushDone)
+	ticker := time.NewTicker(api.writeOpts.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-api.stopFlush:
+			return
+		case <-ticker.C:
+		case <-api.samples.full:
+		}
+		if data := api.flush(""); data.Points > 0 {
+			log.Debug("scheduled flush", zap.Int("points", data.Points), zap.Int("clusters", len(data.Clusters)))
+		}
+	}
+}
+
+// WriteStats counts the points of the async influxdb writes
+type WriteStats struct {
+	// Accepted points are handed to the write api
+	Accepted int64 `json:"accepted"`
+	// Written points are acknowledged by influxdb
+	Written int64 `json:"written"`
+	// FailedBatches are the batches reported failed by the write api
+	FailedBatches int64 `json:"failed_batches"`
+}
+
+// Unwritten returns the points which are still buffered or have been dropped,
+// they are lost when the process exits
+func (s WriteStats) Unwritten() int64 {
+	return s.Accepted - s.Written
+}
+
+type writeCounter struct {
+	accepted      int64
+	written       int64
+	failedBatches int64
+}
+
+func (c *writeCounter) Stats() WriteStats {
+	return WriteStats{
+		Accepted:      atomic.LoadInt64(&c.accepted),
+		Written:       atomic.LoadInt64(&c.written),
+		FailedBatches: atomic.LoadInt64(&c.failedBatches),
+	}
+}
+
+// countLines counts the points of a line protocol batch
+func countLines(batch []byte) int64 {
+	var n int64
+	for _, line := range bytes.Split(batch, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// writeCountingTransport counts the points of the influxdb write requests which
+// are acknowledged, the batches are bounded by the batch size so the body is
+// buffered to be counted.
+type writeCountingTransport struct {
+	base    http.RoundTripper
+	counter *writeCounter
+}
+
+func (t *writeCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || !strings.HasSuffix(req.URL.Path, "/api/v2/write") || req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+	bs, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(bs))
+	req.ContentLength = int64(len(bs))
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode/100 == 2 {
+		atomic.AddInt64(&t.counter.written, countBodyLines(bs, req.Header.Get("Content-Encoding")))
+	}
+	return resp, err
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the base transport
+func (t *writeCountingTransport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+func countBodyLines(body []byte, encoding string) int64 {
+	if encoding != "gzip" {
+		return countLines(body)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return 0
+	}
+	defer r.Close()
+	bs, err := io.ReadAll(r)
+	if err != nil {
+		return 0
+	}
+	return countLines(bs)
+}
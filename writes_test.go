@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func insertSamples(t *testing.T, api *ReportAPI, clusterID string, n int) {
+	for i := 0; i < n; i++ {
+		_, err := api.InsertSample(context.Background(), &InsertSampleParam{
+			Timestamp:     int64(i + 1),
+			Measurement:   "m",
+			TiDBClusterID: clusterID,
+			Fields:        map[string]interface{}{"f": i},
+			Tags:          map[string]string{"tag": "a"},
+		})
+		require.Nil(t, err)
+	}
+}
+
+// newFakeInfluxDB accepts the writes and counts their points, the body is gzip
+// decoded when the request is compressed
+func newFakeInfluxDB(t *testing.T) (*httptest.Server, *int64) {
+	var lines int64
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		bs, _ := io.ReadAll(req.Body)
+		atomic.AddInt64(&lines, countBodyLines(bs, req.Header.Get("Content-Encoding")))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(influx.Close)
+	return influx, &lines
+}
+
+func TestCountBodyLines(t *testing.T) {
+	assert := require.New(t)
+	batch := []byte("m,tag=a f=1 1\nm,tag=b f=2 2\n\n")
+	assert.Equal(int64(2), countBodyLines(batch, ""))
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	_, err := w.Write(batch)
+	assert.Nil(err)
+	assert.Nil(w.Close())
+	assert.Equal(int64(2), countBodyLines(buf.Bytes(), "gzip"))
+}
+
+func TestNewWriteOptions(t *testing.T) {
+	assert := require.New(t)
+	opts, err := newWriteOptions(nil)
+	assert.Nil(err)
+	assert.Equal(&writeOptions{
+		batchSize:        defaultWriteBatchSize,
+		flushInterval:    defaultWriteFlushInterval,
+		retryBufferLimit: defaultWriteRetryBufferLimit,
+		precision:        time.Nanosecond,
+	}, opts)
+
+	opts, err = newWriteOptions(&InfluxDBWriteConfig{
+		BatchSize: 100, FlushInterval: "10s", RetryBufferLimit: 1000, Precision: "s", UseGzip: true,
+	})
+	assert.Nil(err)
+	assert.Equal(&writeOptions{
+		batchSize:        100,
+		flushInterval:    10 * time.Second,
+		retryBufferLimit: 1000,
+		precision:        time.Second,
+		useGzip:          true,
+	}, opts)
+
+	_, err = newWriteOptions(&InfluxDBWriteConfig{Precision: "m"})
+	assert.NotNil(err)
+	_, err = newWriteOptions(&InfluxDBWriteConfig{FlushInterval: "-1s"})
+	assert.NotNil(err)
+}
+
+func TestFlushByCluster(t *testing.T) {
+	assert := require.New(t)
+	influx, lines := newFakeInfluxDB(t)
+	reportAPI, err := NewReportAPI(influx.URL, "org", "bucket", "token",
+		WithInfluxDBWriteOption(&InfluxDBWriteConfig{FlushInterval: "1h", Precision: "s", UseGzip: true}))
+	assert.Nil(err)
+	defer reportAPI.Close()
+	insertSamples(t, reportAPI, "a", 2)
+	insertSamples(t, reportAPI, "b", 3)
+	insertSamples(t, reportAPI, "c", 1)
+
+	data, err := reportAPI.Flush(context.Background(), "a")
+	assert.Nil(err)
+	assert.Equal(&FlushData{Points: 2, Clusters: []*ClusterFlushData{{TiDBClusterID: "a", Points: 2}}}, data)
+	assert.Eventually(func() bool { return atomic.LoadInt64(lines) == 2 }, time.Second, 10*time.Millisecond)
+
+	data, err = reportAPI.Flush(context.Background(), "a")
+	assert.Nil(err)
+	assert.Equal(0, data.Points)
+
+	data, err = reportAPI.Flush(context.Background(), "")
+	assert.Nil(err)
+	assert.Equal(&FlushData{Points: 4, Clusters: []*ClusterFlushData{
+		{TiDBClusterID: "b", Points: 3},
+		{TiDBClusterID: "c", Points: 1},
+	}}, data)
+	assert.Eventually(func() bool { return atomic.LoadInt64(lines) == 6 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(func() bool { return reportAPI.WriteStats().Written == 6 }, time.Second, 10*time.Millisecond)
+}
+
+func TestFlushScheduler(t *testing.T) {
+	assert := require.New(t)
+	influx, lines := newFakeInfluxDB(t)
+	// flushed by the interval
+	reportAPI, err := NewReportAPI(influx.URL, "org", "bucket", "token",
+		WithInfluxDBWriteOption(&InfluxDBWriteConfig{FlushInterval: "20ms"}))
+	assert.Nil(err)
+	defer reportAPI.Close()
+	insertSamples(t, reportAPI, "a", 3)
+	assert.Eventually(func() bool { return atomic.LoadInt64(lines) == 3 }, time.Second, 10*time.Millisecond)
+
+	// flushed by the full batch
+	reportAPI, err = NewReportAPI(influx.URL, "org", "bucket", "token",
+		WithInfluxDBWriteOption(&InfluxDBWriteConfig{BatchSize: 2, FlushInterval: "1h"}))
+	assert.Nil(err)
+	defer reportAPI.Close()
+	insertSamples(t, reportAPI, "a", 1)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(int64(3), atomic.LoadInt64(lines))
+	insertSamples(t, reportAPI, "a", 1)
+	assert.Eventually(func() bool { return atomic.LoadInt64(lines) == 5 }, time.Second, 10*time.Millisecond)
+}
+
+func TestWriteStatsSkipAnnotations(t *testing.T) {
+	assert := require.New(t)
+	var lines int64
+	var rejectSamples int32
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		bs, _ := io.ReadAll(req.Body)
+		// the samples are written with measurement m, the annotations with fast_tune_anomaly
+		if atomic.LoadInt32(&rejectSamples) == 1 && bytes.HasPrefix(bs, []byte("m,")) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt64(&lines, countBodyLines(bs, req.Header.Get("Content-Encoding")))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+	reportAPI, err := NewReportAPI(influx.URL, "org", "bucket", "token",
+		WithInfluxDBWriteOption(&InfluxDBWriteConfig{FlushInterval: "1h", Precision: "s"}))
+	assert.Nil(err)
+	defer reportAPI.Close()
+	createAnnotation := func() {
+		param := &AnnotationParam{TiDBClusterID: "a", Time: 1, Title: "write stall"}
+		assert.Nil(param.Validate())
+		_, err := reportAPI.CreateAnnotation(context.Background(), param)
+		assert.Nil(err)
+	}
+
+	// the blocking annotation writes are neither accepted nor written
+	insertSamples(t, reportAPI, "a", 2)
+	createAnnotation()
+	assert.Equal(int64(1), atomic.LoadInt64(&lines))
+	_, err = reportAPI.Flush(context.Background(), "")
+	assert.Nil(err)
+	assert.Eventually(func() bool { return atomic.LoadInt64(&lines) == 3 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(func() bool { return reportAPI.WriteStats().Written == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(WriteStats{Accepted: 2, Written: 2}, reportAPI.WriteStats())
+
+	// an annotation written while the samples fail does not hide the lost samples
+	atomic.StoreInt32(&rejectSamples, 1)
+	insertSamples(t, reportAPI, "a", 2)
+	createAnnotation()
+	_, err = reportAPI.Flush(context.Background(), "")
+	assert.Nil(err)
+	assert.Eventually(func() bool { return reportAPI.WriteStats().FailedBatches == 1 }, time.Second, 10*time.Millisecond)
+	stats := reportAPI.WriteStats()
+	assert.Equal(int64(2), stats.Written)
+	assert.Equal(int64(2), stats.Unwritten())
+	assert.Equal(int64(4), atomic.LoadInt64(&lines))
+}